@@ -0,0 +1,93 @@
+package websocketproxy
+
+// aliasTable is the alias table used by the WeightedRandom strategy to draw
+// a backend proportionally to its weight in constant time, see Vose's alias
+// method.
+type aliasTable struct {
+	// members are the backends the table was built from, to detect changes.
+	members []*backend
+	// prob is the chance to keep column i, alias the backend taken instead.
+	prob  []float64
+	alias []int
+}
+
+// buildAlias builds the alias table from the weights of the backends.
+// Callers must hold mu.
+func (w *WebsocketProxy) buildAlias() *aliasTable {
+	members := append([]*backend(nil), w.backends[:len(w.Backends)]...)
+	n := len(members)
+	t := &aliasTable{members: members, prob: make([]float64, n), alias: make([]int, n)}
+
+	total := 0
+	for _, b := range members {
+		total += b.weight
+	}
+	if total <= 0 {
+		return t
+	}
+
+	// Scale the weights so that they average to 1, then pair each column
+	// below 1 with one above 1 that fills it up.
+	scaled := make([]float64, n)
+	var small, large []int
+	for i, b := range members {
+		scaled[i] = float64(b.weight) * float64(n) / float64(total)
+		if scaled[i] < 1 {
+			small = append(small, i)
+		} else {
+			large = append(large, i)
+		}
+	}
+	for len(small) > 0 && len(large) > 0 {
+		s, l := small[len(small)-1], large[len(large)-1]
+		small = small[:len(small)-1]
+		t.prob[s], t.alias[s] = scaled[s], l
+		scaled[l] -= 1 - scaled[s]
+		if scaled[l] < 1 {
+			large = large[:len(large)-1]
+			small = append(small, l)
+		}
+	}
+	// What is left is 1 up to rounding errors.
+	for _, i := range append(small, large...) {
+		t.prob[i], t.alias[i] = 1, i
+	}
+	return t
+}
+
+// current reports whether t was built from the current backends. Callers
+// must hold mu.
+func (t *aliasTable) current(w *WebsocketProxy) bool {
+	return t != nil && w.sameBackends(t.members)
+}
+
+// draw picks a column and whether to keep it from a single random number.
+func (t *aliasTable) draw() int {
+	x := randomFloat64() * float64(len(t.prob))
+	i := int(x)
+	if x-float64(i) < t.prob[i] {
+		return i
+	}
+	return t.alias[i]
+}
+
+// weightedRandom draws a backend from the alias table, drawing again when
+// the backend is not selectable or does not speak any of protocols. After
+// as many draws as there are backends it falls back to randomBackend.
+// Callers must hold mu.
+func (w *WebsocketProxy) weightedRandom(protocols []string) int {
+	if !w.alias.current(w) {
+		w.alias = w.buildAlias()
+	}
+	t := w.alias
+	if len(t.prob) == 0 {
+		return -1
+	}
+	for i := 0; i < len(t.prob); i++ {
+		index := t.draw()
+		if w.selectable(index) && w.backends[index].speaks(protocols) {
+			return index
+		}
+	}
+	return w.randomBackend(protocols)
+}
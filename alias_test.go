@@ -0,0 +1,65 @@
+package websocketproxy
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWeightedRandomDistribution(t *testing.T) {
+	proxy := NewProxy()
+	proxy.Strategy = WeightedRandom
+	weights := []int{1, 2, 3, 4}
+	for i, weight := range weights {
+		u, _ := url.Parse("ws://127.0.0.1:900" + strconv.Itoa(i))
+		proxy.AddBackendWeighted(u, weight)
+	}
+
+	counts := make(map[int]int)
+	for i := 0; i < 10000; i++ {
+		index, _ := proxy.selectBackend(nil)
+		counts[index]++
+	}
+	for i, weight := range weights {
+		want := 1000 * weight
+		if counts[i] < want*8/10 || counts[i] > want*12/10 {
+			t.Errorf("backend %d of weight %d selected %d times out of 10000", i, weight, counts[i])
+		}
+	}
+
+	// A backend whose circuit is open is drawn again, the others keep
+	// their proportions.
+	proxy.tripBackend(3, time.Hour)
+	counts = make(map[int]int)
+	for i := 0; i < 6000; i++ {
+		index, _ := proxy.selectBackend(nil)
+		counts[index]++
+	}
+	if counts[3] != 0 {
+		t.Errorf("expecting no selection of the tripped backend, got: %d", counts[3])
+	}
+	for i, weight := range weights[:3] {
+		want := 1000 * weight
+		if counts[i] < want*8/10 || counts[i] > want*12/10 {
+			t.Errorf("backend %d of weight %d selected %d times out of 6000", i, weight, counts[i])
+		}
+	}
+}
+
+func TestWeightedRandomRebuildsOnChange(t *testing.T) {
+	u1, _ := url.Parse("ws://127.0.0.1:9001")
+	u2, _ := url.Parse("ws://127.0.0.1:9002")
+
+	proxy := NewProxy()
+	proxy.Strategy = WeightedRandom
+	proxy.AddBackend(u1)
+	if index, _ := proxy.selectBackend(nil); index != 0 {
+		t.Fatalf("expecting the only backend, got: %d", index)
+	}
+
+	proxy.SetBackends([]*url.URL{u2})
+	if index, b := proxy.selectBackend(nil); index != 0 || b.target != u2 {
+		t.Errorf("expecting the new backend, got: %d", index)
+	}
+}
@@ -0,0 +1,329 @@
+package websocketproxy
+
+import (
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// random is the source for the random fallback selection. It is seeded once
+// since reseeding per call repeats values for calls within the same clock
+// tick.
+var (
+	randomMu sync.Mutex
+	random   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// randomIntn returns a random number in [0, n) from random.
+func randomIntn(n int) int {
+	randomMu.Lock()
+	defer randomMu.Unlock()
+	return random.Intn(n)
+}
+
+// randomInt63n returns a random number in [0, n) from random.
+func randomInt63n(n int64) int64 {
+	randomMu.Lock()
+	defer randomMu.Unlock()
+	return random.Int63n(n)
+}
+
+// randomFloat64 returns a random number in [0, 1) from random.
+func randomFloat64() float64 {
+	randomMu.Lock()
+	defer randomMu.Unlock()
+	return random.Float64()
+}
+
+// Strategy is the algorithm used to pick a backend for a new connection.
+type Strategy int
+
+const (
+	// RoundRobin spreads connections over the backends in turn, honoring the
+	// weights given to AddBackendWeighted. This is the default strategy.
+	RoundRobin Strategy = iota
+
+	// LeastConnections picks the backend with the fewest proxied connections
+	// that are currently open. It suits long-lived WebSocket sessions better
+	// than RoundRobin because it reacts to sessions that stay around.
+	LeastConnections
+
+	// ConsistentHash maps the key of each request, its path unless HashKey
+	// is set, to a backend on a consistent hash ring. The same key keeps
+	// hitting the same backend, and adding or removing a backend only moves
+	// the keys of a fair share of the ring, which suits caching backends.
+	ConsistentHash
+
+	// WeightedLoad picks the backend with the lowest load score given to
+	// SetBackendLoad, letting an external controller steer connections by
+	// the real load of the backends. Backends without a score count as
+	// idle, and ties go to the backend with fewer open connections.
+	WeightedLoad
+
+	// WeightedRandom picks a backend at random with a probability
+	// proportional to the weight given to AddBackendWeighted. Unlike
+	// RoundRobin it does not hand out connections in a fixed order, which
+	// avoids bursts of new long-lived connections on the same backend.
+	WeightedRandom
+)
+
+// backend holds the bookkeeping kept next to each entry of Backends.
+type backend struct {
+	target *url.URL
+	url    func(*http.Request) *url.URL
+
+	// weight and currentWeight drive the smooth weighted round-robin used by
+	// selectBackend, see nextWeighted.
+	weight        int
+	currentWeight int
+
+	// conns is the number of open connections proxied to this backend and
+	// served the number proxied to it so far. maxConns, if non-zero, is the
+	// limit given to AddBackendWithLimit.
+	conns    int
+	served   int
+	maxConns int
+
+	// unhealthy is set by the health checker while the backend fails its
+	// checks. Unhealthy backends are never selected.
+	unhealthy bool
+
+	// draining is set by DrainBackend. Draining backends keep their
+	// connections but are never selected.
+	draining bool
+
+	// down is set when dialing the backend failed and cleared by the next
+	// successful dial, to report OnBackendUp.
+	down bool
+
+	// circuit skips the backend after repeated dial failures.
+	circuit circuit
+
+	// load is the score given to SetBackendLoad at loadSet, see
+	// currentLoad.
+	load    float64
+	loadSet time.Time
+
+	// host, if set by SetBackendHost, is sent as Host header and TLS server
+	// name instead of the host of target.
+	host string
+
+	// header is set on every dial request to this backend, see
+	// AddBackendWithHeaders.
+	header http.Header
+
+	// protocols lists the subprotocols the backend speaks. Empty means the
+	// backend takes any client.
+	protocols []string
+}
+
+// speaks reports whether b supports one of the subprotocols requested by a
+// client. A client requesting none can use any backend.
+func (b *backend) speaks(requested []string) bool {
+	if len(b.protocols) == 0 || len(requested) == 0 {
+		return true
+	}
+	for _, p := range requested {
+		for _, q := range b.protocols {
+			if p == q {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// full reports whether b has reached its connection limit. Callers must
+// hold mu.
+func (b *backend) full() bool {
+	return b.maxConns > 0 && b.conns >= b.maxConns
+}
+
+// syncBackends keeps backends aligned with entries appended to Backends
+// directly. Callers must hold mu.
+func (w *WebsocketProxy) syncBackends() {
+	for i := len(w.backends); i < len(w.Backends); i++ {
+		w.backends = append(w.backends, &backend{url: w.Backends[i], weight: 1})
+	}
+}
+
+// selectBackend returns the index of the backend for req together with its
+// bookkeeping, both read under the same lock. The index is -1 when no
+// backend can be selected. req may be nil when no request is at hand.
+func (w *WebsocketProxy) selectBackend(req *http.Request) (int, *backend) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.pickBackend(req)
+}
+
+// reserveBackend selects the backend for req like selectBackend and counts
+// the new connection against it under the same lock, so concurrent
+// handshakes cannot exceed the limit given to AddBackendWithLimit while
+// they dial. Every successful call must be paired with releaseBackend, or
+// with unreserveBackend if the connection is never established.
+func (w *WebsocketProxy) reserveBackend(req *http.Request) (int, *backend) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	index, b := w.pickBackend(req)
+	if index >= 0 {
+		b.conns++
+		b.served++
+	}
+	return index, b
+}
+
+// pickBackend implements selectBackend. Callers must hold mu.
+func (w *WebsocketProxy) pickBackend(req *http.Request) (int, *backend) {
+	w.syncBackends()
+	w.ReqCount++
+
+	var protocols []string
+	if req != nil {
+		protocols = subprotocols(req)
+		if index := w.stickyBackend(req, protocols); index >= 0 {
+			w.backends[index].circuit.probe(time.Now(), w.cooldownDuration())
+			return index, w.backends[index]
+		}
+	}
+
+	var index int
+	switch {
+	case w.Selector != nil:
+		index = w.Selector(req, w.backendStatus())
+		if index < 0 || index >= len(w.Backends) || !w.selectable(index) || !w.backends[index].speaks(protocols) {
+			index = -1
+		}
+	case w.Strategy == LeastConnections:
+		index = w.leastConnections(protocols)
+	case w.Strategy == ConsistentHash:
+		index = w.consistentHash(req, protocols)
+	case w.Strategy == WeightedLoad:
+		index = w.weightedLoad(protocols)
+	case w.Strategy == WeightedRandom:
+		index = w.weightedRandom(protocols)
+	default:
+		index = w.roundRobin(protocols)
+	}
+	if index < 0 {
+		return -1, nil
+	}
+
+	w.backends[index].circuit.probe(time.Now(), w.cooldownDuration())
+	return index, w.backends[index]
+}
+
+// roundRobin walks the weighted round-robin order, skipping backends that
+// are not selectable or do not speak any of protocols. Callers must hold mu.
+func (w *WebsocketProxy) roundRobin(protocols []string) int {
+	var index, selectcnt int
+	backendcnt := len(w.Backends)
+	for {
+		if selectcnt >= backendcnt {
+			return w.randomBackend(protocols)
+		}
+		index = w.nextWeighted()
+		if !w.selectable(index) || !w.backends[index].speaks(protocols) {
+			selectcnt++
+			continue
+		}
+		return index
+	}
+}
+
+// nextWeighted picks a backend with the smooth weighted round-robin algorithm
+// also used by nginx: every backend gains its weight, the one with the
+// highest current weight wins and is lowered by the total weight. With equal
+// weights this is plain round-robin. Callers must hold mu.
+func (w *WebsocketProxy) nextWeighted() int {
+	best, total := -1, 0
+	for i := range w.Backends {
+		b := w.backends[i]
+		b.currentWeight += b.weight
+		total += b.weight
+		if best < 0 || b.currentWeight > w.backends[best].currentWeight {
+			best = i
+		}
+	}
+	w.backends[best].currentWeight -= total
+	return best
+}
+
+// leastConnections picks the backend with the fewest open connections among
+// the selectable ones speaking one of protocols. Callers must hold mu.
+func (w *WebsocketProxy) leastConnections(protocols []string) int {
+	index := -1
+	for i := range w.Backends {
+		if !w.selectable(i) || !w.backends[i].speaks(protocols) {
+			continue
+		}
+		if index < 0 || w.backends[i].conns < w.backends[index].conns {
+			index = i
+		}
+	}
+	if index < 0 {
+		return w.randomBackend(protocols)
+	}
+	return index
+}
+
+// selectable reports whether the backend at index may receive a new
+// connection, that is it is healthy, not draining, not full, its circuit is
+// not open and, if half-open, has a probe to spare. Callers must hold mu.
+func (w *WebsocketProxy) selectable(index int) bool {
+	b := w.backends[index]
+	now := time.Now()
+	return !b.unhealthy && !b.draining && !b.full() && !b.circuit.open(now) &&
+		!b.circuit.probing(now, w.halfOpenMaxProbes())
+}
+
+// randomBackend is the fallback used when the walk over the backends found
+// none to select. It picks randomly among the selectable backends speaking
+// one of protocols and, if the circuit of every such healthy backend is
+// open, among those so the client still gets a chance. Full backends and
+// half-open backends out of probes are left alone. It returns -1 if there is
+// no healthy, non-draining backend speaking one of protocols. Callers must
+// hold mu.
+func (w *WebsocketProxy) randomBackend(protocols []string) int {
+	var selectable, healthy []int
+	now := time.Now()
+	for i := range w.Backends {
+		b := w.backends[i]
+		if b.unhealthy || b.draining || b.full() || !b.speaks(protocols) || b.circuit.probing(now, w.halfOpenMaxProbes()) {
+			continue
+		}
+		healthy = append(healthy, i)
+		if w.selectable(i) {
+			selectable = append(selectable, i)
+		}
+	}
+	if len(selectable) > 0 {
+		return selectable[randomIntn(len(selectable))]
+	}
+	if len(healthy) == 0 {
+		return -1
+	}
+	return healthy[randomIntn(len(healthy))]
+}
+
+// unreserveBackend frees the slot taken by reserveBackend for a connection
+// that could not be established.
+func (w *WebsocketProxy) unreserveBackend(b *backend) {
+	w.mu.Lock()
+	b.conns--
+	b.served--
+	w.mu.Unlock()
+}
+
+// releaseBackend records that a connection proxied to b was closed. b may
+// be nil for connections routed by Router.
+func (w *WebsocketProxy) releaseBackend(b *backend) {
+	if b == nil {
+		return
+	}
+	w.mu.Lock()
+	b.conns--
+	w.mu.Unlock()
+}
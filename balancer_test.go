@@ -0,0 +1,401 @@
+package websocketproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWeightedBackends(t *testing.T) {
+	u1, _ := url.Parse("ws://127.0.0.1:9001")
+	u2, _ := url.Parse("ws://127.0.0.1:9002")
+
+	proxy := NewProxy()
+	proxy.AddBackendWeighted(u1, 5)
+	proxy.AddBackendWeighted(u2, 1)
+
+	counts := make(map[int]int)
+	for i := 0; i < 600; i++ {
+		index, _ := proxy.selectBackend(nil)
+		counts[index]++
+	}
+
+	if counts[0] != 500 || counts[1] != 100 {
+		t.Errorf("expecting 500/100 selections, got: %d/%d", counts[0], counts[1])
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	b1 := newEchoBackend(t)
+	b2 := newEchoBackend(t)
+
+	proxy := NewProxy()
+	proxy.Strategy = LeastConnections
+	proxy.AddBackend(b1.url)
+	proxy.AddBackend(b2.url)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	// Two connections per backend, then the second backend drops both.
+	conns := make([]*websocket.Conn, 4)
+	for i := range conns {
+		conns[i] = dialProxy(t, s)
+		defer conns[i].Close()
+	}
+	if n := b2.Accepted(); n != 2 {
+		t.Fatalf("expecting 2 connections on second backend, got: %d", n)
+	}
+	conns[1].Close()
+	conns[3].Close()
+
+	deadline := time.Now().Add(time.Second)
+	for proxy.liveConns(1) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("connections to second backend were not released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Round-robin would alternate, least connections keeps filling the
+	// idle backend until it catches up.
+	for i := 0; i < 2; i++ {
+		conn := dialProxy(t, s)
+		defer conn.Close()
+	}
+	if n := b2.Accepted(); n != 4 {
+		t.Errorf("expecting 4 connections on second backend, got: %d", n)
+	}
+	if n := b1.Accepted(); n != 2 {
+		t.Errorf("expecting 2 connections on first backend, got: %d", n)
+	}
+}
+
+// liveConns returns the number of open connections to the backend at index.
+func (w *WebsocketProxy) liveConns(index int) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.backends[index].conns
+}
+
+func TestRandomFallbackDistribution(t *testing.T) {
+	proxy := NewProxy()
+	for i := 0; i < 4; i++ {
+		u, _ := url.Parse("ws://127.0.0.1:900" + strconv.Itoa(i))
+		proxy.AddBackend(u)
+	}
+	for i := 0; i < 4; i++ {
+		proxy.tripBackend(i, time.Hour)
+	}
+
+	counts := make(map[int]int)
+	for i := 0; i < 4000; i++ {
+		index, _ := proxy.selectBackend(nil)
+		counts[index]++
+	}
+	for i := 0; i < 4; i++ {
+		if counts[i] < 800 || counts[i] > 1200 {
+			t.Errorf("backend %d selected %d times out of 4000", i, counts[i])
+		}
+	}
+}
+
+func TestFallbackSkipsOpenCircuits(t *testing.T) {
+	proxy := NewProxy()
+	// The heavy backends exhaust the round-robin walk before the light
+	// one comes up, sending every selection through the fallback.
+	for i := 0; i < 3; i++ {
+		u, _ := url.Parse("ws://127.0.0.1:900" + strconv.Itoa(i))
+		proxy.AddBackendWeighted(u, 5)
+		proxy.tripBackend(i, time.Hour)
+	}
+	u, _ := url.Parse("ws://127.0.0.1:9003")
+	proxy.AddBackend(u)
+
+	for i := 0; i < 100; i++ {
+		if index, _ := proxy.selectBackend(nil); index != 3 {
+			t.Fatalf("expecting the only closed circuit to be selected, got: %d", index)
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	pool := newEchoBackend(t)
+	tenant := newEchoBackend(t)
+
+	proxy := NewProxy()
+	proxy.AddBackend(pool.url)
+	proxy.Router = func(req *http.Request) *url.URL {
+		if strings.HasPrefix(req.URL.Path, "/tenant/abc") {
+			return tenant.url
+		}
+		return nil
+	}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	proxyURL := "ws" + strings.TrimPrefix(s.URL, "http")
+	for _, path := range []string{"/tenant/abc", "/tenant/abc/x", "/other"} {
+		conn, _, err := websocket.DefaultDialer.Dial(proxyURL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+
+	if n := tenant.Accepted(); n != 2 {
+		t.Errorf("expecting 2 routed connections, got: %d", n)
+	}
+	if n := pool.Accepted(); n != 1 {
+		t.Errorf("expecting 1 balanced connection, got: %d", n)
+	}
+}
+
+func TestSubprotocolSelection(t *testing.T) {
+	v1 := newEchoBackend(t)
+	v2 := newEchoBackend(t)
+
+	proxy := NewProxy()
+	proxy.AddBackend(v1.url, "protocol-v1")
+	proxy.AddBackend(v2.url, "protocol-v2")
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	dialer := websocket.Dialer{Subprotocols: []string{"protocol-v2"}}
+	for i := 0; i < 4; i++ {
+		conn, _, err := dialer.Dial(proxyURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if n := v1.Accepted(); n != 0 {
+		t.Errorf("expecting no connection on the protocol-v1 backend, got: %d", n)
+	}
+	if n := v2.Accepted(); n != 4 {
+		t.Errorf("expecting 4 connections on the protocol-v2 backend, got: %d", n)
+	}
+
+	dialer.Subprotocols = []string{"protocol-v3"}
+	_, resp, err := dialer.Dial(proxyURL, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expecting no backend for an unknown subprotocol, got: %v", err)
+	}
+}
+
+func TestSelector(t *testing.T) {
+	b1 := newEchoBackend(t)
+	b2 := newEchoBackend(t)
+
+	proxy := NewProxy()
+	proxy.AddBackend(b1.url)
+	proxy.AddBackend(b2.url)
+	var seen []BackendInfo
+	proxy.Selector = func(req *http.Request, backends []BackendInfo) int {
+		seen = backends
+		return 1
+	}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	for i := 0; i < 5; i++ {
+		dialProxy(t, s).Close()
+	}
+	if n := b2.Accepted(); n != 5 {
+		t.Errorf("expecting every connection on the selected backend, got: %d", n)
+	}
+	if n := b1.Accepted(); n != 0 {
+		t.Errorf("expecting no connection on the other backend, got: %d", n)
+	}
+	if len(seen) != 2 || seen[0].URL.String() != b1.url.String() || !seen[1].Available {
+		t.Errorf("expecting the state of both backends, got: %+v", seen)
+	}
+
+	// A selector may refuse the connection.
+	proxy.Selector = func(*http.Request, []BackendInfo) int { return -1 }
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, newHandshakeRequest("/"))
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("expecting status %d, got: %d", http.StatusServiceUnavailable, rw.Code)
+	}
+}
+
+func TestSelectorUnselectable(t *testing.T) {
+	b1 := newEchoBackend(t)
+	b2 := newEchoBackend(t)
+
+	proxy := NewProxy()
+	proxy.AddBackend(b1.url, "chat")
+	proxy.AddBackend(b2.url)
+	proxy.DrainBackend(b2.url)
+	var protocols []string
+	choice := 1
+	proxy.Selector = func(req *http.Request, backends []BackendInfo) int {
+		protocols = websocket.Subprotocols(req)
+		return choice
+	}
+
+	// A draining backend is not handed a connection.
+	if index, _ := proxy.selectBackend(newHandshakeRequest("/")); index != -1 {
+		t.Errorf("expecting a draining backend to be rejected, got: %d", index)
+	}
+
+	// Nor is a backend lacking the requested subprotocols.
+	proxy.UndrainBackend(b2.url)
+	proxy.AddBackend(newEchoBackend(t).url, "mqtt")
+	choice = 2
+	req := newHandshakeRequest("/")
+	req.Header.Set("Sec-WebSocket-Protocol", "chat")
+	if index, _ := proxy.selectBackend(req); index != -1 {
+		t.Errorf("expecting a backend without the subprotocol to be rejected, got: %d", index)
+	}
+	if len(protocols) != 1 || protocols[0] != "chat" {
+		t.Errorf("expecting Selector to get the request, got subprotocols: %q", protocols)
+	}
+	choice = 0
+	if index, _ := proxy.selectBackend(req); index != 0 {
+		t.Errorf("expecting the backend speaking the subprotocol, got: %d", index)
+	}
+}
+
+func TestBackendConnLimit(t *testing.T) {
+	b1 := newEchoBackend(t)
+	b2 := newEchoBackend(t)
+
+	proxy := NewProxy()
+	proxy.AddBackendWithLimit(b1.url, 2)
+	proxy.AddBackendWithLimit(b2.url, 1)
+	proxy.Strategy = ConsistentHash
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	// Every connection hashes to the same backend until it is full.
+	for i := 0; i < 3; i++ {
+		conn := dialProxy(t, s)
+		defer conn.Close()
+	}
+	if n1, n2 := b1.Accepted(), b2.Accepted(); n1 != 2 || n2 != 1 {
+		t.Errorf("expecting 2/1 connections up to the limits, got: %d/%d", n1, n2)
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expecting no backend once every backend is full, got: %v", err)
+	}
+	if status := proxy.BackendStatus(); status[0].Available || status[0].MaxConns != 2 {
+		t.Errorf("expecting a full backend to be unavailable, got: %+v", status[0])
+	}
+}
+
+func TestBackendConnLimitConcurrent(t *testing.T) {
+	var handshakes int32
+	upgrader := websocket.Upgrader{}
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&handshakes, 1)
+		time.Sleep(100 * time.Millisecond)
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer slow.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(slow.URL, "http"))
+
+	proxy := NewProxy()
+	proxy.AddBackendWithLimit(u, 2)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	// A burst of handshakes while the first ones are still dialing.
+	var wg sync.WaitGroup
+	conns := make(chan *websocket.Conn, 6)
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil); err == nil {
+				conns <- conn
+			}
+		}()
+	}
+	wg.Wait()
+	close(conns)
+	for conn := range conns {
+		defer conn.Close()
+	}
+	if n := atomic.LoadInt32(&handshakes); n != 2 {
+		t.Errorf("expecting the burst to stop at the limit of 2, got %d handshakes", n)
+	}
+	if info := proxy.BackendStatus()[0]; info.ActiveConns != 2 || info.TotalConns != 2 {
+		t.Errorf("expecting 2 connections, got: %+v", info)
+	}
+
+	// A failed dial gives the slot back.
+	proxy = NewProxy()
+	proxy.AddBackendWithLimit(closedURL(t), 1)
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, newHandshakeRequest("/"))
+	if info := proxy.BackendStatus()[0]; info.ActiveConns != 0 || info.TotalConns != 0 {
+		t.Errorf("expecting the slot to be freed after a failed dial, got: %+v", info)
+	}
+}
+
+func TestConcurrentAddBackend(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	// Reconfigure the backends while clients are served, every added
+	// backend reaching the echo server.
+	done := make(chan struct{})
+	reconfigured := make(chan struct{})
+	go func() {
+		defer close(reconfigured)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			u, _ := url.Parse(b.url.String() + "/" + strconv.Itoa(i))
+			proxy.AddBackend(u)
+			proxy.RemoveBackend(u)
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				conn.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	<-reconfigured
+}
@@ -0,0 +1,111 @@
+package websocketproxy
+
+import "time"
+
+const (
+	// DefaultFailureThreshold is used when WebsocketProxy.FailureThreshold
+	// is zero.
+	DefaultFailureThreshold = 1
+
+	// DefaultCooldownDuration is used when WebsocketProxy.CooldownDuration
+	// is zero.
+	DefaultCooldownDuration = 5 * time.Second
+
+	// DefaultHalfOpenMaxProbes is used when WebsocketProxy.HalfOpenMaxProbes
+	// is zero.
+	DefaultHalfOpenMaxProbes = 1
+)
+
+// circuit is the circuit breaker state of a backend. The circuit is closed
+// while dials succeed. After FailureThreshold consecutive failures it opens
+// and the backend is skipped for CooldownDuration. Once the cooldown is over
+// the circuit is half-open: up to HalfOpenMaxProbes connections are let
+// through as probes, and the next dial either closes the circuit or opens it
+// right away for another cooldown.
+type circuit struct {
+	failures    int
+	lastFailure time.Time
+	openUntil   time.Time
+	tripped     bool
+
+	// probes is the number of connections let through while half-open. The
+	// slots are given back at probeUntil in case no dial reports back, for
+	// example because the client went away.
+	probes     int
+	probeUntil time.Time
+}
+
+// open reports whether the backend must be skipped at now.
+func (c *circuit) open(now time.Time) bool {
+	return now.Before(c.openUntil)
+}
+
+// probing reports whether the circuit is half-open at now with all of its
+// maxProbes probes under way, so the backend must be skipped as well.
+func (c *circuit) probing(now time.Time, maxProbes int) bool {
+	return c.tripped && !c.open(now) && c.probes >= maxProbes && now.Before(c.probeUntil)
+}
+
+// probe records that a connection was let through at now. It only counts
+// while the circuit is half-open, and its slot is held for at most timeout.
+func (c *circuit) probe(now time.Time, timeout time.Duration) {
+	if !c.tripped || c.open(now) {
+		return
+	}
+	if !now.Before(c.probeUntil) {
+		c.probes = 0
+	}
+	c.probes++
+	c.probeUntil = now.Add(timeout)
+}
+
+// failure records a failed dial at now. Failures more than cooldown apart
+// are not consecutive. An opened circuit stays open for cooldown plus
+// jitter.
+func (c *circuit) failure(now time.Time, threshold int, cooldown, jitter time.Duration) {
+	if now.Sub(c.lastFailure) > cooldown {
+		c.failures = 0
+	}
+	c.failures++
+	c.lastFailure = now
+	if c.tripped || c.failures >= threshold {
+		c.tripped = true
+		c.failures = 0
+		c.probes = 0
+		c.openUntil = now.Add(cooldown + jitter)
+	}
+}
+
+// success records a successful dial and closes the circuit.
+func (c *circuit) success() {
+	*c = circuit{}
+}
+
+func (w *WebsocketProxy) failureThreshold() int {
+	if w.FailureThreshold <= 0 {
+		return DefaultFailureThreshold
+	}
+	return w.FailureThreshold
+}
+
+func (w *WebsocketProxy) cooldownDuration() time.Duration {
+	if w.CooldownDuration <= 0 {
+		return DefaultCooldownDuration
+	}
+	return w.CooldownDuration
+}
+
+func (w *WebsocketProxy) halfOpenMaxProbes() int {
+	if w.HalfOpenMaxProbes <= 0 {
+		return DefaultHalfOpenMaxProbes
+	}
+	return w.HalfOpenMaxProbes
+}
+
+// cooldownJitter returns a random duration of up to CooldownJitter.
+func (w *WebsocketProxy) cooldownJitter() time.Duration {
+	if w.CooldownJitter <= 0 {
+		return 0
+	}
+	return time.Duration(randomInt63n(int64(w.CooldownJitter) + 1))
+}
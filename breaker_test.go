@@ -0,0 +1,159 @@
+package websocketproxy
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// tripBackend opens the circuit of the backend at index for d.
+func (w *WebsocketProxy) tripBackend(index int, d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.syncBackends()
+	w.backends[index].circuit.tripped = true
+	w.backends[index].circuit.openUntil = time.Now().Add(d)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var c circuit
+	now := time.Now()
+
+	c.failure(now, 3, time.Second, 0)
+	c.failure(now, 3, time.Second, 0)
+	if c.open(now) {
+		t.Fatal("circuit opened before reaching the threshold")
+	}
+	c.failure(now, 3, time.Second, 0)
+	if !c.open(now) {
+		t.Fatal("expecting circuit to open after 3 consecutive failures")
+	}
+
+	// Half-open after the cooldown, a single failed probe opens it again.
+	now = now.Add(2 * time.Second)
+	if c.open(now) {
+		t.Fatal("expecting circuit to be half-open after the cooldown")
+	}
+	c.failure(now, 3, time.Second, 0)
+	if !c.open(now) {
+		t.Fatal("expecting a failed probe to reopen the circuit")
+	}
+
+	c.success()
+	if c.open(now) {
+		t.Error("expecting success to close the circuit")
+	}
+
+	// Failures further apart than the cooldown are not consecutive.
+	c.failure(now, 2, time.Second, 0)
+	c.failure(now.Add(2*time.Second), 2, time.Second, 0)
+	if c.open(now.Add(2 * time.Second)) {
+		t.Error("expecting failures outside the window not to add up")
+	}
+}
+
+func TestDeadBackendSkippedDuringCooldown(t *testing.T) {
+	dead := closedURL(t)
+	b := newEchoBackend(t)
+	metrics := newRecordingMetrics()
+
+	proxy := NewProxy()
+	proxy.AddBackend(dead)
+	proxy.AddBackend(b.url)
+	proxy.Metrics = metrics
+	proxy.FailureThreshold = 1
+	proxy.CooldownDuration = time.Hour
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	for i := 0; i < 10; i++ {
+		dialProxy(t, s).Close()
+	}
+
+	if n := metrics.get(metrics.errors, dead.Host); n != 1 {
+		t.Errorf("expecting the dead backend to be dialed once, got: %d", n)
+	}
+}
+
+func TestCooldownJitter(t *testing.T) {
+	proxy := NewProxy()
+	proxy.CooldownJitter = time.Second
+	cooldown := proxy.cooldownDuration()
+
+	now := time.Now()
+	retries := make(map[time.Time]bool)
+	for i := 0; i < 100; i++ {
+		var c circuit
+		c.failure(now, 1, cooldown, proxy.cooldownJitter())
+		if d := c.openUntil.Sub(now); d < cooldown || d > cooldown+proxy.CooldownJitter {
+			t.Fatalf("expecting a cooldown between %s and %s, got: %s", cooldown, cooldown+proxy.CooldownJitter, d)
+		}
+		retries[c.openUntil] = true
+	}
+	if len(retries) < 90 {
+		t.Errorf("expecting staggered retries, got %d distinct times out of 100", len(retries))
+	}
+
+	proxy.CooldownJitter = 0
+	if d := proxy.cooldownJitter(); d != 0 {
+		t.Errorf("expecting no jitter by default, got: %s", d)
+	}
+}
+
+func TestHalfOpenProbes(t *testing.T) {
+	u, _ := url.Parse("ws://127.0.0.1:9001")
+	proxy := NewProxy()
+	proxy.AddBackend(u)
+	proxy.HalfOpenMaxProbes = 2
+
+	// The cooldown is over, the backend recovers.
+	proxy.tripBackend(0, -time.Second)
+	let := 0
+	for i := 0; i < 10; i++ {
+		if index, _ := proxy.selectBackend(nil); index == 0 {
+			let++
+		}
+	}
+	if let != 2 {
+		t.Fatalf("expecting 2 probes let through while half-open, got: %d", let)
+	}
+	if proxy.BackendStatus()[0].Available {
+		t.Error("expecting the backend out of probes to be unavailable")
+	}
+
+	// A failed probe restarts the cooldown.
+	proxy.backendDown(proxy.backends[0], u, errNoBackend)
+	if proxy.BackendStatus()[0].Available || !proxy.backends[0].circuit.open(time.Now()) {
+		t.Error("expecting the cooldown to restart after a failed probe")
+	}
+
+	// A successful probe closes the circuit.
+	proxy.tripBackend(0, -time.Second)
+	if index, _ := proxy.selectBackend(nil); index != 0 {
+		t.Fatalf("expecting a probe to be let through, got: %d", index)
+	}
+	proxy.backendUp(proxy.backends[0], u)
+	for i := 0; i < 10; i++ {
+		if index, _ := proxy.selectBackend(nil); index != 0 {
+			t.Fatalf("expecting the recovered backend to be selected, got: %d", index)
+		}
+	}
+}
+
+func TestHalfOpenProbeTimeout(t *testing.T) {
+	var c circuit
+	now := time.Now()
+	c.failure(now, 1, time.Second, 0)
+
+	now = now.Add(2 * time.Second)
+	c.probe(now, time.Second)
+	if !c.probing(now, 1) {
+		t.Fatal("expecting the single probe to be under way")
+	}
+	// The probe never reported back, its slot is given back.
+	now = now.Add(2 * time.Second)
+	if c.probing(now, 1) {
+		t.Error("expecting the probe slot to be given back after its timeout")
+	}
+}
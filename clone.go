@@ -0,0 +1,135 @@
+package websocketproxy
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// Clone returns a new proxy with the configuration of w. Slices, Upgrader,
+// Dialer and the settings given to SetBackendTLSConfig and SetShadowBackend
+// are copied, so changing them on either proxy leaves the other alone. The
+// clone has the same backends, with their weights, limits, headers and
+// subprotocols, but its own bookkeeping: it starts with no connections, no
+// health checker, no failure history and no backend drained. Functions,
+// Logger, Metrics and WriteBufferPool are shared.
+func (w *WebsocketProxy) Clone() *WebsocketProxy {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	c := &WebsocketProxy{
+		Director:               w.Director,
+		FailureThreshold:       w.FailureThreshold,
+		CooldownDuration:       w.CooldownDuration,
+		CooldownJitter:         w.CooldownJitter,
+		HalfOpenMaxProbes:      w.HalfOpenMaxProbes,
+		BackendErrorStatus:     w.BackendErrorStatus,
+		ForwardMode:            w.ForwardMode,
+		Strategy:               w.Strategy,
+		Selector:               w.Selector,
+		HashKey:                w.HashKey,
+		LoadHalfLife:           w.LoadHalfLife,
+		RewritePath:            w.RewritePath,
+		Router:                 w.Router,
+		RewriteBackendURL:      w.RewriteBackendURL,
+		MaxBackendRedirects:    w.MaxBackendRedirects,
+		FanOutBackends:         append([]*url.URL(nil), w.FanOutBackends...),
+		StickyMode:             w.StickyMode,
+		StickyCookieName:       w.StickyCookieName,
+		OnBackendDown:          w.OnBackendDown,
+		OnBackendUp:            w.OnBackendUp,
+		OnProxyError:           w.OnProxyError,
+		ErrorHandler:           w.ErrorHandler,
+		OnConnClose:            w.OnConnClose,
+		ShadowSampleRate:       w.ShadowSampleRate,
+		RequestIDHeader:        w.RequestIDHeader,
+		GenerateRequestID:      w.GenerateRequestID,
+		MaxFramesPerSec:        w.MaxFramesPerSec,
+		MaxBytesPerSec:         w.MaxBytesPerSec,
+		ThrottlePolicy:         w.ThrottlePolicy,
+		AllowedMessageTypes:    w.AllowedMessageTypes,
+		NonUpgradeHandler:      w.NonUpgradeHandler,
+		OnClientMessage:        w.OnClientMessage,
+		OnBackendMessage:       w.OnBackendMessage,
+		Logger:                 w.Logger,
+		LogHandshakes:          w.LogHandshakes,
+		AllowedOrigins:         append([]string(nil), w.AllowedOrigins...),
+		EnableCompression:      w.EnableCompression,
+		ReadBufferSize:         w.ReadBufferSize,
+		WriteBufferSize:        w.WriteBufferSize,
+		WriteBufferPool:        w.WriteBufferPool,
+		DialTimeout:            w.DialTimeout,
+		UpgradeTimeout:         w.UpgradeTimeout,
+		ConnectTimeout:         w.ConnectTimeout,
+		KeepAlive:              w.KeepAlive,
+		BackendLocalAddr:       w.BackendLocalAddr,
+		BackendProxyURL:        w.BackendProxyURL,
+		Metrics:                w.Metrics,
+		ForwardedHeaderMode:    w.ForwardedHeaderMode,
+		TrustForwardedHeaders:  w.TrustForwardedHeaders,
+		ForwardHeaders:         append([]string(nil), w.ForwardHeaders...),
+		StripHeaders:           append([]string(nil), w.StripHeaders...),
+		ForwardResponseHeaders: append([]string(nil), w.ForwardResponseHeaders...),
+		MaxConnections:         w.MaxConnections,
+		IdleTimeout:            w.IdleTimeout,
+		ForwardPings:           w.ForwardPings,
+		MaxConnLifetime:        w.MaxConnLifetime,
+		LifetimeCloseCode:      w.LifetimeCloseCode,
+		LifetimeCloseReason:    w.LifetimeCloseReason,
+		ConnDeadline:           w.ConnDeadline,
+		ConnDeadlineCloseCode:  w.ConnDeadlineCloseCode,
+		RebalanceInterval:      w.RebalanceInterval,
+		RebalanceCloseCode:     w.RebalanceCloseCode,
+		RebalanceCloseReason:   w.RebalanceCloseReason,
+		ShutdownCloseCode:      w.ShutdownCloseCode,
+		ShutdownCloseReason:    w.ShutdownCloseReason,
+		MaxMessageSize:         w.MaxMessageSize,
+		StreamMessages:         w.StreamMessages,
+		WriteTimeout:           w.WriteTimeout,
+		MaxRetries:             w.MaxRetries,
+		RetryBackoff:           w.RetryBackoff,
+		ReplayEarlyMessages:    w.ReplayEarlyMessages,
+		ReplayWindow:           w.ReplayWindow,
+		ResumeOnBackendFailure: w.ResumeOnBackendFailure,
+		BackendReconnectGrace:  w.BackendReconnectGrace,
+		ConnRateLimit:          w.ConnRateLimit,
+		TrustProxyProtocol:     w.TrustProxyProtocol,
+	}
+	if w.Upgrader != nil {
+		u := *w.Upgrader
+		c.Upgrader = &u
+	}
+	if w.Dialer != nil {
+		d := *w.Dialer
+		c.Dialer = &d
+	}
+	if w.tlsConfig != nil {
+		c.tlsConfig = w.tlsConfig.Clone()
+	}
+	if w.shadow != nil {
+		u := *w.shadow
+		c.shadow = &u
+	}
+
+	w.syncBackends()
+	c.Backends = make([]func(*http.Request) *url.URL, 0, len(w.Backends))
+	for i, b := range w.backends {
+		entry := &backend{
+			url:       w.Backends[i],
+			weight:    b.weight,
+			maxConns:  b.maxConns,
+			host:      b.host,
+			header:    b.header.Clone(),
+			protocols: append([]string(nil), b.protocols...),
+		}
+		// The URL of a backend added with a target depends on the settings
+		// of its proxy, such as RewritePath.
+		if b.target != nil {
+			target := *b.target
+			entry.target = &target
+			entry.url = c.getRequestURL(&target)
+		}
+		c.Backends = append(c.Backends, entry.url)
+		c.backends = append(c.backends, entry)
+	}
+	return c
+}
@@ -0,0 +1,50 @@
+package websocketproxy
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestClone(t *testing.T) {
+	a, _ := url.Parse("ws://10.0.0.1:9000/base")
+	b, _ := url.Parse("ws://10.0.0.2:9000")
+	proxy := NewProxy()
+	proxy.Upgrader = &websocket.Upgrader{ReadBufferSize: 512}
+	proxy.ForwardHeaders = []string{"X-Request-Id"}
+	proxy.AddBackendWeighted(a, 3, "chat")
+	proxy.DrainBackend(a)
+
+	clone := proxy.Clone()
+	clone.ForwardMode = RedirectForwardMode
+	clone.ForwardHeaders[0] = "X-Changed"
+	clone.Upgrader.ReadBufferSize = 4096
+	clone.AddBackend(b)
+	clone.RemoveBackend(a)
+	clone.RewritePath = func(*url.URL) string { return "/rewritten" }
+
+	if proxy.ForwardMode != ReverseForwardMode || proxy.ForwardHeaders[0] != "X-Request-Id" || proxy.Upgrader.ReadBufferSize != 512 {
+		t.Error("expecting the configuration of the original to be left alone")
+	}
+	status := proxy.BackendStatus()
+	if len(status) != 1 || status[0].URL.String() != a.String() || !status[0].Draining {
+		t.Errorf("expecting the backends of the original to be left alone, got: %+v", status)
+	}
+	req := httptest.NewRequest("GET", "/chat", nil)
+	if got := proxy.Backends[0](req).Path; got != "/base/chat" {
+		t.Errorf("expecting the original to ignore the RewritePath of the clone, got: %q", got)
+	}
+
+	status = clone.BackendStatus()
+	if len(status) != 1 || status[0].URL.String() != b.String() {
+		t.Errorf("expecting the clone to hold its own backends, got: %+v", status)
+	}
+
+	clone = proxy.Clone()
+	status = clone.BackendStatus()
+	if len(status) != 1 || status[0].Weight != 3 || status[0].Protocols[0] != "chat" || status[0].Draining {
+		t.Errorf("expecting the configuration of the backend with fresh state, got: %+v", status)
+	}
+}
@@ -0,0 +1,544 @@
+package websocketproxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// shutdownPollInterval is how often Shutdown checks whether all proxied
+// connections are gone.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// closeWriteTimeout bounds the time spent writing a close frame.
+const closeWriteTimeout = time.Second
+
+// DefaultShutdownCloseCode and DefaultShutdownCloseReason are sent to the
+// peers of the connections closed by Shutdown unless
+// WebsocketProxy.ShutdownCloseCode is set.
+const (
+	DefaultShutdownCloseCode   = websocket.CloseGoingAway
+	DefaultShutdownCloseReason = "going away"
+)
+
+// DefaultLifetimeCloseReason and DefaultRebalanceCloseReason are sent with
+// 1001 (going away) to the peers of the connections closed by
+// MaxConnLifetime and Rebalance unless WebsocketProxy.LifetimeCloseCode and
+// RebalanceCloseCode are set.
+const (
+	DefaultLifetimeCloseReason  = "connection lifetime exceeded"
+	DefaultRebalanceCloseReason = "rebalancing"
+)
+
+// proxyConn is a client connection paired with its backend connection.
+type proxyConn struct {
+	// fromClient and fromBackend count the message bytes copied in each
+	// direction. They are accessed atomically and come first to be 64-bit
+	// aligned on 32-bit platforms.
+	fromClient  int64
+	fromBackend int64
+
+	client *websocket.Conn
+
+	// id identifies the connection for CloseConnection.
+	id string
+
+	// mu guards the backend side, which failover may replace while the
+	// connection is proxied, and closed.
+	mu      sync.Mutex
+	backend *websocket.Conn
+
+	// fanOut holds the other backend connections of a FanOutBackends
+	// connection, pinged and closed along with backend.
+	fanOut []*websocket.Conn
+
+	// backendURL is the URL dialed for backend, entry the Backends entry it
+	// was selected from.
+	backendURL *url.URL
+	entry      *backend
+
+	// header holds the handshake headers built for the client, before the
+	// per-backend ones, for the shadow to reuse.
+	header http.Header
+
+	// deflate is set if the backend accepted permessage-deflate, which is
+	// then offered to the client as well.
+	deflate bool
+
+	// closed is set once the connections are torn down. replay keeps the
+	// first client messages for failover, if enabled.
+	closed bool
+	replay *replayBuffer
+
+	// reconnecting is closed when the failover in progress, if any, is
+	// over. done is closed by closeConns, see closing.
+	reconnecting chan struct{}
+	done         chan struct{}
+
+	// start is when the client connection was upgraded.
+	start time.Time
+}
+
+// Side identifies who ended a proxied connection.
+type Side int
+
+const (
+	// ClientSide is the client connected to the proxy.
+	ClientSide Side = iota
+
+	// BackendSide is the backend the connection was proxied to.
+	BackendSide
+
+	// ProxySide is the proxy itself, for example on Shutdown, a message
+	// over MaxMessageSize or a message rejected by a hook.
+	ProxySide
+)
+
+func (s Side) String() string {
+	switch s {
+	case ClientSide:
+		return "client"
+	case BackendSide:
+		return "backend"
+	case ProxySide:
+		return "proxy"
+	}
+	return "unknown"
+}
+
+// MessageTypes selects the data messages clients may send, see
+// AllowedMessageTypes.
+type MessageTypes int
+
+const (
+	// TextAndBinary allows both text and binary messages. This is the
+	// default.
+	TextAndBinary MessageTypes = iota
+
+	// TextOnly allows text messages only.
+	TextOnly
+
+	// BinaryOnly allows binary messages only.
+	BinaryOnly
+)
+
+// allows reports whether a message of msgType may be sent.
+func (t MessageTypes) allows(msgType int) bool {
+	switch t {
+	case TextOnly:
+		return msgType == websocket.TextMessage
+	case BinaryOnly:
+		return msgType == websocket.BinaryMessage
+	}
+	return true
+}
+
+// ConnStats describes a proxied connection that was closed.
+type ConnStats struct {
+	// ID identifies the connection among the active ones, see
+	// CloseConnection. It is made of the client address and a sequence
+	// number.
+	ID string
+
+	// ClientAddr is the remote address of the client and Backend the URL
+	// the connection was proxied to.
+	ClientAddr string
+	Backend    *url.URL
+
+	// BytesFromClient and BytesFromBackend are the message payload bytes
+	// copied from the client to the backend and back. Frame headers and
+	// control frames are not counted.
+	BytesFromClient  int64
+	BytesFromBackend int64
+
+	// Duration is the lifetime of the connection.
+	Duration time.Duration
+
+	// ClosedBy is the side that ended the connection and Err the error
+	// that ended it, a *websocket.CloseError if a close frame was received.
+	ClosedBy Side
+	Err      error
+
+	// RequestID is the ID of the request that opened the connection, see
+	// WebsocketProxy.RequestIDHeader.
+	RequestID string
+}
+
+// stats returns the statistics of pc. Must only be called once both copy
+// goroutines are done.
+func (pc *proxyConn) stats() ConnStats {
+	return ConnStats{
+		ID:               pc.id,
+		ClientAddr:       pc.client.RemoteAddr().String(),
+		Backend:          pc.backendURL,
+		BytesFromClient:  atomic.LoadInt64(&pc.fromClient),
+		BytesFromBackend: atomic.LoadInt64(&pc.fromBackend),
+		Duration:         time.Since(pc.start),
+	}
+}
+
+// backendConn returns the current backend connection.
+func (pc *proxyConn) backendConn() *websocket.Conn {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.backend
+}
+
+// close sends a close frame with code and text to both peers and closes the
+// underlying connections, which ends the copy goroutines.
+func (pc *proxyConn) close(code int, text string) {
+	msg := websocket.FormatCloseMessage(code, text)
+	deadline := time.Now().Add(closeWriteTimeout)
+	pc.client.WriteControl(websocket.CloseMessage, msg, deadline)
+	pc.backendConn().WriteControl(websocket.CloseMessage, msg, deadline)
+	for _, conn := range pc.fanOut {
+		conn.WriteControl(websocket.CloseMessage, msg, deadline)
+	}
+	pc.closeConns()
+}
+
+// isClosed reports whether closeConns was called.
+func (pc *proxyConn) isClosed() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.closed
+}
+
+// closing returns a channel closed once closeConns is called.
+func (pc *proxyConn) closing() <-chan struct{} {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.done == nil {
+		pc.done = make(chan struct{})
+		if pc.closed {
+			close(pc.done)
+		}
+	}
+	return pc.done
+}
+
+// survivorCloseMessage returns the close frame for the peer still connected
+// after the other one ended the connection with err. A close frame is
+// passed on as is, a peer that dropped becomes 1001 (going away).
+func survivorCloseMessage(err error) []byte {
+	if cerr, ok := err.(*websocket.CloseError); ok {
+		switch cerr.Code {
+		case websocket.CloseNoStatusReceived:
+			return websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		case websocket.CloseAbnormalClosure, websocket.CloseTLSHandshake:
+		default:
+			return websocket.FormatCloseMessage(cerr.Code, cerr.Text)
+		}
+	}
+	return websocket.FormatCloseMessage(websocket.CloseGoingAway, "peer went away")
+}
+
+// closeConns closes both connections and prevents a later failover.
+func (pc *proxyConn) closeConns() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if !pc.closed && pc.done != nil {
+		close(pc.done)
+	}
+	pc.closed = true
+	pc.client.Close()
+	pc.backend.Close()
+	for _, conn := range pc.fanOut {
+		conn.Close()
+	}
+}
+
+// forwardClose makes a close frame received from src reach the connection
+// returned by dst with the same code and reason, so each peer sees why the
+// other one left. src still answers the close frame as the default handler
+// does.
+func forwardClose(src *websocket.Conn, dst func() *websocket.Conn) {
+	src.SetCloseHandler(func(code int, text string) error {
+		deadline := time.Now().Add(closeWriteTimeout)
+		dst().WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), deadline)
+		src.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""), deadline)
+		return nil
+	})
+}
+
+// forwardPings installs ping and pong handlers on src that write the frame
+// to dst, instead of answering pings and dropping pongs. With a non-zero
+// idle timeout, a pong still extends the read deadline of src like
+// armIdleTimeout does.
+func forwardPings(src *websocket.Conn, dst func() *websocket.Conn, timeout time.Duration) {
+	src.SetPingHandler(func(data string) error {
+		dst().WriteControl(websocket.PingMessage, []byte(data), time.Now().Add(closeWriteTimeout))
+		return nil
+	})
+	src.SetPongHandler(func(data string) error {
+		dst().WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(closeWriteTimeout))
+		if timeout > 0 {
+			return src.SetReadDeadline(time.Now().Add(timeout))
+		}
+		return nil
+	})
+}
+
+// keepAlive arms a read deadline of timeout on both connections, extended by
+// every pong, and pings both peers every half timeout until done is closed.
+// Must be called before the copy goroutines start reading.
+func (pc *proxyConn) keepAlive(timeout time.Duration, done <-chan struct{}) {
+	armIdleTimeout(pc.client, timeout)
+	armIdleTimeout(pc.backend, timeout)
+	for _, conn := range pc.fanOut {
+		armIdleTimeout(conn, timeout)
+	}
+
+	go func() {
+		ticker := time.NewTicker(timeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				deadline := time.Now().Add(closeWriteTimeout)
+				pc.client.WriteControl(websocket.PingMessage, nil, deadline)
+				pc.backendConn().WriteControl(websocket.PingMessage, nil, deadline)
+				for _, conn := range pc.fanOut {
+					conn.WriteControl(websocket.PingMessage, nil, deadline)
+				}
+			}
+		}
+	}()
+}
+
+// armIdleTimeout sets a read deadline of timeout on conn, extended by every
+// pong.
+func armIdleTimeout(conn *websocket.Conn, timeout time.Duration) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(timeout))
+	})
+}
+
+// armTimers starts the MaxConnLifetime and ConnDeadline timers closing pc,
+// the connection opened by req, and returns a function stopping them.
+func (w *WebsocketProxy) armTimers(req *http.Request, pc *proxyConn) func() {
+	var timers []*time.Timer
+	if w.MaxConnLifetime > 0 {
+		timers = append(timers, time.AfterFunc(w.connLifetime(), func() {
+			pc.close(closeFrame(w.LifetimeCloseCode, w.LifetimeCloseReason, DefaultLifetimeCloseReason))
+		}))
+	}
+	if w.ConnDeadline != nil {
+		if deadline := w.ConnDeadline(req); !deadline.IsZero() {
+			timers = append(timers, time.AfterFunc(time.Until(deadline), func() {
+				pc.close(w.connDeadlineCloseCode(), "connection deadline exceeded")
+			}))
+		}
+	}
+	return func() {
+		for _, timer := range timers {
+			timer.Stop()
+		}
+	}
+}
+
+// connLifetime returns the lifetime of a new connection under
+// MaxConnLifetime, shortened by a random jitter of up to a tenth so that
+// connections opened together do not all close together.
+func (w *WebsocketProxy) connLifetime() time.Duration {
+	jitter := randomInt63n(int64(w.MaxConnLifetime/10) + 1)
+	return w.MaxConnLifetime - time.Duration(jitter)
+}
+
+// DefaultConnDeadlineCloseCode is sent when WebsocketProxy.ConnDeadline
+// closes a connection and ConnDeadlineCloseCode is zero.
+const DefaultConnDeadlineCloseCode = websocket.ClosePolicyViolation
+
+func (w *WebsocketProxy) connDeadlineCloseCode() int {
+	if w.ConnDeadlineCloseCode != 0 {
+		return w.ConnDeadlineCloseCode
+	}
+	return DefaultConnDeadlineCloseCode
+}
+
+// reserveConn admits a new connection under MaxConnections. The check and
+// the increment happen under the same lock so concurrent handshakes can
+// never exceed the limit. Every successful call must be paired with
+// releaseConn.
+func (w *WebsocketProxy) reserveConn() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.MaxConnections > 0 && w.reserved >= w.MaxConnections {
+		return false
+	}
+	w.reserved++
+	return true
+}
+
+// releaseConn frees a slot taken by reserveConn.
+func (w *WebsocketProxy) releaseConn() {
+	w.mu.Lock()
+	w.reserved--
+	w.mu.Unlock()
+}
+
+// trackConn registers pc as active. It returns false if the proxy is
+// shutting down, in which case pc must not be served.
+func (w *WebsocketProxy) trackConn(pc *proxyConn) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.shuttingDown {
+		return false
+	}
+	if w.conns == nil {
+		w.conns = make(map[*proxyConn]struct{})
+	}
+	w.connSeq++
+	pc.id = pc.client.RemoteAddr().String() + "/" + strconv.FormatUint(w.connSeq, 10)
+	w.conns[pc] = struct{}{}
+	return true
+}
+
+// CloseConnection closes the active connection with the given ID, as found
+// in ConnStats, and reports whether there was one. Both the client and the
+// backend get a policy violation (1008) close frame, for example to kick an
+// abusive client.
+func (w *WebsocketProxy) CloseConnection(id string) bool {
+	w.mu.Lock()
+	var found *proxyConn
+	for pc := range w.conns {
+		if pc.id == id {
+			found = pc
+			break
+		}
+	}
+	w.mu.Unlock()
+
+	if found == nil {
+		return false
+	}
+	found.close(websocket.ClosePolicyViolation, "closed by the proxy")
+	return true
+}
+
+// untrackConn removes pc from the active connections.
+func (w *WebsocketProxy) untrackConn(pc *proxyConn) {
+	w.mu.Lock()
+	delete(w.conns, pc)
+	w.mu.Unlock()
+}
+
+// shutdownClose returns the close code and reason sent by Shutdown.
+func (w *WebsocketProxy) shutdownClose() (int, string) {
+	return closeFrame(w.ShutdownCloseCode, w.ShutdownCloseReason, DefaultShutdownCloseReason)
+}
+
+// closeFrame returns the close code and reason configured for a close
+// initiated by the proxy. If code is zero, 1001 (going away) is sent with
+// reason, or defaultReason if that is empty too.
+func closeFrame(code int, reason, defaultReason string) (int, string) {
+	if code == 0 {
+		code = websocket.CloseGoingAway
+		if reason == "" {
+			reason = defaultReason
+		}
+	}
+	return code, reason
+}
+
+// startBackground installs stop and done, the channels controlling a new
+// background goroutine, in *curStop and *curDone and counts the goroutine in
+// background. It returns false if Shutdown has been called, in which case
+// the goroutine must not be started. A goroutine installed concurrently in
+// the meantime is stopped, so at most one is left running.
+func (w *WebsocketProxy) startBackground(curStop, curDone *chan struct{}, stop, done chan struct{}) bool {
+	w.mu.Lock()
+	if w.shuttingDown {
+		w.mu.Unlock()
+		return false
+	}
+	prevStop, prevDone := *curStop, *curDone
+	*curStop, *curDone = stop, done
+	w.background.Add(1)
+	w.mu.Unlock()
+
+	if prevStop != nil {
+		close(prevStop)
+		<-prevDone
+	}
+	return true
+}
+
+// isShuttingDown reports whether Shutdown has been called.
+func (w *WebsocketProxy) isShuttingDown() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.shuttingDown
+}
+
+// Shutdown stops the proxy from accepting new connections and closes every
+// active connection with a close frame sent to both the client and the
+// backend, 1001 (going away) unless ShutdownCloseCode is set. It waits
+// until all connections are gone or ctx is done, in which case the
+// context's error is returned. The background goroutines of
+// StartHealthCheck, SetBackendProvider and Rebalance are stopped as well,
+// and calling them afterwards does nothing, so that a proxy that was shut
+// down leaves nothing running behind.
+//
+// Shutdown does not stop the http.Server serving the proxy; call it from the
+// server's shutdown path, for example with http.Server.RegisterOnShutdown.
+func (w *WebsocketProxy) Shutdown(ctx context.Context) error {
+	w.mu.Lock()
+	w.shuttingDown = true
+	w.mu.Unlock()
+
+	// Stopping the background goroutines may wait for work in flight, do
+	// it alongside closing the connections and within ctx.
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		w.StopHealthCheck()
+		w.StopBackendProvider()
+		w.StopRebalance()
+		w.background.Wait()
+	}()
+
+	w.mu.Lock()
+	conns := make([]*proxyConn, 0, len(w.conns))
+	for pc := range w.conns {
+		conns = append(conns, pc)
+	}
+	w.mu.Unlock()
+
+	code, text := w.shutdownClose()
+	for _, pc := range conns {
+		pc.close(code, text)
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		w.mu.Lock()
+		active := len(w.conns)
+		w.mu.Unlock()
+		if active == 0 {
+			select {
+			case <-stopped:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
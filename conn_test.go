@@ -0,0 +1,814 @@
+package websocketproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestShutdown(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := proxy.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("expecting going away close, got: %v", err)
+	}
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, newHandshakeRequest("/"))
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("expecting status %d after shutdown, got: %d", http.StatusServiceUnavailable, rw.Code)
+	}
+}
+
+func TestShutdownCloseMessage(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.ShutdownCloseCode = websocket.CloseServiceRestart
+	proxy.ShutdownCloseReason = "server maintenance"
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := proxy.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err := conn.ReadMessage()
+	cerr, ok := err.(*websocket.CloseError)
+	if !ok || cerr.Code != websocket.CloseServiceRestart || cerr.Text != "server maintenance" {
+		t.Errorf("expecting the configured close, got: %v", err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	// The stalled backend never reads, so it never answers pings.
+	upgrader := websocket.Upgrader{}
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		time.Sleep(2 * time.Second)
+	}))
+	defer stalled.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(stalled.URL, "http"))
+
+	proxy := NewProxy()
+	proxy.AddBackend(u)
+	proxy.IdleTimeout = 200 * time.Millisecond
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatal("idle connection was not closed by the proxy")
+			}
+			break
+		}
+	}
+	if d := time.Since(start); d < proxy.IdleTimeout {
+		t.Errorf("connection closed before the idle timeout: %s", d)
+	}
+}
+
+func TestIdleTimeoutKeepsLiveConnection(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.IdleTimeout = 100 * time.Millisecond
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+
+	// Reading answers the proxy's pings while no message is exchanged.
+	msgs := make(chan string, 1)
+	go func() {
+		for {
+			_, p, err := conn.ReadMessage()
+			if err != nil {
+				close(msgs)
+				return
+			}
+			msgs <- string(p)
+		}
+	}()
+
+	time.Sleep(3 * proxy.IdleTimeout)
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("still here")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-msgs; msg != "still here" {
+		t.Errorf("expecting echo after idle period, got: %q", msg)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.MaxConnections = 1
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err == nil {
+		t.Fatal("expecting the second connection to be rejected")
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expecting status %d, got: %v", http.StatusServiceUnavailable, resp)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("expecting a Retry-After header")
+	}
+
+	// The slot is freed once the first connection is gone.
+	conn.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("slot was not released after close")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReserveConnAtomic(t *testing.T) {
+	proxy := NewProxy()
+	proxy.MaxConnections = 5
+
+	var admitted int32
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if proxy.reserveConn() {
+				atomic.AddInt32(&admitted, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if admitted != 5 {
+		t.Errorf("expecting 5 admitted connections, got: %d", admitted)
+	}
+}
+
+func TestForwardClose(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "policy")
+		conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		conn.ReadMessage()
+	}))
+	defer backend.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(backend.URL, "http"))
+
+	proxy := NewProxy()
+	proxy.AddBackend(u)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+	_, _, err := conn.ReadMessage()
+	cerr, ok := err.(*websocket.CloseError)
+	if !ok {
+		t.Fatalf("expecting a close error, got: %v", err)
+	}
+	if cerr.Code != websocket.ClosePolicyViolation || cerr.Text != "policy" {
+		t.Errorf("expecting close 1008 \"policy\", got: %d %q", cerr.Code, cerr.Text)
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.MaxMessageSize = 16
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("small")); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "small" {
+		t.Fatalf("expecting the small message echoed, got: %q, %v", msg, err)
+	}
+
+	if err := conn.WriteMessage(websocket.TextMessage, make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("expecting close 1009, got: %v", err)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	// The backend accepts the connection but never reads from it.
+	release := make(chan struct{})
+	defer close(release)
+	upgrader := websocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		<-release
+	}))
+	defer backend.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(backend.URL, "http"))
+
+	proxy := NewProxy()
+	proxy.AddBackend(u)
+	proxy.WriteTimeout = 100 * time.Millisecond
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		conn.ReadMessage()
+	}()
+	msg := make([]byte, 1<<20)
+	go func() {
+		for conn.WriteMessage(websocket.BinaryMessage, msg) == nil {
+		}
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expecting the stalled connection to be closed")
+	}
+}
+
+func TestOnConnClose(t *testing.T) {
+	b := newEchoBackend(t)
+	statsc := make(chan ConnStats, 1)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.OnConnClose = func(stats ConnStats) {
+		statsc <- stats
+	}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	const n, size = 10, 100
+	msg := make([]byte, size)
+	for i := 0; i < n; i++ {
+		if err := conn.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	conn.Close()
+
+	select {
+	case stats := <-statsc:
+		if stats.BytesFromClient != n*size || stats.BytesFromBackend != n*size {
+			t.Errorf("expecting %d bytes each way, got: %d and %d", n*size, stats.BytesFromClient, stats.BytesFromBackend)
+		}
+		if stats.Backend.Host != b.url.Host {
+			t.Errorf("expecting backend %s, got: %s", b.url.Host, stats.Backend.Host)
+		}
+		if stats.ClientAddr != conn.LocalAddr().String() {
+			t.Errorf("expecting client %s, got: %s", conn.LocalAddr(), stats.ClientAddr)
+		}
+		if stats.Duration <= 0 {
+			t.Errorf("expecting a positive duration, got: %v", stats.Duration)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnConnClose was not called")
+	}
+}
+
+func TestClientInitiatedTeardown(t *testing.T) {
+	errs := make(chan error, 1)
+	upgrader := websocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}))
+	defer backend.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(backend.URL, "http"))
+
+	statsc := make(chan ConnStats, 1)
+	proxy := NewProxy()
+	proxy.AddBackend(u)
+	proxy.OnConnClose = func(stats ConnStats) {
+		statsc <- stats
+	}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	// The client goes away without a close frame.
+	dialProxy(t, s).UnderlyingConn().Close()
+
+	select {
+	case err := <-errs:
+		if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Errorf("expecting the backend to receive 1001, got: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("backend connection was not closed")
+	}
+	if stats := <-statsc; stats.ClosedBy != ClientSide {
+		t.Errorf("expecting the client to have closed, got: %v", stats.ClosedBy)
+	}
+}
+
+func TestBackendInitiatedTeardown(t *testing.T) {
+	statsc := make(chan ConnStats, 1)
+	proxy := NewProxy()
+	proxy.AddBackend(newDroppingBackend(t))
+	proxy.OnConnClose = func(stats ConnStats) {
+		statsc <- stats
+	}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("expecting the client to receive 1001, got: %v", err)
+	}
+	if stats := <-statsc; stats.ClosedBy != BackendSide {
+		t.Errorf("expecting the backend to have closed, got: %v", stats.ClosedBy)
+	}
+}
+
+func TestMaxConnLifetime(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.MaxConnLifetime = 100 * time.Millisecond
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	start := time.Now()
+	conn := dialProxy(t, s)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("expecting close 1001, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("connection closed too early, after %v", elapsed)
+	}
+}
+
+func TestLifetimeAndRebalanceClose(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.LifetimeCloseCode = 4000
+	proxy.LifetimeCloseReason = "rotate"
+	proxy.RebalanceInterval = 10 * time.Millisecond
+	proxy.RebalanceCloseCode = 4002
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+	for len(proxy.ActiveConnections()) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	proxy.Rebalance(1)
+	defer proxy.StopRebalance()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, 4002) {
+		t.Errorf("expecting close 4002 from Rebalance, got: %v", err)
+	}
+
+	proxy.MaxConnLifetime = 50 * time.Millisecond
+	conn = dialProxy(t, s)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = conn.ReadMessage()
+	if cerr, ok := err.(*websocket.CloseError); !ok || cerr.Code != 4000 || cerr.Text != "rotate" {
+		t.Errorf("expecting close 4000 \"rotate\" at the end of the lifetime, got: %v", err)
+	}
+}
+
+func TestConnDeadline(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	deadline := time.Now().Add(200 * time.Millisecond)
+	proxy.ConnDeadline = func(req *http.Request) time.Time {
+		if req.URL.Query().Get("token") == "" {
+			return time.Time{}
+		}
+		return deadline
+	}
+	proxy.ConnDeadlineCloseCode = 4001
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	conn, _, err := websocket.DefaultDialer.Dial(proxyURL+"?token=abc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	open := dialProxy(t, s)
+	defer open.Close()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, 4001) {
+		t.Fatalf("expecting close 4001, got: %v", err)
+	}
+	if early := time.Until(deadline); early > 10*time.Millisecond {
+		t.Errorf("connection closed %v before its deadline", early)
+	}
+	if late := time.Since(deadline); late > 500*time.Millisecond {
+		t.Errorf("connection closed %v after its deadline", late)
+	}
+
+	if err := open.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := open.ReadMessage(); err != nil || string(msg) != "hello" {
+		t.Errorf("expecting a connection without deadline to stay open, got: %q, %v", msg, err)
+	}
+}
+
+func TestConnLifetimeJitter(t *testing.T) {
+	proxy := NewProxy()
+	proxy.MaxConnLifetime = time.Minute
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		d := proxy.connLifetime()
+		if d > time.Minute || d < 54*time.Second {
+			t.Fatalf("lifetime out of range: %v", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 2 {
+		t.Error("expecting jittered lifetimes")
+	}
+}
+
+func TestNoGoroutineLeak(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.IdleTimeout = time.Minute
+	proxy.MaxConnLifetime = time.Minute
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	// Warm up the servers so their own goroutines are in the baseline.
+	dialProxy(t, s).Close()
+	time.Sleep(50 * time.Millisecond)
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 20; i++ {
+		conn := dialProxy(t, s)
+		conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+		conn.ReadMessage()
+		if i%2 == 0 {
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		}
+		conn.Close()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			t.Fatalf("expecting at most %d goroutines once connections are closed, got: %d", baseline, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShutdownStopsBackground(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	u, _ := url.Parse("ws" + strings.TrimPrefix(backend.URL, "http"))
+	baseline := runtime.NumGoroutine()
+
+	proxy := NewProxy()
+	proxy.StartHealthCheck(10 * time.Millisecond)
+	proxy.SetBackendProvider(func() []*url.URL { return []*url.URL{u} }, 10*time.Millisecond)
+	s := httptest.NewServer(proxy)
+	conns := make([]*websocket.Conn, 3)
+	for i := range conns {
+		conns[i] = dialProxy(t, s)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := proxy.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	s.Close()
+	backend.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			t.Fatalf("expecting at most %d goroutines after shutdown, got: %d", baseline, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShutdownAbortsHealthCheck(t *testing.T) {
+	proxy := NewProxy()
+	proxy.DialTimeout = 5 * time.Second
+	proxy.StartHealthCheck(10 * time.Millisecond)
+	// Added after the first round, so only the checker gets stuck on it.
+	proxy.AddBackend(stalledURL(t))
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := proxy.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expecting Shutdown not to wait for the health check in flight, took: %v", elapsed)
+	}
+	if info := proxy.BackendStatus()[0]; !info.Healthy {
+		t.Errorf("expecting an aborted check to leave the backend healthy, got: %+v", info)
+	}
+}
+
+func TestNoBackgroundAfterShutdown(t *testing.T) {
+	u, _ := url.Parse("ws://127.0.0.1:9000")
+	proxy := NewProxy()
+	if err := proxy.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	provided := false
+	proxy.StartHealthCheck(10 * time.Millisecond)
+	proxy.SetBackendProvider(func() []*url.URL {
+		provided = true
+		return []*url.URL{u}
+	}, 10*time.Millisecond)
+	proxy.mu.Lock()
+	running := proxy.healthStop != nil || proxy.providerStop != nil
+	proxy.mu.Unlock()
+	if running || provided {
+		t.Error("expecting StartHealthCheck and SetBackendProvider to do nothing after Shutdown")
+	}
+	if err := proxy.WaitReady(context.Background()); err != errHealthCheckStopped {
+		t.Errorf("expecting %v, got: %v", errHealthCheckStopped, err)
+	}
+}
+
+func TestForwardPings(t *testing.T) {
+	for _, forward := range []bool{false, true} {
+		pings := make(chan string, 1)
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.SetPingHandler(func(data string) error {
+				pings <- data
+				return conn.WriteControl(websocket.PongMessage, []byte("backend "+data), time.Now().Add(time.Second))
+			})
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}))
+		u, _ := url.Parse("ws" + strings.TrimPrefix(backend.URL, "http"))
+
+		proxy := NewProxy()
+		proxy.AddBackend(u)
+		proxy.ForwardPings = forward
+		s := httptest.NewServer(proxy)
+
+		conn := dialProxy(t, s)
+		pongs := make(chan string, 1)
+		conn.SetPongHandler(func(data string) error {
+			pongs <- data
+			return nil
+		})
+		go func() {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+		if err := conn.WriteControl(websocket.PingMessage, []byte("hb-1"), time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+
+		wantPong := "hb-1"
+		if forward {
+			wantPong = "backend hb-1"
+			select {
+			case got := <-pings:
+				if got != "hb-1" {
+					t.Errorf("expecting the ping payload at the backend, got: %q", got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("expecting the client ping to reach the backend")
+			}
+		}
+		select {
+		case got := <-pongs:
+			if got != wantPong {
+				t.Errorf("forward %v: expecting pong %q, got: %q", forward, wantPong, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("forward %v: expecting a pong", forward)
+		}
+		select {
+		case <-pings:
+			if !forward {
+				t.Error("expecting the proxy to answer the ping itself")
+			}
+		default:
+		}
+
+		conn.Close()
+		s.Close()
+		backend.Close()
+	}
+}
+
+func TestCloseConnection(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	kicked := dialProxy(t, s)
+	defer kicked.Close()
+	kept := dialProxy(t, s)
+	defer kept.Close()
+
+	// Find the ID of the first connection by its client address.
+	var id string
+	deadline := time.Now().Add(5 * time.Second)
+	for id == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("expecting the connection to be tracked")
+		}
+		proxy.mu.Lock()
+		for pc := range proxy.conns {
+			if pc.client.RemoteAddr().String() == kicked.LocalAddr().String() {
+				id = pc.id
+			}
+		}
+		proxy.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !proxy.CloseConnection(id) {
+		t.Fatal("expecting the connection to be found")
+	}
+	if _, _, err := kicked.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("expecting a policy violation close, got: %v", err)
+	}
+
+	if err := kept.WriteMessage(websocket.TextMessage, []byte("still here")); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := kept.ReadMessage(); err != nil || string(msg) != "still here" {
+		t.Errorf("expecting the other connection to stay open, got: %q, %v", msg, err)
+	}
+	if proxy.CloseConnection("unknown") {
+		t.Error("expecting an unknown ID not to be found")
+	}
+}
+
+func TestAllowedMessageTypes(t *testing.T) {
+	b := newEchoBackend(t)
+	tests := []struct {
+		allowed MessageTypes
+		msgType int
+		ok      bool
+	}{
+		{TextAndBinary, websocket.TextMessage, true},
+		{TextAndBinary, websocket.BinaryMessage, true},
+		{TextOnly, websocket.TextMessage, true},
+		{TextOnly, websocket.BinaryMessage, false},
+		{BinaryOnly, websocket.BinaryMessage, true},
+		{BinaryOnly, websocket.TextMessage, false},
+	}
+	for _, tt := range tests {
+		proxy := NewProxy()
+		proxy.AddBackend(b.url)
+		proxy.AllowedMessageTypes = tt.allowed
+		s := httptest.NewServer(proxy)
+
+		conn := dialProxy(t, s)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if err := conn.WriteMessage(tt.msgType, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		msgType, _, err := conn.ReadMessage()
+		if tt.ok && (err != nil || msgType != tt.msgType) {
+			t.Errorf("policy %d: expecting message type %d to be echoed, got: %d, %v", tt.allowed, tt.msgType, msgType, err)
+		}
+		if !tt.ok && !websocket.IsCloseError(err, websocket.CloseUnsupportedData) {
+			t.Errorf("policy %d: expecting close 1003 for message type %d, got: %v", tt.allowed, tt.msgType, err)
+		}
+		conn.Close()
+		s.Close()
+	}
+}
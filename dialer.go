@@ -0,0 +1,271 @@
+package websocketproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultDialTimeout is used when neither WebsocketProxy.DialTimeout nor the
+// HandshakeTimeout of Dialer is set, so a backend accepting connections but
+// never answering the handshake cannot hold a client for long.
+const DefaultDialTimeout = 10 * time.Second
+
+// DefaultUpgradeTimeout is used when neither WebsocketProxy.UpgradeTimeout
+// nor the HandshakeTimeout of the upgrader is set.
+const DefaultUpgradeTimeout = 10 * time.Second
+
+// dialer returns the dialer used to connect to backends. It is a copy of
+// Dialer, or DefaultDialer if nil, with the proxy's settings applied, so
+// neither of them is ever modified.
+func (w *WebsocketProxy) dialer() *websocket.Dialer {
+	dialer := w.Dialer
+	if w.Dialer == nil {
+		dialer = DefaultDialer
+	}
+	d := *dialer
+
+	w.mu.Lock()
+	if w.tlsConfig != nil {
+		d.TLSClientConfig = w.tlsConfig
+	}
+	w.mu.Unlock()
+
+	// DialTimeout only replaces the default handshake timeout, never one
+	// configured on Dialer.
+	if w.Dialer == nil || w.Dialer.HandshakeTimeout == 0 {
+		d.HandshakeTimeout = w.DialTimeout
+		if d.HandshakeTimeout <= 0 {
+			d.HandshakeTimeout = DefaultDialTimeout
+		}
+	}
+
+	if w.Dialer == nil {
+		w.applyBufferSizes(&d.ReadBufferSize, &d.WriteBufferSize)
+	}
+	if w.BackendProxyURL != nil {
+		d.Proxy = http.ProxyURL(w.BackendProxyURL)
+	}
+	if w.EnableCompression {
+		d.EnableCompression = true
+	}
+	if w.WriteBufferPool != nil && d.WriteBufferPool == nil {
+		d.WriteBufferPool = w.WriteBufferPool
+	}
+
+	if (w.ConnectTimeout > 0 || w.KeepAlive > 0 || w.BackendLocalAddr != nil) && d.NetDial == nil && d.NetDialContext == nil {
+		netDialer := &net.Dialer{Timeout: w.ConnectTimeout, KeepAlive: w.KeepAlive}
+		if w.BackendLocalAddr != nil {
+			netDialer.LocalAddr = w.BackendLocalAddr
+		}
+		d.NetDialContext = netDialer.DialContext
+	}
+
+	return &d
+}
+
+// applyBackendSettings applies the settings of b to the handshake made with
+// dialer and requestHeader: the headers of AddBackendWithHeaders and the
+// Host and TLS server name of SetBackendHost. Client and health check
+// handshakes use it alike so backends see the same requests from both.
+func (w *WebsocketProxy) applyBackendSettings(b *backend, dialer *websocket.Dialer, requestHeader http.Header) {
+	w.mu.Lock()
+	host, header := b.host, b.header
+	w.mu.Unlock()
+
+	for name, values := range header {
+		name = http.CanonicalHeaderKey(name)
+		if !handshakeHeaders[name] {
+			requestHeader[name] = append([]string(nil), values...)
+		}
+	}
+	if host != "" {
+		requestHeader.Set("Host", host)
+		tlsConfig := &tls.Config{}
+		if dialer.TLSClientConfig != nil {
+			tlsConfig = dialer.TLSClientConfig.Clone()
+		}
+		tlsConfig.ServerName = hostname(host)
+		dialer.TLSClientConfig = tlsConfig
+	}
+}
+
+// abortOnDone makes d close the connections it dials once ctx is done.
+// DialContext only honors ctx until the TCP connection is established and
+// would otherwise wait for the backend's handshake response regardless. The
+// returned function must be called when the dial returned and reports
+// whether ctx is done, in which case a connection that was dialed anyway
+// must be discarded.
+func abortOnDone(ctx context.Context, d *websocket.Dialer) func() bool {
+	var (
+		mu       sync.Mutex
+		conns    []net.Conn
+		finished bool
+	)
+	track := func(conn net.Conn, err error) (net.Conn, error) {
+		if err == nil {
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+		return conn, err
+	}
+
+	netDial := d.NetDialContext
+	if netDial == nil && d.NetDial != nil {
+		dial := d.NetDial
+		netDial = func(_ context.Context, network, addr string) (net.Conn, error) {
+			return dial(network, addr)
+		}
+	}
+	if netDial == nil {
+		netDial = (&net.Dialer{}).DialContext
+	}
+	d.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return track(netDial(ctx, network, addr))
+	}
+	if tlsDial := d.NetDialTLSContext; tlsDial != nil {
+		d.NetDialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return track(tlsDial(ctx, network, addr))
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			mu.Lock()
+			if !finished {
+				for _, conn := range conns {
+					conn.Close()
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+	return func() bool {
+		mu.Lock()
+		finished = true
+		mu.Unlock()
+		close(done)
+		return ctx.Err() != nil
+	}
+}
+
+// redirectURL returns the URL a redirect response to a handshake with
+// target points to, or nil if its Location is missing or not a WebSocket
+// URL. http and https locations are mapped to ws and wss.
+func redirectURL(target *url.URL, resp *http.Response) *url.URL {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return nil
+	}
+	u, err := target.Parse(location)
+	if err != nil {
+		return nil
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	case "ws", "wss":
+	default:
+		return nil
+	}
+	return u
+}
+
+// upgrader returns the upgrader used for client connections. Like dialer, it
+// is a copy of Upgrader, or DefaultUpgrader if nil, with the proxy's settings
+// applied.
+func (w *WebsocketProxy) upgrader() *websocket.Upgrader {
+	upgrader := w.Upgrader
+	if w.Upgrader == nil {
+		upgrader = DefaultUpgrader
+	}
+	u := *upgrader
+
+	if w.UpgradeTimeout > 0 {
+		u.HandshakeTimeout = w.UpgradeTimeout
+	} else if u.HandshakeTimeout == 0 {
+		u.HandshakeTimeout = DefaultUpgradeTimeout
+	}
+	if w.Upgrader == nil {
+		w.applyBufferSizes(&u.ReadBufferSize, &u.WriteBufferSize)
+	}
+	if w.EnableCompression {
+		u.EnableCompression = true
+	}
+	if w.WriteBufferPool != nil && u.WriteBufferPool == nil {
+		u.WriteBufferPool = w.WriteBufferPool
+	}
+	if w.originCheckEnabled() {
+		u.CheckOrigin = w.checkOrigin
+	}
+
+	return &u
+}
+
+// applyBufferSizes sets the buffer sizes of a default dialer or upgrader to
+// ReadBufferSize and WriteBufferSize, if set.
+func (w *WebsocketProxy) applyBufferSizes(read, write *int) {
+	if w.ReadBufferSize > 0 {
+		*read = w.ReadBufferSize
+	}
+	if w.WriteBufferSize > 0 {
+		*write = w.WriteBufferSize
+	}
+}
+
+// checkHandshake runs the checks of upgrader.Upgrade that depend on req
+// alone and returns the status and error to reject it with, if any.
+func checkHandshake(upgrader *websocket.Upgrader, req *http.Request) (int, error) {
+	if req.Method != http.MethodGet {
+		return http.StatusMethodNotAllowed, errNotWebSocket
+	}
+	if req.Header.Get(headerKey) == "" {
+		return http.StatusBadRequest, errNotWebSocket
+	}
+	if req.Header.Get(headerVersion) != "13" {
+		return http.StatusUpgradeRequired, errUnsupportedVersion
+	}
+	checkOrigin := upgrader.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(req) {
+		return http.StatusForbidden, errOriginNotAllowed
+	}
+	return 0, nil
+}
+
+// SetBackendTLSConfig sets the TLS configuration used to connect to wss://
+// backends, for example to trust a private CA. It overrides the
+// TLSClientConfig of Dialer without modifying it.
+func (w *WebsocketProxy) SetBackendTLSConfig(cfg *tls.Config) {
+	w.mu.Lock()
+	w.tlsConfig = cfg
+	w.mu.Unlock()
+}
+
+// checkBackendProxy returns an error if BackendProxyURL uses a scheme the
+// Dialer cannot tunnel through.
+func (w *WebsocketProxy) checkBackendProxy() error {
+	if w.BackendProxyURL == nil {
+		return nil
+	}
+	switch w.BackendProxyURL.Scheme {
+	case "http", "socks5":
+		return nil
+	}
+	return fmt.Errorf("%w: %q", errBackendProxyScheme, w.BackendProxyURL.Scheme)
+}
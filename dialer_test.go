@@ -0,0 +1,613 @@
+package websocketproxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDialerKeepAlive(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.KeepAlive = 30 * time.Second
+	proxy.ConnectTimeout = time.Second
+
+	if proxy.dialer().NetDialContext == nil {
+		t.Fatal("expecting a net dialer to apply KeepAlive and ConnectTimeout")
+	}
+	if DefaultDialer.NetDialContext != nil {
+		t.Fatal("DefaultDialer must not be modified")
+	}
+
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	conn := dialProxy(t, s)
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, p, err := conn.ReadMessage(); err != nil || string(p) != "hello" {
+		t.Errorf("expecting echo, got: %q, %v", p, err)
+	}
+}
+
+func TestDialerKeepsCustomNetDial(t *testing.T) {
+	b := newEchoBackend(t)
+	var dials int32
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.KeepAlive = 30 * time.Second
+	proxy.Dialer = &websocket.Dialer{
+		NetDial: func(network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return net.Dial(network, addr)
+		},
+	}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	dialProxy(t, s).Close()
+	if atomic.LoadInt32(&dials) != 1 {
+		t.Error("expecting the custom NetDial to be used")
+	}
+}
+
+// stalledURL returns a ws:// URL of a listener that accepts connections but
+// never answers the handshake.
+func stalledURL(t *testing.T) *url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	u, _ := url.Parse("ws://" + l.Addr().String())
+	return u
+}
+
+func TestBackendLocalAddr(t *testing.T) {
+	// Any address of 127.0.0.0/8 is a loopback alias on Linux.
+	source := net.ParseIP("127.0.0.2")
+	l, err := net.Listen("tcp", source.String()+":0")
+	if err != nil {
+		t.Skipf("no loopback alias %s: %v", source, err)
+	}
+	l.Close()
+
+	remote := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote <- r.RemoteAddr
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	defer backend.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(backend.URL, "http"))
+
+	proxy := NewProxy()
+	proxy.AddBackend(u)
+	proxy.BackendLocalAddr = &net.TCPAddr{IP: source}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	dialProxy(t, s).Close()
+	host, _, _ := net.SplitHostPort(<-remote)
+	if host != source.String() {
+		t.Errorf("expecting the backend connection from %s, got: %s", source, host)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	stalled := stalledURL(t)
+	b := newEchoBackend(t)
+	metrics := newRecordingMetrics()
+
+	proxy := NewProxy()
+	proxy.AddBackend(stalled)
+	proxy.AddBackend(b.url)
+	proxy.DialTimeout = 100 * time.Millisecond
+	proxy.Metrics = metrics
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	start := time.Now()
+	dialProxy(t, s).Close()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expecting failover within the dial timeout, took: %s", d)
+	}
+	if n := metrics.get(metrics.errors, stalled.Host); n != 1 {
+		t.Errorf("expecting the stalled backend to count as failed, got: %d", n)
+	}
+	if proxy.BackendStatus()[0].Available {
+		t.Error("expecting the circuit of the stalled backend to open")
+	}
+}
+
+func TestDefaultDialTimeout(t *testing.T) {
+	proxy := NewProxy()
+	if d := proxy.dialer().HandshakeTimeout; d != DefaultDialTimeout {
+		t.Errorf("expecting the default dial timeout, got: %s", d)
+	}
+	proxy.Dialer = &websocket.Dialer{}
+	if d := proxy.dialer().HandshakeTimeout; d != DefaultDialTimeout {
+		t.Errorf("expecting the default dial timeout for a dialer without one, got: %s", d)
+	}
+	proxy.Dialer = &websocket.Dialer{HandshakeTimeout: time.Minute}
+	proxy.DialTimeout = time.Second
+	if d := proxy.dialer().HandshakeTimeout; d != time.Minute {
+		t.Errorf("expecting the timeout of Dialer to win, got: %s", d)
+	}
+}
+
+func TestBackendProxyURL(t *testing.T) {
+	b := newEchoBackend(t)
+	connects := make(chan string, 1)
+	mock := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		connects <- r.Host
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+		w.WriteHeader(http.StatusOK)
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.Flush()
+		go func() {
+			io.Copy(upstream, rw)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+	}))
+	defer mock.Close()
+
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.BackendProxyURL, _ = url.Parse(mock.URL)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "hello" {
+		t.Fatalf("expecting the echo through the outbound proxy, got: %q, %v", msg, err)
+	}
+	select {
+	case host := <-connects:
+		if host != b.url.Host {
+			t.Errorf("expecting a tunnel to %s, got: %s", b.url.Host, host)
+		}
+	default:
+		t.Error("expecting the backend connection to go through the outbound proxy")
+	}
+}
+
+func TestBackendProxyURLScheme(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.BackendProxyURL, _ = url.Parse("https://proxy.example:3128")
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, newHandshakeRequest("/"))
+	if rw.Code != http.StatusInternalServerError {
+		t.Errorf("expecting %d for an https outbound proxy, got: %d", http.StatusInternalServerError, rw.Code)
+	}
+	if n := b.Accepted(); n != 0 {
+		t.Errorf("expecting no backend connection, got: %d", n)
+	}
+	if info := proxy.BackendStatus()[0]; !info.Available {
+		t.Errorf("expecting the backend to stay available, got: %+v", info)
+	}
+
+	proxy.BackendProxyURL.Scheme = "socks5"
+	if err := proxy.checkBackendProxy(); err != nil {
+		t.Errorf("expecting socks5 to be accepted, got: %v", err)
+	}
+}
+
+func TestBackendRedirect(t *testing.T) {
+	b := newEchoBackend(t)
+	redirects := 0
+	var mu sync.Mutex
+	redirecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		redirects++
+		mu.Unlock()
+		target := "http://" + b.url.Host + r.URL.Path
+		if r.URL.Path == "/loop" {
+			target = r.URL.Path
+		}
+		http.Redirect(w, r, target, http.StatusFound)
+	}))
+	defer redirecting.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(redirecting.URL, "http"))
+
+	proxy := NewProxy()
+	proxy.AddBackend(u)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	// Not followed by default.
+	_, resp, err := websocket.DefaultDialer.Dial(proxyURL, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expecting status %d for an unfollowed redirect, got: %v", http.StatusServiceUnavailable, err)
+	}
+	if n := b.Accepted(); n != 0 {
+		t.Fatalf("expecting the redirect not to be followed, got %d connections", n)
+	}
+
+	proxy = NewProxy()
+	proxy.AddBackend(u)
+	proxy.MaxBackendRedirects = 2
+	s2 := httptest.NewServer(proxy)
+	defer s2.Close()
+	proxyURL = "ws" + strings.TrimPrefix(s2.URL, "http")
+
+	conn, _, err := websocket.DefaultDialer.Dial(proxyURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "hello" {
+		t.Fatalf("expecting the echo of the redirect target, got: %q, %v", msg, err)
+	}
+	if n := b.Accepted(); n != 1 {
+		t.Errorf("expecting the redirect target to be dialed once, got: %d", n)
+	}
+	if info := proxy.BackendStatus()[0]; info.ActiveConns != 1 {
+		t.Errorf("expecting the connection to count against the selected backend, got: %d", info.ActiveConns)
+	}
+
+	// A redirect loop stops after MaxBackendRedirects.
+	mu.Lock()
+	redirects = 0
+	mu.Unlock()
+	_, resp, err = websocket.DefaultDialer.Dial(proxyURL+"/loop", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expecting status %d for a redirect loop, got: %v", http.StatusServiceUnavailable, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if redirects != 3 {
+		t.Errorf("expecting the first handshake and 2 redirects, got: %d", redirects)
+	}
+}
+
+func TestBackendRedirectCrossHost(t *testing.T) {
+	target, headers := newHeaderBackend(t)
+	redirected := make(chan http.Header, 1)
+	redirecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirected <- r.Header
+		http.Redirect(w, r, "http://"+target.Host+r.URL.Path, http.StatusFound)
+	}))
+	defer redirecting.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(redirecting.URL, "http"))
+
+	proxy := NewProxy()
+	proxy.AddBackendWithHeaders(u, http.Header{"X-Api-Key": {"secret"}})
+	proxy.ForwardHeaders = []string{"Authorization"}
+	proxy.MaxBackendRedirects = 1
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	header := http.Header{"Authorization": {"Bearer token"}, "Cookie": {"session=1"}}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	h := <-redirected
+	if h.Get("X-Api-Key") != "secret" || h.Get("Authorization") == "" || h.Get("Cookie") == "" {
+		t.Errorf("expecting the backend to get its headers and the credentials, got: %v", h)
+	}
+	h = <-headers
+	for _, name := range []string{"X-Api-Key", "Authorization", "Cookie"} {
+		if got := h.Get(name); got != "" {
+			t.Errorf("expecting %s not to follow a redirect to another host, got: %q", name, got)
+		}
+	}
+}
+
+func TestDialCancelledWithRequest(t *testing.T) {
+	stalled := stalledURL(t)
+	metrics := newRecordingMetrics()
+	proxy := NewProxy()
+	proxy.AddBackend(stalled)
+	proxy.Metrics = metrics
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	rw := httptest.NewRecorder()
+	start := time.Now()
+	proxy.ServeHTTP(rw, newHandshakeRequest("/").WithContext(ctx))
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expecting the dial to be aborted with the request, took: %s", d)
+	}
+	if n := metrics.get(metrics.errors, stalled.Host); n != 0 {
+		t.Errorf("expecting the aborted dial not to count as failed, got: %d", n)
+	}
+	if !proxy.BackendStatus()[0].Available {
+		t.Error("expecting the backend to stay available")
+	}
+}
+
+func TestEnableCompression(t *testing.T) {
+	extensions := make(chan string, 1)
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		extensions <- r.Header.Get("Sec-WebSocket-Extensions")
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		messageType, p, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.WriteMessage(messageType, p)
+	}))
+	defer backend.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(backend.URL, "http"))
+
+	proxy := NewProxy()
+	proxy.AddBackend(u)
+	proxy.EnableCompression = true
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	dialer := websocket.Dialer{EnableCompression: true}
+	conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if ext := <-extensions; !strings.Contains(ext, "permessage-deflate") {
+		t.Errorf("expecting the backend to be offered compression, got: %q", ext)
+	}
+	if ext := resp.Header.Get("Sec-WebSocket-Extensions"); !strings.Contains(ext, "permessage-deflate") {
+		t.Errorf("expecting the client to negotiate compression, got: %q", ext)
+	}
+
+	msg := strings.Repeat("compress me ", 100)
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	if _, p, err := conn.ReadMessage(); err != nil || string(p) != msg {
+		t.Errorf("expecting compressed round trip, got: %d bytes, %v", len(p), err)
+	}
+}
+
+func TestCompressionMatchesOnBothLegs(t *testing.T) {
+	for _, tt := range []struct{ client, backend bool }{
+		{true, true}, {true, false}, {false, true}, {false, false},
+	} {
+		offered := make(chan bool, 1)
+		upgrader := websocket.Upgrader{EnableCompression: tt.backend}
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			offered <- offersDeflate(r.Header)
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}))
+		u, _ := url.Parse("ws" + strings.TrimPrefix(backend.URL, "http"))
+
+		proxy := NewProxy()
+		proxy.AddBackend(u)
+		proxy.EnableCompression = true
+		s := httptest.NewServer(proxy)
+
+		dialer := websocket.Dialer{EnableCompression: tt.client}
+		conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+
+		backendLeg := <-offered && tt.backend
+		clientLeg := offersDeflate(resp.Header)
+		if backendLeg != (tt.client && tt.backend) || clientLeg != backendLeg {
+			t.Errorf("client %v, backend %v: expecting matching compression, got client leg %v, backend leg %v",
+				tt.client, tt.backend, clientLeg, backendLeg)
+		}
+		s.Close()
+		backend.Close()
+	}
+}
+
+func TestWriteBufferPool(t *testing.T) {
+	pool := &sync.Pool{}
+	proxy := NewProxy()
+	proxy.WriteBufferPool = pool
+	if proxy.dialer().WriteBufferPool != pool || proxy.upgrader().WriteBufferPool != pool {
+		t.Error("expecting the pool on both the dialer and the upgrader")
+	}
+	if DefaultUpgrader.WriteBufferPool != nil || DefaultDialer.WriteBufferPool != nil {
+		t.Error("the default upgrader and dialer must not be modified")
+	}
+
+	own := &sync.Pool{}
+	proxy.Upgrader = &websocket.Upgrader{WriteBufferPool: own}
+	if proxy.upgrader().WriteBufferPool != own {
+		t.Error("expecting the upgrader's own pool to win")
+	}
+}
+
+func TestBufferSizes(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.ReadBufferSize = 64 << 10
+	proxy.WriteBufferSize = 32 << 10
+	if d, u := proxy.dialer(), proxy.upgrader(); d.ReadBufferSize != 64<<10 || u.ReadBufferSize != 64<<10 ||
+		d.WriteBufferSize != 32<<10 || u.WriteBufferSize != 32<<10 {
+		t.Error("expecting the buffer sizes on both the dialer and the upgrader")
+	}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+	msg := []byte(strings.Repeat("0123456789", 100<<10))
+	if err := conn.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, got, err := conn.ReadMessage(); err != nil || string(got) != string(msg) {
+		t.Errorf("expecting the large message back, got %d bytes: %v", len(got), err)
+	}
+
+	proxy.Upgrader = &websocket.Upgrader{ReadBufferSize: 1024}
+	if proxy.upgrader().ReadBufferSize != 1024 {
+		t.Error("expecting an explicit Upgrader to keep its own buffer sizes")
+	}
+}
+
+// BenchmarkIdleConnections reports the heap held per idle proxied connection
+// after a message went through it, with and without a WriteBufferPool.
+func BenchmarkIdleConnections(b *testing.B) {
+	for _, pooled := range []bool{false, true} {
+		name := "NoPool"
+		if pooled {
+			name = "Pool"
+		}
+		b.Run(name, func(b *testing.B) {
+			backend := newEchoBackend(b)
+			proxy := NewProxy()
+			proxy.AddBackend(backend.url)
+			if pooled {
+				proxy.WriteBufferPool = &sync.Pool{}
+			}
+			s := httptest.NewServer(proxy)
+			defer s.Close()
+			proxyURL := "ws" + strings.TrimPrefix(s.URL, "http")
+
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			conns := make([]*websocket.Conn, 0, b.N)
+			for i := 0; i < b.N; i++ {
+				conn, _, err := websocket.DefaultDialer.Dial(proxyURL, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+				conn.ReadMessage()
+				conns = append(conns, conn)
+			}
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(after.HeapInuse-before.HeapInuse)/float64(b.N), "heap-B/conn")
+			for _, conn := range conns {
+				conn.Close()
+			}
+		})
+	}
+}
+
+// stalledClient is a ResponseWriter whose hijacked connection is never read,
+// like a client that sent its handshake and stalls.
+type stalledClient struct {
+	httptest.ResponseRecorder
+	conn net.Conn
+}
+
+func (c *stalledClient) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return c.conn, bufio.NewReadWriter(bufio.NewReader(c.conn), bufio.NewWriter(c.conn)), nil
+}
+
+func TestUpgradeTimeout(t *testing.T) {
+	closed := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}))
+	defer backend.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(backend.URL, "http"))
+
+	proxy := NewProxy()
+	proxy.UpgradeTimeout = 50 * time.Millisecond
+	proxy.AddBackend(u)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	req := newHandshakeRequest("/")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		proxy.ServeHTTP(&stalledClient{conn: server}, req)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expecting the stalled upgrade to time out")
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expecting the backend connection to be closed")
+	}
+}
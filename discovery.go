@@ -0,0 +1,77 @@
+package websocketproxy
+
+import (
+	"net/url"
+	"time"
+)
+
+// DefaultBackendRefresh is used by SetBackendProvider when refresh is not
+// positive.
+const DefaultBackendRefresh = 30 * time.Second
+
+// SetBackendProvider drives the backends from provider, for example a
+// lookup in a service registry. provider is called right away and then
+// every refresh, and its result replaces the backends as with SetBackends.
+// An empty result is taken as a failed lookup and leaves the backends as
+// they are, so a registry outage cannot empty the pool. A refresh that is
+// not positive is replaced with DefaultBackendRefresh. Calling it again
+// replaces the provider; StopBackendProvider stops it. Once Shutdown was
+// called it does nothing.
+func (w *WebsocketProxy) SetBackendProvider(provider func() []*url.URL, refresh time.Duration) {
+	if refresh <= 0 {
+		refresh = DefaultBackendRefresh
+	}
+	if w.isShuttingDown() {
+		return
+	}
+	w.StopBackendProvider()
+
+	w.refreshBackends(provider)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	if !w.startBackground(&w.providerStop, &w.providerDone, stop, done) {
+		return
+	}
+
+	go func() {
+		defer w.background.Done()
+		defer close(done)
+		ticker := time.NewTicker(refresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				w.refreshBackends(provider)
+			}
+		}
+	}()
+}
+
+// StopBackendProvider stops the refreshes started by SetBackendProvider and
+// waits for them to exit. The backends are left as they are.
+func (w *WebsocketProxy) StopBackendProvider() {
+	w.mu.Lock()
+	stop, done := w.providerStop, w.providerDone
+	w.providerStop, w.providerDone = nil, nil
+	w.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+// refreshBackends replaces the backends with the result of provider unless
+// it is empty.
+func (w *WebsocketProxy) refreshBackends(provider func() []*url.URL) {
+	targets := provider()
+	if len(targets) == 0 {
+		w.logger().Errorf("websocketproxy: backend provider returned no backend, keeping the current ones")
+		return
+	}
+	w.SetBackends(targets)
+}
@@ -0,0 +1,80 @@
+package websocketproxy
+
+import (
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackendProvider(t *testing.T) {
+	a, _ := url.Parse("ws://10.0.0.1:9000")
+	b, _ := url.Parse("ws://10.0.0.2:9000")
+	c, _ := url.Parse("ws://10.0.0.3:9000")
+
+	var mu sync.Mutex
+	current := []*url.URL{a, b}
+	provider := func() []*url.URL {
+		mu.Lock()
+		defer mu.Unlock()
+		return current
+	}
+	set := func(targets ...*url.URL) {
+		mu.Lock()
+		current = targets
+		mu.Unlock()
+	}
+	proxy := NewProxy()
+	// waitBackends waits for the backends to be want.
+	waitBackends := func(want ...*url.URL) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			status := proxy.BackendStatus()
+			same := len(status) == len(want)
+			for i := 0; same && i < len(want); i++ {
+				same = status[i].URL.String() == want[i].String()
+			}
+			if same {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expecting backends %v, got: %+v", want, status)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	proxy.SetBackendProvider(provider, 10*time.Millisecond)
+	defer proxy.StopBackendProvider()
+	if n := len(proxy.BackendStatus()); n != 2 {
+		t.Fatalf("expecting the first refresh before SetBackendProvider returns, got %d backends", n)
+	}
+	proxy.DrainBackend(b)
+
+	set(b, c)
+	waitBackends(b, c)
+	if !proxy.BackendStatus()[0].Draining {
+		t.Error("expecting a backend that stayed to keep its state")
+	}
+
+	// A failed lookup keeps the pool.
+	set()
+	time.Sleep(50 * time.Millisecond)
+	waitBackends(b, c)
+
+	proxy.StopBackendProvider()
+	set(a)
+	time.Sleep(50 * time.Millisecond)
+	waitBackends(b, c)
+}
+
+func TestBackendProviderZeroRefresh(t *testing.T) {
+	u, _ := url.Parse("ws://127.0.0.1:9001")
+	proxy := NewProxy()
+	proxy.SetBackendProvider(func() []*url.URL { return []*url.URL{u} }, 0)
+	defer proxy.StopBackendProvider()
+
+	if n := proxy.backendCount(); n != 1 {
+		t.Errorf("expecting the provider to be used with the default refresh, got %d backends", n)
+	}
+}
@@ -0,0 +1,83 @@
+package websocketproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// DefaultBackendErrorStatus is used when WebsocketProxy.BackendErrorStatus is
+// zero.
+const DefaultBackendErrorStatus = http.StatusServiceUnavailable
+
+// relayedHeaders are the headers of a backend's rejection passed on to the
+// client together with its status.
+var relayedHeaders = []string{"Www-Authenticate", "Retry-After", headerVersion}
+
+// HandshakeError is reported when backends reject the handshake with a 4xx
+// client error. If every backend answers with the same status, the status
+// and the WWW-Authenticate, Retry-After and Sec-WebSocket-Version headers
+// are relayed to the client instead of a generic error, so clients can tell
+// 401 from 403 or retry a 426 with a version the backend supports.
+type HandshakeError struct {
+	// StatusCode is the status returned by the backend.
+	StatusCode int
+
+	// Header holds the relayed headers of the backend response.
+	Header http.Header
+}
+
+func newHandshakeError(resp *http.Response) *HandshakeError {
+	header := http.Header{}
+	for _, name := range relayedHeaders {
+		if values, ok := resp.Header[name]; ok {
+			header[name] = append([]string(nil), values...)
+		}
+	}
+	return &HandshakeError{StatusCode: resp.StatusCode, Header: header}
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("backend rejected handshake: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// StatusError is the error passed to WebsocketProxy.ErrorHandler. Code is
+// the status the proxy answers with by default and Err the reason, for
+// example a *HandshakeError.
+type StatusError struct {
+	Code int
+	Err  error
+}
+
+func (e *StatusError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns Err.
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// httpError answers req with the error err and status code, through
+// ErrorHandler if set and with text as the body otherwise. Headers set on rw
+// beforehand, such as Retry-After, are kept.
+func (w *WebsocketProxy) httpError(rw http.ResponseWriter, req *http.Request, err error, code int, text string) {
+	if w.ErrorHandler != nil {
+		w.ErrorHandler(rw, req, &StatusError{Code: code, Err: err})
+		return
+	}
+	http.Error(rw, text, code)
+}
+
+// backendError answers req with BackendErrorStatus after err prevented
+// reaching a backend. A 503 tells clients to retry later with Retry-After.
+func (w *WebsocketProxy) backendError(rw http.ResponseWriter, req *http.Request, err error) {
+	code := w.BackendErrorStatus
+	if code == 0 {
+		code = DefaultBackendErrorStatus
+	}
+	if code == http.StatusServiceUnavailable {
+		rw.Header().Set("Retry-After", retryAfter)
+	}
+	w.httpError(rw, req, err, code, strings.ToLower(http.StatusText(code)))
+}
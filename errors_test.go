@@ -0,0 +1,191 @@
+package websocketproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// newRejectingBackend returns a backend answering every handshake with
+// status.
+func newRejectingBackend(t *testing.T, status int) *url.URL {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="backend"`)
+		w.Header().Set("X-Internal", "secret")
+		http.Error(w, http.StatusText(status), status)
+	}))
+	t.Cleanup(s.Close)
+	u, _ := url.Parse("ws" + strings.TrimPrefix(s.URL, "http"))
+	return u
+}
+
+func TestRelayBackendRejection(t *testing.T) {
+	proxy := NewProxy()
+	proxy.AddBackend(newRejectingBackend(t, http.StatusUnauthorized))
+	proxy.AddBackend(newRejectingBackend(t, http.StatusUnauthorized))
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err == nil {
+		t.Fatal("expecting the handshake to fail")
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expecting status %d, got: %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+	if v := resp.Header.Get("WWW-Authenticate"); v != `Bearer realm="backend"` {
+		t.Errorf("expecting WWW-Authenticate to be relayed, got: %q", v)
+	}
+	if v := resp.Header.Get("X-Internal"); v != "" {
+		t.Errorf("expecting X-Internal not to be relayed, got: %q", v)
+	}
+
+	// Rejections say nothing about the backend's health.
+	if !proxy.selectable(0) || !proxy.selectable(1) {
+		t.Error("expecting rejecting backends to stay selectable")
+	}
+}
+
+func TestMixedBackendRejection(t *testing.T) {
+	proxy := NewProxy()
+	proxy.AddBackend(newRejectingBackend(t, http.StatusUnauthorized))
+	proxy.AddBackend(newRejectingBackend(t, http.StatusForbidden))
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err == nil {
+		t.Fatal("expecting the handshake to fail")
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expecting status %d, got: %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+
+	rw := httptest.NewRecorder()
+	req := newHandshakeRequest("/")
+	req.Header.Set("Sec-WebSocket-Version", "8")
+	proxy.ServeHTTP(rw, req)
+	if rw.Code != http.StatusUpgradeRequired {
+		t.Errorf("expecting status %d, got: %d", http.StatusUpgradeRequired, rw.Code)
+	}
+	if v := rw.Header().Get("Sec-WebSocket-Version"); v != "13" {
+		t.Errorf("expecting the supported version to be listed, got: %q", v)
+	}
+	if n := b.Accepted(); n != 0 {
+		t.Errorf("expecting no backend dial for an unsupported version, got: %d", n)
+	}
+}
+
+func TestRelayVersionMismatch(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Sec-WebSocket-Version", "13, 8")
+		http.Error(w, http.StatusText(http.StatusUpgradeRequired), http.StatusUpgradeRequired)
+	}))
+	defer backend.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(backend.URL, "http"))
+
+	proxy := NewProxy()
+	proxy.AddBackend(u)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err == nil {
+		t.Fatal("expecting the handshake to fail")
+	}
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Errorf("expecting status %d, got: %d", http.StatusUpgradeRequired, resp.StatusCode)
+	}
+	if v := resp.Header.Get("Sec-WebSocket-Version"); v != "13, 8" {
+		t.Errorf("expecting the backend's versions to be relayed, got: %q", v)
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	proxy := NewProxy()
+	proxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+		serr, ok := err.(*StatusError)
+		if !ok {
+			t.Errorf("expecting a *StatusError, got: %T", err)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(serr.Code)
+		fmt.Fprintf(rw, `{"error":%q}`, serr.Err.Error())
+	}
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, newHandshakeRequest("/"))
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("expecting status %d, got: %d", http.StatusServiceUnavailable, rw.Code)
+	}
+	if rw.Header().Get("Retry-After") == "" {
+		t.Error("expecting the Retry-After header to be kept")
+	}
+	want := `{"error":"No backend available"}`
+	if body := rw.Body.String(); body != want {
+		t.Errorf("expecting body %s, got: %s", want, body)
+	}
+}
+
+func TestBackendErrorStatus(t *testing.T) {
+	dead := closedURL(t)
+	var reported []error
+	proxy := NewProxy()
+	proxy.Router = func(req *http.Request) *url.URL { return dead }
+	proxy.OnProxyError = func(req *http.Request, err error) { reported = append(reported, err) }
+
+	// A backend that cannot be dialed is unavailable, not an internal error.
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, newHandshakeRequest("/"))
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("expecting status %d, got: %d", http.StatusServiceUnavailable, rw.Code)
+	}
+	if rw.Header().Get("Retry-After") == "" {
+		t.Error("expecting a Retry-After header with 503")
+	}
+
+	proxy.BackendErrorStatus = http.StatusBadGateway
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, newHandshakeRequest("/"))
+	if rw.Code != http.StatusBadGateway {
+		t.Errorf("expecting status %d, got: %d", http.StatusBadGateway, rw.Code)
+	}
+	if rw.Header().Get("Retry-After") != "" {
+		t.Error("expecting no Retry-After header with 502")
+	}
+	if len(reported) != 2 {
+		t.Errorf("expecting 2 reported errors, got: %v", reported)
+	}
+}
+
+func TestUpgradeFailureReported(t *testing.T) {
+	b := newEchoBackend(t)
+	var reported []error
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.BackendErrorStatus = http.StatusBadGateway
+	proxy.OnProxyError = func(req *http.Request, err error) { reported = append(reported, err) }
+
+	// The recorder cannot be hijacked, so the backend is reached but the
+	// client upgrade fails.
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, newHandshakeRequest("/"))
+	if rw.Code == http.StatusBadGateway {
+		t.Error("expecting an upgrade failure not to answer BackendErrorStatus")
+	}
+	if len(reported) != 1 || !strings.Contains(reported[0].Error(), "Hijacker") {
+		t.Errorf("expecting the upgrade failure to be reported, got: %v", reported)
+	}
+}
@@ -0,0 +1,207 @@
+package websocketproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// serveFanOut connects the client of req to every backend of FanOutBackends,
+// whose URLs are joined with the request path as with AddBackend. The
+// subprotocol and compression are the ones negotiated by the first backend
+// connected, which is also the one reported by ActiveConnections.
+func (w *WebsocketProxy) serveFanOut(rw http.ResponseWriter, req *http.Request, upgrader *websocket.Upgrader) {
+	var conns []*websocket.Conn
+	var urls []*url.URL
+	var upgradeHeader http.Header
+	closeAll := func(code int, text string) {
+		msg := websocket.FormatCloseMessage(code, text)
+		for _, conn := range conns {
+			conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeWriteTimeout))
+			conn.Close()
+		}
+	}
+
+	for _, target := range w.FanOutBackends {
+		backendURL := w.getRequestURL(target)(req)
+		pc, header, err := w.dialBackend(req, -1, nil, backendURL)
+		if err != nil {
+			if req.Context().Err() != nil {
+				closeAll(websocket.CloseGoingAway, "client went away")
+				return
+			}
+			w.requestLogger(req).Errorf("websocketproxy: fan-out server(%s) not available: %v", backendURL.Host, err)
+			continue
+		}
+		if upgradeHeader == nil {
+			upgradeHeader = header
+			upgrader.EnableCompression = upgrader.EnableCompression && pc.deflate
+		}
+		conns = append(conns, pc.backend)
+		urls = append(urls, backendURL)
+	}
+	if len(conns) == 0 {
+		w.requestLogger(req).Errorf("websocketproxy: %v", errNoBackend)
+		w.proxyError(req, errNoBackend)
+		w.backendError(rw, req, errNoBackend)
+		return
+	}
+
+	if protocol := conns[0].Subprotocol(); protocol != "" {
+		if !acceptsSubprotocol(req, upgrader, protocol) {
+			w.requestLogger(req).Errorf("websocketproxy: %v: %q", errSubprotocol, protocol)
+			w.proxyError(req, errSubprotocol)
+			closeAll(websocket.CloseProtocolError, "subprotocol not accepted")
+			w.httpError(rw, req, errSubprotocol, http.StatusBadGateway, "bad gateway")
+			return
+		}
+		upgradeHeader.Set(headerProtocol, protocol)
+	}
+	upgrader.Subprotocols = nil
+
+	client, err := upgrader.Upgrade(rw, req, upgradeHeader)
+	if err != nil {
+		w.requestLogger(req).Errorf("websocketproxy: couldn't upgrade %s", err)
+		w.proxyError(req, err)
+		closeAll(websocket.CloseGoingAway, "client handshake failed")
+		return
+	}
+	defer client.Close()
+
+	pc := &proxyConn{client: client, backend: conns[0], fanOut: conns[1:], backendURL: urls[0], start: time.Now()}
+	if !w.trackConn(pc) {
+		code, text := w.shutdownClose()
+		client.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(code, text),
+			time.Now().Add(closeWriteTimeout))
+		closeAll(code, text)
+		return
+	}
+	defer w.untrackConn(pc)
+
+	metrics := w.metrics()
+	metrics.IncActiveConns(pc.backendURL.Host)
+	defer func(start time.Time) {
+		metrics.DecActiveConns(pc.backendURL.Host)
+		metrics.ObserveConnDuration(pc.backendURL.Host, time.Since(start))
+	}(time.Now())
+
+	if w.MaxMessageSize > 0 {
+		client.SetReadLimit(w.MaxMessageSize)
+		for _, conn := range conns {
+			conn.SetReadLimit(w.MaxMessageSize)
+		}
+	}
+	if w.IdleTimeout > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		pc.keepAlive(w.IdleTimeout, done)
+	}
+	defer w.armTimers(req, pc)()
+
+	// Backend messages are merged into the client connection, whose writes
+	// must not overlap. The last backend to leave closes the client, which
+	// ends the broadcast below, and leaves its error in backendErr unless
+	// the client left first.
+	var clientMu sync.Mutex
+	var backendErr error
+	clientLeft := false
+	var wg sync.WaitGroup
+	live := int32(len(conns))
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(conn *websocket.Conn, backendURL *url.URL) {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					w.connPanic(req, pc, fmt.Sprintf("copying from fan-out server(%s) to client", backendURL.Host), r)
+				}
+			}()
+			for {
+				msgType, msg, err := conn.ReadMessage()
+				if err != nil {
+					w.requestLogger(req).Debugf("websocketproxy: fan-out server(%s) left: %v", backendURL.Host, err)
+					conn.Close()
+					if atomic.AddInt32(&live, -1) == 0 {
+						clientMu.Lock()
+						if !clientLeft {
+							backendErr = err
+						}
+						clientMu.Unlock()
+						client.WriteControl(websocket.CloseMessage, survivorCloseMessage(err), time.Now().Add(closeWriteTimeout))
+						client.Close()
+					}
+					return
+				}
+				if w.IdleTimeout > 0 {
+					conn.SetReadDeadline(time.Now().Add(w.IdleTimeout))
+				}
+				clientMu.Lock()
+				if w.WriteTimeout > 0 {
+					client.SetWriteDeadline(time.Now().Add(w.WriteTimeout))
+				}
+				err = client.WriteMessage(msgType, msg)
+				clientMu.Unlock()
+				if err != nil {
+					// The client is gone, the broadcast closes the backends.
+					return
+				}
+				atomic.AddInt64(&pc.fromBackend, int64(len(msg)))
+			}
+		}(conn, urls[i])
+	}
+
+	// Broadcast the client messages to the backends still there. A backend
+	// failing a write is closed, which ends its reader above.
+	for {
+		var msgType int
+		var msg []byte
+		msgType, msg, err = client.ReadMessage()
+		if err != nil {
+			break
+		}
+		if w.IdleTimeout > 0 {
+			client.SetReadDeadline(time.Now().Add(w.IdleTimeout))
+		}
+		for i, conn := range conns {
+			if w.WriteTimeout > 0 {
+				conn.SetWriteDeadline(time.Now().Add(w.WriteTimeout))
+			}
+			if werr := conn.WriteMessage(msgType, msg); werr != nil {
+				w.requestLogger(req).Debugf("websocketproxy: error when copying to fan-out server(%s): %v", urls[i].Host, werr)
+				conn.Close()
+			}
+		}
+		atomic.AddInt64(&pc.fromClient, int64(len(msg)))
+	}
+	w.requestLogger(req).Debugf("websocketproxy: fan-out client(%s) left: %v", req.RemoteAddr, err)
+	clientMu.Lock()
+	clientLeft = backendErr == nil
+	clientMu.Unlock()
+
+	msg := survivorCloseMessage(err)
+	for _, conn := range conns {
+		conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeWriteTimeout))
+		conn.Close()
+	}
+	wg.Wait()
+
+	if w.OnConnClose != nil {
+		stats := pc.stats()
+		stats.RequestID = RequestID(req)
+		stats.ClosedBy, stats.Err = ClientSide, err
+		clientMu.Lock()
+		if pc.isClosed() {
+			stats.ClosedBy = ProxySide
+		} else if backendErr != nil {
+			stats.ClosedBy, stats.Err = BackendSide, backendErr
+		}
+		clientMu.Unlock()
+		w.OnConnClose(stats)
+	}
+}
@@ -0,0 +1,237 @@
+package websocketproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fanOutBackend records the messages it receives and answers each one with
+// its name, except "bye <name>" on which it drops the connection.
+type fanOutBackend struct {
+	url      *url.URL
+	received chan string
+	server   *httptest.Server
+}
+
+func newFanOutBackend(t *testing.T, name string) *fanOutBackend {
+	b := &fanOutBackend{received: make(chan string, 10)}
+	upgrader := websocket.Upgrader{}
+	b.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, p, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			b.received <- string(p)
+			if string(p) == "bye "+name {
+				return
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(name)); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(b.server.Close)
+	b.url, _ = url.Parse("ws" + strings.TrimPrefix(b.server.URL, "http"))
+	return b
+}
+
+func TestFanOut(t *testing.T) {
+	b1 := newFanOutBackend(t, "one")
+	b2 := newFanOutBackend(t, "two")
+
+	proxy := NewProxy()
+	proxy.FanOutBackends = []*url.URL{b1.url, b2.url, closedURL(t)}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []*fanOutBackend{b1, b2} {
+		select {
+		case msg := <-b.received:
+			if msg != "hello" {
+				t.Errorf("expecting hello on every backend, got: %q", msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expecting the message to reach every backend")
+		}
+	}
+	replies := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		_, p, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		replies[string(p)] = true
+	}
+	if !replies["one"] || !replies["two"] {
+		t.Errorf("expecting the replies of both backends, got: %v", replies)
+	}
+
+	// The others carry on when one backend dies.
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("bye one")); err != nil {
+		t.Fatal(err)
+	}
+	if _, p, err := conn.ReadMessage(); err != nil || string(p) != "two" {
+		t.Fatalf("expecting the reply of the surviving backend, got: %q, %v", p, err)
+	}
+	<-b1.received
+	<-b2.received
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	if _, p, err := conn.ReadMessage(); err != nil || string(p) != "two" {
+		t.Errorf("expecting the reply of the surviving backend, got: %q, %v", p, err)
+	}
+	select {
+	case msg := <-b1.received:
+		t.Errorf("expecting nothing sent to the dead backend, got: %q", msg)
+	case <-b2.received:
+	}
+
+	// The client is closed once the last backend is gone.
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("bye two")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("expecting going away close, got: %v", err)
+	}
+}
+
+func TestFanOutNoBackend(t *testing.T) {
+	proxy := NewProxy()
+	proxy.FanOutBackends = []*url.URL{closedURL(t)}
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, newHandshakeRequest("/"))
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("expecting status %d, got: %d", http.StatusServiceUnavailable, rw.Code)
+	}
+}
+
+func TestFanOutConnLifecycle(t *testing.T) {
+	b1 := newFanOutBackend(t, "one")
+	b2 := newFanOutBackend(t, "two")
+	metrics := newRecordingMetrics()
+	closed := make(chan ConnStats, 1)
+
+	proxy := NewProxy()
+	proxy.FanOutBackends = []*url.URL{b1.url, b2.url}
+	proxy.MaxConnLifetime = 100 * time.Millisecond
+	proxy.Metrics = metrics
+	proxy.OnConnClose = func(stats ConnStats) { closed <- stats }
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	start := time.Now()
+	conn := dialProxy(t, s)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("expecting close 1001 at the end of the lifetime, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("connection closed too early, after %v", elapsed)
+	}
+
+	select {
+	case stats := <-closed:
+		if stats.ClosedBy != ProxySide {
+			t.Errorf("expecting the proxy to have closed the connection, got: %s", stats.ClosedBy)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expecting OnConnClose to be called")
+	}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	if n := metrics.active[b1.url.Host]; n != 0 {
+		t.Errorf("expecting no active connection left, got: %d", n)
+	}
+	if n := metrics.durations[b1.url.Host]; n != 1 {
+		t.Errorf("expecting one connection duration observed, got: %d", n)
+	}
+}
+
+func TestFanOutConnDeadline(t *testing.T) {
+	b1 := newFanOutBackend(t, "one")
+	b2 := newFanOutBackend(t, "two")
+
+	proxy := NewProxy()
+	proxy.FanOutBackends = []*url.URL{b1.url, b2.url}
+	deadline := time.Now().Add(100 * time.Millisecond)
+	proxy.ConnDeadline = func(*http.Request) time.Time { return deadline }
+	proxy.ConnDeadlineCloseCode = 4001
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, 4001) {
+		t.Fatalf("expecting close 4001 at the deadline, got: %v", err)
+	}
+	if early := time.Until(deadline); early > 10*time.Millisecond {
+		t.Errorf("connection closed %v before its deadline", early)
+	}
+}
+
+// panickingLogger panics when a fan-out backend leaves.
+type panickingLogger struct {
+	recordingLogger
+}
+
+func (l *panickingLogger) Debugf(format string, v ...interface{}) {
+	if strings.Contains(format, "fan-out server(%s) left") {
+		panic("bad logger")
+	}
+	l.recordingLogger.Debugf(format, v...)
+}
+
+func TestFanOutReaderPanic(t *testing.T) {
+	b1 := newFanOutBackend(t, "one")
+	b2 := newFanOutBackend(t, "two")
+
+	logger := &panickingLogger{}
+	proxy := NewProxy()
+	proxy.FanOutBackends = []*url.URL{b1.url, b2.url}
+	proxy.Logger = logger
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("bye one")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, websocket.CloseInternalServerErr) {
+			t.Fatalf("expecting close 1011 after the panic, got: %v", err)
+		}
+		break
+	}
+	if !logger.logged(logger.errors, "panic copying from fan-out server") {
+		t.Error("expecting the panic to be logged")
+	}
+}
@@ -0,0 +1,320 @@
+package websocketproxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// ForwardedHeaderMode selects the headers describing the client that are
+// added to backend requests.
+type ForwardedHeaderMode int
+
+const (
+	// ForwardedXForwarded sets X-Forwarded-For and X-Forwarded-Proto. This
+	// is the default.
+	ForwardedXForwarded ForwardedHeaderMode = iota
+
+	// ForwardedOff adds no header about the client.
+	ForwardedOff
+
+	// ForwardedRFC7239 appends an element with the for, host and proto
+	// parameters to the Forwarded header defined by RFC 7239.
+	ForwardedRFC7239
+
+	// ForwardedBoth sets both the X-Forwarded-* and Forwarded headers.
+	ForwardedBoth
+)
+
+// The WebSocket handshake headers in their canonical form, as returned by
+// http.CanonicalHeaderKey. net/http canonicalizes the header keys of the
+// requests and responses it parses, whatever casing the peer sent, so
+// header maps must be indexed with these rather than the RFC 6455 spelling
+// such as Sec-WebSocket-Protocol.
+const (
+	headerKey        = "Sec-Websocket-Key"
+	headerAccept     = "Sec-Websocket-Accept"
+	headerVersion    = "Sec-Websocket-Version"
+	headerExtensions = "Sec-Websocket-Extensions"
+	headerProtocol   = "Sec-Websocket-Protocol"
+)
+
+// handshakeHeaders are set by the dialer and the upgrader for each
+// handshake and must not be copied from one leg to the other.
+var handshakeHeaders = map[string]bool{
+	"Upgrade":        true,
+	"Connection":     true,
+	headerKey:        true,
+	headerAccept:     true,
+	headerVersion:    true,
+	headerExtensions: true,
+	headerProtocol:   true,
+}
+
+// forwardedHeaders are passed through untouched when TrustForwardedHeaders
+// is set.
+var forwardedHeaders = []string{
+	"X-Forwarded-For",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Host",
+	"Forwarded",
+}
+
+// credentialHeaders are dropped from the backend handshake when the backend
+// redirects it to another host, as net/http does when following redirects.
+var credentialHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Proxy-Authorization",
+}
+
+// requestHeader builds the headers sent with the backend handshake for req.
+func (w *WebsocketProxy) requestHeader(req *http.Request) http.Header {
+	// Pass headers from the incoming request to the dialer to forward them to
+	// the final destinations.
+	requestHeader := http.Header{}
+	if origin := req.Header.Get("Origin"); origin != "" {
+		requestHeader.Add("Origin", origin)
+	}
+	for _, cookie := range req.Header[http.CanonicalHeaderKey("Cookie")] {
+		requestHeader.Add("Cookie", cookie)
+	}
+
+	if w.TrustForwardedHeaders {
+		for _, name := range forwardedHeaders {
+			if values, ok := req.Header[name]; ok {
+				requestHeader[name] = append([]string(nil), values...)
+			}
+		}
+	} else {
+		if w.ForwardedHeaderMode == ForwardedXForwarded || w.ForwardedHeaderMode == ForwardedBoth {
+			w.setXForwarded(req, requestHeader)
+		}
+		if w.ForwardedHeaderMode == ForwardedRFC7239 || w.ForwardedHeaderMode == ForwardedBoth {
+			setForwarded(req, requestHeader)
+		}
+	}
+
+	if id := RequestID(req); id != "" {
+		requestHeader.Set(w.requestIDHeader(), id)
+	}
+
+	// Copy the headers the user asked for, then drop the stripped ones.
+	for _, name := range w.ForwardHeaders {
+		name = http.CanonicalHeaderKey(name)
+		if handshakeHeaders[name] {
+			continue
+		}
+		if values, ok := req.Header[name]; ok {
+			requestHeader[name] = append([]string(nil), values...)
+		}
+	}
+	for _, name := range w.StripHeaders {
+		requestHeader.Del(name)
+	}
+
+	// Enable the director to copy any additional headers it desires for
+	// forwarding to the remote server.
+	if w.Director != nil {
+		w.Director(req, requestHeader)
+	}
+
+	return requestHeader
+}
+
+// upgradeHeader builds the headers passed to the client's handshake response
+// from the backend's handshake response.
+func (w *WebsocketProxy) upgradeHeader(resp *http.Response) http.Header {
+	upgradeHeader := http.Header{}
+	// Keep every cookie, Get would only return the first one.
+	for _, cookie := range resp.Header["Set-Cookie"] {
+		upgradeHeader.Add("Set-Cookie", cookie)
+	}
+	for _, name := range w.ForwardResponseHeaders {
+		name = http.CanonicalHeaderKey(name)
+		if handshakeHeaders[name] {
+			continue
+		}
+		if values, ok := resp.Header[name]; ok {
+			upgradeHeader[name] = append([]string(nil), values...)
+		}
+	}
+	return upgradeHeader
+}
+
+// subprotocols returns the subprotocols requested by req. Unlike
+// websocket.Subprotocols, it reads every Sec-WebSocket-Protocol header line.
+func subprotocols(req *http.Request) []string {
+	var protocols []string
+	for _, line := range req.Header[headerProtocol] {
+		for _, p := range strings.Split(line, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				protocols = append(protocols, p)
+			}
+		}
+	}
+	return protocols
+}
+
+// containsProtocol reports whether protocols contains protocol.
+func containsProtocol(protocols []string, protocol string) bool {
+	for _, p := range protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// offersDeflate reports whether h, the headers of a handshake request or
+// response, lists the permessage-deflate extension, the only one the
+// dialer and the upgrader implement.
+func offersDeflate(h http.Header) bool {
+	for _, line := range h[headerExtensions] {
+		for _, ext := range strings.Split(line, ",") {
+			if i := strings.IndexByte(ext, ';'); i >= 0 {
+				ext = ext[:i]
+			}
+			if strings.EqualFold(strings.TrimSpace(ext), "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// acceptsSubprotocol reports whether protocol, selected by a backend, was
+// offered by the client of req and is supported by upgrader, if it lists
+// any.
+func acceptsSubprotocol(req *http.Request, upgrader *websocket.Upgrader, protocol string) bool {
+	if !containsProtocol(subprotocols(req), protocol) {
+		return false
+	}
+	return len(upgrader.Subprotocols) == 0 || containsProtocol(upgrader.Subprotocols, protocol)
+}
+
+// hostname returns host without its port, if any, and without the brackets
+// of an IPv6 address.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// clientIP returns the address identifying the client of req. It is taken
+// from the first X-Forwarded-For entry only with TrustForwardedHeaders, since
+// clients can otherwise set any value, and from the remote address, as
+// corrected by WrapListener, by default.
+func (w *WebsocketProxy) clientIP(req *http.Request) string {
+	if w.TrustForwardedHeaders {
+		if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
+			return strings.TrimSpace(strings.Split(prior, ",")[0])
+		}
+	}
+	if ip, ok := remoteIP(req.RemoteAddr); ok {
+		return ip
+	}
+	return req.RemoteAddr
+}
+
+// remoteIP returns the IP address of remoteAddr, a host:port pair, in its
+// canonical form without brackets or IPv6 zone, as X-Forwarded-For expects.
+func remoteIP(remoteAddr string) (string, bool) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return "", false
+	}
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), true
+	}
+	return host, true
+}
+
+// setXForwarded sets the X-Forwarded-For and X-Forwarded-Proto headers of
+// the backend request for req.
+func (w *WebsocketProxy) setXForwarded(req *http.Request, requestHeader http.Header) {
+	// Pass X-Forwarded-For headers too, code below is a part of
+	// httputil.ReverseProxy. See http://en.wikipedia.org/wiki/X-Forwarded-For
+	// for more information
+	if clientIP, ok := remoteIP(req.RemoteAddr); ok {
+		// If we aren't the first proxy retain prior
+		// X-Forwarded-For information as a comma+space
+		// separated list and fold multiple headers into one.
+		if prior, ok := req.Header["X-Forwarded-For"]; ok {
+			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		requestHeader.Set("X-Forwarded-For", clientIP)
+	}
+
+	// Set the originating protocol of the incoming HTTP request. The SSL might
+	// be terminated on our site and because we doing proxy adding this would
+	// be helpful for applications on the backend.
+	requestHeader.Set("X-Forwarded-Proto", requestProto(req))
+}
+
+// setForwarded appends an RFC 7239 element describing req to the Forwarded
+// header of the backend request, after the ones of prior proxies.
+func setForwarded(req *http.Request, requestHeader http.Header) {
+	var params []string
+	if ip, ok := remoteIP(req.RemoteAddr); ok {
+		// IPv6 addresses are bracketed and, containing colons, quoted.
+		if strings.Contains(ip, ":") {
+			ip = `"[` + ip + `]"`
+		}
+		params = append(params, "for="+ip)
+	}
+	if req.Host != "" {
+		params = append(params, "host="+forwardedValue(req.Host))
+	}
+	params = append(params, "proto="+requestProto(req))
+
+	element := strings.Join(params, ";")
+	if prior, ok := req.Header["Forwarded"]; ok {
+		element = strings.Join(prior, ", ") + ", " + element
+	}
+	requestHeader.Set("Forwarded", element)
+}
+
+// forwardedValue returns v as an RFC 7239 value, an RFC 7230 quoted-string
+// unless it is a token. Only '"' and '\' are escaped, other bytes are kept
+// as they are.
+func forwardedValue(v string) string {
+	for _, c := range v {
+		if !isTokenChar(c) {
+			var sb strings.Builder
+			sb.WriteByte('"')
+			for i := 0; i < len(v); i++ {
+				if v[i] == '"' || v[i] == '\\' {
+					sb.WriteByte('\\')
+				}
+				sb.WriteByte(v[i])
+			}
+			sb.WriteByte('"')
+			return sb.String()
+		}
+	}
+	return v
+}
+
+// isTokenChar reports whether c may appear in an RFC 7230 token.
+func isTokenChar(c rune) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
+
+// requestProto returns the protocol the client used to reach the proxy.
+func requestProto(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,391 @@
+package websocketproxy
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// newHeaderBackend returns a backend that accepts every handshake and sends
+// the request headers it received to the returned channel.
+func newHeaderBackend(t *testing.T) (*url.URL, <-chan http.Header) {
+	headers := make(chan http.Header, 16)
+	upgrader := websocket.Upgrader{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	t.Cleanup(s.Close)
+	u, _ := url.Parse("ws" + strings.TrimPrefix(s.URL, "http"))
+	return u, headers
+}
+
+func TestForwardAndStripHeaders(t *testing.T) {
+	u, headers := newHeaderBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(u)
+	proxy.ForwardHeaders = []string{"authorization", "X-Tenant", "Sec-WebSocket-Key"}
+	proxy.StripHeaders = []string{"Cookie", "X-Tenant"}
+	proxy.Director = func(incoming *http.Request, out http.Header) {
+		out.Set("X-Tenant", "director")
+	}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	h := http.Header{}
+	h.Set("Authorization", "Bearer token")
+	h.Set("X-Tenant", "client")
+	h.Set("X-Other", "dropped")
+	h.Set("Cookie", "session=1")
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	got := <-headers
+	if v := got.Get("Authorization"); v != "Bearer token" {
+		t.Errorf("expecting Authorization to be forwarded, got: %q", v)
+	}
+	if v := got.Get("X-Other"); v != "" {
+		t.Errorf("expecting X-Other not to be forwarded, got: %q", v)
+	}
+	if v := got.Get("Cookie"); v != "" {
+		t.Errorf("expecting Cookie to be stripped, got: %q", v)
+	}
+	if v := got.Get("X-Tenant"); v != "director" {
+		t.Errorf("expecting Director to win over StripHeaders, got: %q", v)
+	}
+}
+
+func TestForwardResponseHeaders(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := http.Header{}
+		h.Set("X-Session-Id", "abc")
+		h.Set("X-Internal", "secret")
+		h.Add("Set-Cookie", "a=1")
+		h.Add("Set-Cookie", "b=2")
+		conn, err := upgrader.Upgrade(w, r, h)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	defer backend.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(backend.URL, "http"))
+
+	proxy := NewProxy()
+	proxy.AddBackend(u)
+	proxy.ForwardResponseHeaders = []string{"x-session-id"}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if v := resp.Header.Get("X-Session-Id"); v != "abc" {
+		t.Errorf("expecting X-Session-Id to be forwarded, got: %q", v)
+	}
+	if v := resp.Header.Get("X-Internal"); v != "" {
+		t.Errorf("expecting X-Internal not to be forwarded, got: %q", v)
+	}
+	if cookies := resp.Header["Set-Cookie"]; len(cookies) != 2 {
+		t.Errorf("expecting both cookies, got: %v", cookies)
+	}
+}
+
+func TestSubprotocolNegotiation(t *testing.T) {
+	upgrader := websocket.Upgrader{Subprotocols: []string{"b-proto", "a-proto"}}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	defer backend.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(backend.URL, "http"))
+
+	proxy := NewProxy()
+	proxy.AddBackend(u)
+	// The proxy's own preference must not override the backend's choice.
+	proxy.Upgrader = &websocket.Upgrader{Subprotocols: []string{"a-proto", "b-proto"}}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{"a-proto", "b-proto"}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.Subprotocol(); got != "b-proto" {
+		t.Errorf("expecting the subprotocol selected by the backend, got: %q", got)
+	}
+}
+
+func TestXForwardedFor(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		prior      []string
+		want       string
+	}{
+		{"192.0.2.1:1234", nil, "192.0.2.1"},
+		{"[2001:db8::1]:1234", nil, "2001:db8::1"},
+		{"[2001:0db8:0000::0001]:1234", nil, "2001:db8::1"},
+		{"[fe80::1%eth0]:1234", nil, "fe80::1"},
+		{"[::ffff:192.0.2.1]:1234", nil, "192.0.2.1"},
+		{"192.0.2.1:1234", []string{"203.0.113.7"}, "203.0.113.7, 192.0.2.1"},
+		{"[2001:db8::1]:1234", []string{"203.0.113.7, 2001:db8::2", "198.51.100.3"}, "203.0.113.7, 2001:db8::2, 198.51.100.3, 2001:db8::1"},
+	}
+	proxy := NewProxy()
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		for _, v := range tt.prior {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+		if got := proxy.requestHeader(req).Get("X-Forwarded-For"); got != tt.want {
+			t.Errorf("remote %s, prior %q: expecting %q, got: %q", tt.remoteAddr, tt.prior, tt.want, got)
+		}
+	}
+}
+
+func TestForwardedValue(t *testing.T) {
+	tests := []struct{ v, want string }{
+		{"192.0.2.1", "192.0.2.1"},
+		{"[2001:db8::1]", `"[2001:db8::1]"`},
+		{"café.example", "\"café.example\""},
+		{"a\x7fb", "\"a\x7fb\""},
+		{`say "hi" \o/`, `"say \"hi\" \\o/"`},
+	}
+	for _, tt := range tests {
+		if got := forwardedValue(tt.v); got != tt.want {
+			t.Errorf("%q: expecting %s, got: %s", tt.v, tt.want, got)
+		}
+	}
+}
+
+func TestForwardedHeaderMode(t *testing.T) {
+	tests := []struct {
+		mode       ForwardedHeaderMode
+		remoteAddr string
+		prior      string
+		forwarded  string
+		xff        bool
+	}{
+		{ForwardedXForwarded, "192.0.2.1:1234", "", "", true},
+		{ForwardedOff, "192.0.2.1:1234", "", "", false},
+		{ForwardedRFC7239, "192.0.2.1:1234", "", `for=192.0.2.1;host="proxy.example.com:8080";proto=http`, false},
+		{ForwardedRFC7239, "[2001:db8::1]:1234", "", `for="[2001:db8::1]";host="proxy.example.com:8080";proto=http`, false},
+		{ForwardedBoth, "192.0.2.1:1234", "for=203.0.113.7;proto=https", `for=203.0.113.7;proto=https, for=192.0.2.1;host="proxy.example.com:8080";proto=http`, true},
+	}
+	for _, tt := range tests {
+		proxy := NewProxy()
+		proxy.ForwardedHeaderMode = tt.mode
+		req := httptest.NewRequest("GET", "http://proxy.example.com:8080/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.prior != "" {
+			req.Header.Set("Forwarded", tt.prior)
+		}
+
+		h := proxy.requestHeader(req)
+		if got := h.Get("Forwarded"); got != tt.forwarded {
+			t.Errorf("mode %d, remote %s: expecting Forwarded %q, got: %q", tt.mode, tt.remoteAddr, tt.forwarded, got)
+		}
+		if got := h.Get("X-Forwarded-For") != "" && h.Get("X-Forwarded-Proto") != ""; got != tt.xff {
+			t.Errorf("mode %d: expecting X-Forwarded-* %v, got: %v", tt.mode, tt.xff, got)
+		}
+	}
+}
+
+func TestTrustForwardedHeaders(t *testing.T) {
+	for _, trust := range []bool{false, true} {
+		proxy := NewProxy()
+		proxy.TrustForwardedHeaders = trust
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", "chat.example.com")
+
+		h := proxy.requestHeader(req)
+		xff, proto, host := "203.0.113.7, 192.0.2.1", "http", ""
+		if trust {
+			xff, proto, host = "203.0.113.7", "https", "chat.example.com"
+		}
+		if got := h.Get("X-Forwarded-For"); got != xff {
+			t.Errorf("trust %v: expecting X-Forwarded-For %q, got: %q", trust, xff, got)
+		}
+		if got := h.Get("X-Forwarded-Proto"); got != proto {
+			t.Errorf("trust %v: expecting X-Forwarded-Proto %q, got: %q", trust, proto, got)
+		}
+		if got := h.Get("X-Forwarded-Host"); got != host {
+			t.Errorf("trust %v: expecting X-Forwarded-Host %q, got: %q", trust, host, got)
+		}
+	}
+}
+
+func TestSubprotocolHeaderLines(t *testing.T) {
+	upgrader := websocket.Upgrader{Subprotocols: []string{"c-proto"}}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	defer backend.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(backend.URL, "http"))
+
+	proxy := NewProxy()
+	proxy.AddBackend(u)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	// Every header line counts, not only the first one.
+	h := http.Header{"Sec-Websocket-Protocol": {"a-proto", "b-proto, c-proto"}}
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.Subprotocol(); got != "c-proto" {
+		t.Errorf("expecting the protocol of the second header line, got: %q", got)
+	}
+	if got := resp.Header["Sec-Websocket-Protocol"]; len(got) != 1 {
+		t.Errorf("expecting a single selected protocol, got: %q", got)
+	}
+}
+
+func TestSubprotocolMismatch(t *testing.T) {
+	// The backend answers with a subprotocol whatever the client offered.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var upgrader websocket.Upgrader
+		conn, err := upgrader.Upgrade(w, r, http.Header{"Sec-Websocket-Protocol": {"b-proto"}})
+		if err != nil {
+			return
+		}
+		conn.ReadMessage()
+		conn.Close()
+	}))
+	defer backend.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(backend.URL, "http"))
+
+	proxy := NewProxy()
+	proxy.AddBackend(u)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	dialer := websocket.Dialer{Subprotocols: []string{"a-proto"}}
+	_, resp, err := dialer.Dial(proxyURL, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expecting 502 for a subprotocol the client did not offer, got: %v", err)
+	}
+
+	// Offered by the client but not supported by Upgrader.
+	proxy.Upgrader = &websocket.Upgrader{Subprotocols: []string{"a-proto"}}
+	dialer.Subprotocols = []string{"a-proto", "b-proto"}
+	_, resp, err = dialer.Dial(proxyURL, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expecting 502 for a subprotocol Upgrader does not support, got: %v", err)
+	}
+
+	proxy.Upgrader = &websocket.Upgrader{Subprotocols: []string{"a-proto", "b-proto"}}
+	conn, _, err := dialer.Dial(proxyURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.Subprotocol(); got != "b-proto" {
+		t.Errorf("expecting the subprotocol selected by the backend, got: %q", got)
+	}
+}
+
+func TestHandshakeHeaderCasing(t *testing.T) {
+	// The backend answers the handshake by hand with unusual header casing,
+	// which is valid since header names are case-insensitive.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := sha1.New()
+		h.Write([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+		accept := base64.StdEncoding.EncodeToString(h.Sum(nil))
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+			"upgrade: websocket\r\n" +
+			"CONNECTION: Upgrade\r\n" +
+			"sec-websocket-accept: " + accept + "\r\n" +
+			"SEC-WEBSOCKET-PROTOCOL: b-proto\r\n\r\n")
+		rw.Flush()
+		io.Copy(io.Discard, rw)
+	}))
+	defer backend.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(backend.URL, "http"))
+
+	proxy := NewProxy()
+	proxy.AddBackend(u)
+	proxy.Upgrader = &websocket.Upgrader{Subprotocols: []string{"a-proto", "b-proto"}}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{"a-proto", "b-proto"}}
+	conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.Subprotocol(); got != "b-proto" {
+		t.Errorf("expecting the subprotocol selected by the backend, got: %q", got)
+	}
+	if got := resp.Header[headerProtocol]; len(got) != 1 || got[0] != "b-proto" {
+		t.Errorf("expecting a single canonical subprotocol header, got: %q", got)
+	}
+}
+
+func TestBackendHeaders(t *testing.T) {
+	u1, headers1 := newHeaderBackend(t)
+	u2, headers2 := newHeaderBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackendWithHeaders(u1, http.Header{"X-Api-Key": {"key-1"}})
+	proxy.AddBackendWithHeaders(u2, http.Header{"x-api-key": {"key-2"}, "Upgrade": {"nope"}})
+	proxy.Director = func(incoming *http.Request, out http.Header) {
+		out.Set("X-Api-Key", "director")
+		out.Set("X-Tenant", "director")
+	}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	for i := 0; i < 2; i++ {
+		conn := dialProxy(t, s)
+		conn.Close()
+	}
+	for i, h := range []http.Header{<-headers1, <-headers2} {
+		want := "key-" + strconv.Itoa(i+1)
+		if got := h.Get("X-Api-Key"); got != want {
+			t.Errorf("backend %d: expecting its own X-Api-Key %q, got: %q", i, want, got)
+		}
+		if got := h.Get("X-Tenant"); got != "director" {
+			t.Errorf("backend %d: expecting the Director headers to be kept, got: %q", i, got)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package websocketproxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultHealthCheckInterval is used by StartHealthCheck when interval is
+// not positive.
+const DefaultHealthCheckInterval = 10 * time.Second
+
+// StartHealthCheck starts checking every backend each interval by completing
+// a WebSocket handshake with it and closing the connection right away.
+// Backends failing the check are not selected until a later check succeeds.
+// The first round of checks runs before StartHealthCheck returns, so a
+// backend that is down at startup never receives a client. An interval that
+// is not positive is replaced with DefaultHealthCheckInterval. Calling it
+// again restarts the checker with the new interval. Once Shutdown was
+// called it does nothing.
+func (w *WebsocketProxy) StartHealthCheck(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultHealthCheckInterval
+	}
+	if w.isShuttingDown() {
+		return
+	}
+	w.StopHealthCheck()
+
+	w.checkBackends(context.Background())
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	if !w.startBackground(&w.healthStop, &w.healthDone, stop, done) {
+		return
+	}
+
+	// Stopping the checker also aborts the checks in flight, so that
+	// StopHealthCheck and Shutdown do not wait for a slow backend.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+	go func() {
+		defer w.background.Done()
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				w.checkBackends(ctx)
+			}
+		}
+	}()
+}
+
+// StopHealthCheck stops the checker started by StartHealthCheck and waits
+// for it to exit. Every backend is considered healthy again afterwards.
+func (w *WebsocketProxy) StopHealthCheck() {
+	w.mu.Lock()
+	stop, done := w.healthStop, w.healthDone
+	w.healthStop, w.healthDone = nil, nil
+	w.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+
+	w.mu.Lock()
+	for _, b := range w.backends {
+		b.unhealthy = false
+	}
+	w.healthCheckDone()
+	w.mu.Unlock()
+}
+
+// WaitReady blocks until at least one backend added with a URL passes its
+// health check and is not draining, or ctx is done. It relies on the checker
+// started by StartHealthCheck, which must be called first, and returns an
+// error if the checker is not running or stops while waiting. Since
+// StartHealthCheck runs the first round of checks before returning,
+// WaitReady returns right away if a backend was up at startup, and
+// otherwise as soon as a later round finds one, for example:
+//
+//	proxy.StartHealthCheck(time.Second)
+//	if err := proxy.WaitReady(ctx); err != nil {
+//		log.Fatalln(err)
+//	}
+//	log.Fatalln(http.ListenAndServe(":8080", proxy))
+func (w *WebsocketProxy) WaitReady(ctx context.Context) error {
+	for {
+		w.mu.Lock()
+		if w.healthStop == nil {
+			w.mu.Unlock()
+			return errHealthCheckStopped
+		}
+		w.syncBackends()
+		for _, b := range w.backends {
+			if b.target != nil && !b.unhealthy && !b.draining {
+				w.mu.Unlock()
+				return nil
+			}
+		}
+		if w.healthChecked == nil {
+			w.healthChecked = make(chan struct{})
+		}
+		checked := w.healthChecked
+		w.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-checked:
+		}
+	}
+}
+
+// healthCheckDone wakes the callers of WaitReady. Callers must hold mu.
+func (w *WebsocketProxy) healthCheckDone() {
+	if w.healthChecked != nil {
+		close(w.healthChecked)
+		w.healthChecked = nil
+	}
+}
+
+// checkBackends runs one round of health checks concurrently. Checks
+// aborted because ctx is done leave the health of their backend alone.
+func (w *WebsocketProxy) checkBackends(ctx context.Context) {
+	w.mu.Lock()
+	w.syncBackends()
+	backends := make([]*backend, len(w.backends))
+	copy(backends, w.backends)
+	w.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, b := range backends {
+		// Backends appended to Backends directly have no fixed URL to check.
+		if b.target == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(b *backend) {
+			defer wg.Done()
+			err := w.checkBackend(ctx, b)
+			if ctx.Err() != nil {
+				return
+			}
+			healthy := err == nil
+
+			w.mu.Lock()
+			changed := b.unhealthy == healthy
+			b.unhealthy = !healthy
+			w.mu.Unlock()
+
+			if !changed {
+				return
+			}
+			if healthy {
+				w.logger().Debugf("websocketproxy: backend %s passed health check", b.target.Host)
+				if w.OnBackendUp != nil {
+					w.OnBackendUp(b.target)
+				}
+			} else {
+				w.logger().Errorf("websocketproxy: backend %s failed health check: %v", b.target.Host, err)
+				if w.OnBackendDown != nil {
+					w.OnBackendDown(b.target, err)
+				}
+			}
+		}(b)
+	}
+	wg.Wait()
+
+	w.mu.Lock()
+	w.healthCheckDone()
+	w.mu.Unlock()
+}
+
+// checkBackend completes a handshake with the URL of b, with the same
+// per-backend headers, Host and TLS settings as client handshakes, and
+// closes the connection.
+func (w *WebsocketProxy) checkBackend(ctx context.Context, b *backend) error {
+	dialer := w.dialer()
+	header := http.Header{}
+	w.applyBackendSettings(b, dialer, header)
+	aborted := abortOnDone(ctx, dialer)
+	conn, _, err := dialer.DialContext(ctx, b.target.String(), header)
+	if aborted() && err == nil {
+		conn.Close()
+		return ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
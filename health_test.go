@@ -0,0 +1,169 @@
+package websocketproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// toggleBackend is an echo backend that rejects handshakes while down. Only
+// proxied connections, recognized by their X-Forwarded-For header, are
+// counted in proxied.
+type toggleBackend struct {
+	url     *url.URL
+	down    int32
+	proxied int32
+}
+
+func newToggleBackend(t *testing.T, down bool) *toggleBackend {
+	b := &toggleBackend{}
+	if down {
+		b.down = 1
+	}
+	upgrader := websocket.Upgrader{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&b.down) == 1 {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("X-Forwarded-For") != "" {
+			atomic.AddInt32(&b.proxied, 1)
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	t.Cleanup(s.Close)
+	b.url, _ = url.Parse("ws" + strings.TrimPrefix(s.URL, "http"))
+	return b
+}
+
+func TestHealthCheck(t *testing.T) {
+	down := newToggleBackend(t, true)
+	up := newToggleBackend(t, false)
+
+	proxy := NewProxy()
+	proxy.AddBackend(down.url)
+	proxy.AddBackend(up.url)
+	proxy.StartHealthCheck(20 * time.Millisecond)
+	defer proxy.StopHealthCheck()
+
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	for i := 0; i < 10; i++ {
+		dialProxy(t, s).Close()
+	}
+	if n := atomic.LoadInt32(&down.proxied); n != 0 {
+		t.Errorf("expecting no connection on the unhealthy backend, got: %d", n)
+	}
+	if n := atomic.LoadInt32(&up.proxied); n != 10 {
+		t.Errorf("expecting 10 connections on the healthy backend, got: %d", n)
+	}
+
+	// Once the backend recovers, the checker puts it back in rotation.
+	atomic.StoreInt32(&down.down, 0)
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&down.proxied) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("recovered backend never received a connection")
+		}
+		dialProxy(t, s).Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHealthCheckBackendSettings(t *testing.T) {
+	// The backend requires its API key and its virtual host.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "secret" || r.Host != "chat.internal" {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	defer backend.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(backend.URL, "http"))
+
+	proxy := NewProxy()
+	proxy.AddBackendWithHeaders(u, http.Header{"X-Api-Key": {"secret"}})
+	proxy.SetBackendHost(u, "chat.internal")
+	proxy.StartHealthCheck(time.Hour)
+	defer proxy.StopHealthCheck()
+
+	if !proxy.BackendStatus()[0].Healthy {
+		t.Error("expecting the health check to send the backend's headers and host")
+	}
+}
+
+func TestHealthCheckZeroInterval(t *testing.T) {
+	down := newToggleBackend(t, true)
+	proxy := NewProxy()
+	proxy.AddBackend(down.url)
+	proxy.StartHealthCheck(0)
+	defer proxy.StopHealthCheck()
+
+	if proxy.BackendStatus()[0].Healthy {
+		t.Error("expecting the checker to run with the default interval")
+	}
+}
+
+func TestStopHealthCheck(t *testing.T) {
+	down := newToggleBackend(t, true)
+
+	proxy := NewProxy()
+	proxy.AddBackend(down.url)
+	proxy.StartHealthCheck(time.Hour)
+
+	if index, _ := proxy.selectBackend(nil); index != -1 {
+		t.Errorf("expecting no backend while unhealthy, got: %d", index)
+	}
+
+	proxy.StopHealthCheck()
+	if index, _ := proxy.selectBackend(nil); index != 0 {
+		t.Errorf("expecting backend to be selectable after stop, got: %d", index)
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	b := newToggleBackend(t, true)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+
+	if err := proxy.WaitReady(context.Background()); err == nil {
+		t.Error("expecting an error without a health checker")
+	}
+
+	proxy.StartHealthCheck(20 * time.Millisecond)
+	defer proxy.StopHealthCheck()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := proxy.WaitReady(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expecting the wait to time out while the backend is down, got: %v", err)
+	}
+
+	time.AfterFunc(100*time.Millisecond, func() { atomic.StoreInt32(&b.down, 0) })
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := proxy.WaitReady(ctx); err != nil {
+		t.Fatalf("expecting the backend to become ready, got: %v", err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("expecting WaitReady to block until the backend is up")
+	}
+}
@@ -0,0 +1,68 @@
+package websocketproxy
+
+import (
+	"math"
+	"net/url"
+	"time"
+)
+
+// DefaultLoadHalfLife is used when WebsocketProxy.LoadHalfLife is zero.
+const DefaultLoadHalfLife = 30 * time.Second
+
+// SetBackendLoad records score as the current load of the backend added with
+// a URL equal to target, for example its CPU usage as reported by an
+// external controller, and reports whether one was found. Lower scores are
+// preferred by the WeightedLoad strategy. A score not refreshed decays
+// towards zero with LoadHalfLife.
+func (w *WebsocketProxy) SetBackendLoad(target *url.URL, score float64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	index := w.findBackend(target)
+	if index < 0 {
+		return false
+	}
+	b := w.backends[index]
+	b.load = score
+	b.loadSet = time.Now()
+	return true
+}
+
+func (w *WebsocketProxy) loadHalfLife() time.Duration {
+	if w.LoadHalfLife <= 0 {
+		return DefaultLoadHalfLife
+	}
+	return w.LoadHalfLife
+}
+
+// currentLoad returns the load score of b decayed for the time elapsed
+// since it was set. Callers must hold mu.
+func (w *WebsocketProxy) currentLoad(b *backend, now time.Time) float64 {
+	if b.loadSet.IsZero() {
+		return 0
+	}
+	halfLives := float64(now.Sub(b.loadSet)) / float64(w.loadHalfLife())
+	return b.load * math.Pow(0.5, halfLives)
+}
+
+// weightedLoad picks the selectable backend speaking one of protocols with
+// the lowest load score, preferring the one with fewer open connections on
+// a tie. Callers must hold mu.
+func (w *WebsocketProxy) weightedLoad(protocols []string) int {
+	now := time.Now()
+	index, best := -1, 0.0
+	for i := range w.Backends {
+		b := w.backends[i]
+		if !w.selectable(i) || !b.speaks(protocols) {
+			continue
+		}
+		load := w.currentLoad(b, now)
+		if index < 0 || load < best || load == best && b.conns < w.backends[index].conns {
+			index, best = i, load
+		}
+	}
+	if index < 0 {
+		return w.randomBackend(protocols)
+	}
+	return index
+}
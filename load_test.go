@@ -0,0 +1,78 @@
+package websocketproxy
+
+import (
+	"math"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWeightedLoad(t *testing.T) {
+	proxy := NewProxy()
+	proxy.Strategy = WeightedLoad
+	var targets []*url.URL
+	for i := 0; i < 3; i++ {
+		u, _ := url.Parse("ws://10.0.0." + strconv.Itoa(i) + ":9000")
+		proxy.AddBackend(u)
+		targets = append(targets, u)
+	}
+
+	proxy.SetBackendLoad(targets[0], 0.9)
+	proxy.SetBackendLoad(targets[1], 0.2)
+	proxy.SetBackendLoad(targets[2], 0.5)
+	for i := 0; i < 3; i++ {
+		if index, _ := proxy.selectBackend(nil); index != 1 {
+			t.Fatalf("expecting the least loaded backend 1, got: %d", index)
+		}
+	}
+
+	proxy.SetBackendLoad(targets[1], 0.95)
+	if index, _ := proxy.selectBackend(nil); index != 2 {
+		t.Errorf("expecting backend 2 after the load of 1 rose, got: %d", index)
+	}
+
+	proxy.tripBackend(2, time.Hour)
+	if index, _ := proxy.selectBackend(nil); index != 0 {
+		t.Errorf("expecting backend 0 while 2 is open, got: %d", index)
+	}
+
+	u, _ := url.Parse("ws://10.0.0.9:9000")
+	if proxy.SetBackendLoad(u, 0) {
+		t.Error("expecting an unknown backend not to be found")
+	}
+}
+
+func TestWeightedLoadTie(t *testing.T) {
+	proxy := NewProxy()
+	proxy.Strategy = WeightedLoad
+	for i := 0; i < 2; i++ {
+		u, _ := url.Parse("ws://10.0.0." + strconv.Itoa(i) + ":9000")
+		proxy.AddBackend(u)
+	}
+
+	// Without scores the backends are picked by their open connections.
+	_, b := proxy.reserveBackend(nil)
+	if _, next := proxy.selectBackend(nil); next == b {
+		t.Error("expecting the backend without connections on a tie")
+	}
+}
+
+func TestLoadDecay(t *testing.T) {
+	proxy := NewProxy()
+	proxy.LoadHalfLife = time.Minute
+	u, _ := url.Parse("ws://10.0.0.1:9000")
+	proxy.AddBackend(u)
+	proxy.SetBackendLoad(u, 0.8)
+
+	b := proxy.backends[0]
+	if got := proxy.currentLoad(b, b.loadSet.Add(time.Minute)); math.Abs(got-0.4) > 1e-9 {
+		t.Errorf("expecting the load halved after one half-life, got: %v", got)
+	}
+	if got := proxy.currentLoad(b, b.loadSet.Add(10*time.Minute)); got > 0.001 {
+		t.Errorf("expecting a stale load to decay, got: %v", got)
+	}
+	if got := proxy.BackendStatus()[0].Load; got <= 0.79 || got > 0.8 {
+		t.Errorf("expecting the current load in the status, got: %v", got)
+	}
+}
@@ -0,0 +1,70 @@
+package websocketproxy
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Logger receives the log messages of the proxy. Errorf is used for failures
+// worth an operator's attention, Debugf for routine events such as a client
+// being connected. Implementations must be safe for concurrent use.
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// NewLogger returns a Logger writing both levels to l. If l is nil, the
+// standard logger of the log package is used.
+func NewLogger(l *log.Logger) Logger {
+	return stdLogger{l}
+}
+
+// stdLogger is the Logger used when WebsocketProxy.Logger is nil.
+type stdLogger struct {
+	l *log.Logger
+}
+
+func (s stdLogger) Debugf(format string, v ...interface{}) { s.printf(format, v...) }
+func (s stdLogger) Errorf(format string, v ...interface{}) { s.printf(format, v...) }
+
+func (s stdLogger) printf(format string, v ...interface{}) {
+	if s.l == nil {
+		log.Printf(format, v...)
+		return
+	}
+	s.l.Printf(format, v...)
+}
+
+// logger returns the Logger to write to, never nil.
+func (w *WebsocketProxy) logger() Logger {
+	if w.Logger == nil {
+		return stdLogger{}
+	}
+	return w.Logger
+}
+
+// logHandshake logs the handshake with the backend at index, -1 for a URL
+// returned by Router, under LogHandshakes. resp is nil if the backend could
+// not be reached.
+func (w *WebsocketProxy) logHandshake(req *http.Request, index int, target *url.URL, header http.Header, resp *http.Response) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	headers := make([]string, 0, len(names))
+	for _, name := range names {
+		headers = append(headers, name+": "+strings.Join(header[name], ", "))
+	}
+
+	status, protocol := "no response", ""
+	if resp != nil {
+		status = resp.Status
+		protocol = resp.Header.Get(headerProtocol)
+	}
+	w.requestLogger(req).Debugf("websocketproxy: handshake of client(%s) with backend %d url(%s) headers[%s] subprotocol(%s) status(%s)",
+		req.RemoteAddr, index, target, strings.Join(headers, "; "), protocol, status)
+}
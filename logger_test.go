@@ -0,0 +1,149 @@
+package websocketproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// recordingLogger keeps the messages logged at each level.
+type recordingLogger struct {
+	mu     sync.Mutex
+	debugs []string
+	errors []string
+}
+
+func (l *recordingLogger) Debugf(format string, v ...interface{}) {
+	l.mu.Lock()
+	l.debugs = append(l.debugs, fmt.Sprintf(format, v...))
+	l.mu.Unlock()
+}
+
+func (l *recordingLogger) Errorf(format string, v ...interface{}) {
+	l.mu.Lock()
+	l.errors = append(l.errors, fmt.Sprintf(format, v...))
+	l.mu.Unlock()
+}
+
+func (l *recordingLogger) logged(level []string, substr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, msg := range level {
+		if strings.Contains(msg, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLogger(t *testing.T) {
+	dead := closedURL(t)
+	b := newEchoBackend(t)
+	logger := &recordingLogger{}
+
+	proxy := NewProxy()
+	proxy.AddBackend(dead)
+	proxy.AddBackend(b.url)
+	proxy.Logger = logger
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	dialProxy(t, s).Close()
+
+	if !logger.logged(logger.errors, "server("+dead.Host+") not available") {
+		t.Errorf("expecting the dial failure to be logged as error, got: %q", logger.errors)
+	}
+	if !logger.logged(logger.debugs, "through reverse proxy connected") {
+		t.Errorf("expecting the connection to be logged as debug, got: %q", logger.debugs)
+	}
+}
+
+func TestNormalCloseNotLoggedAsError(t *testing.T) {
+	b := newEchoBackend(t)
+	logger := &recordingLogger{}
+
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.Logger = logger
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye")
+	if err := conn.WriteMessage(websocket.CloseMessage, msg); err != nil {
+		t.Fatal(err)
+	}
+	// The proxy closes the connection once the copy ended.
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if len(logger.errors) != 0 {
+		t.Errorf("expecting no error for a normal close, got: %q", logger.errors)
+	}
+}
+
+func TestLogHandshakes(t *testing.T) {
+	upgrader := websocket.Upgrader{Subprotocols: []string{"chat"}}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	defer backend.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(backend.URL, "http"))
+
+	for _, enabled := range []bool{false, true} {
+		logger := &recordingLogger{}
+		proxy := NewProxy()
+		proxy.AddBackend(u)
+		proxy.Logger = logger
+		proxy.LogHandshakes = enabled
+		proxy.Upgrader = &websocket.Upgrader{Subprotocols: []string{"chat"}}
+		s := httptest.NewServer(proxy)
+
+		h := http.Header{"Cookie": {"session=abc"}, "Sec-Websocket-Protocol": {"chat"}}
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/room", h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		// Wait for the connection's last messages to be logged.
+		for len(proxy.ActiveConnections()) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+		s.Close()
+
+		if !enabled {
+			if logger.logged(logger.debugs, "handshake of client") {
+				t.Errorf("expecting no handshake details without LogHandshakes, got: %q", logger.debugs)
+			}
+			continue
+		}
+		for _, want := range []string{
+			"backend 0",
+			"url(" + u.String() + "/room)",
+			"Cookie: session=abc",
+			"subprotocol(chat)",
+			"status(101 Switching Protocols)",
+		} {
+			if !logger.logged(logger.debugs, want) {
+				t.Errorf("expecting %q in the handshake details, got: %q", want, logger.debugs)
+			}
+		}
+	}
+}
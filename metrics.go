@@ -0,0 +1,37 @@
+package websocketproxy
+
+import "time"
+
+// Metrics receives events about proxied connections, for example to update
+// Prometheus counters and gauges. The backend argument is the host of the
+// selected backend URL. Implementations must be safe for concurrent use.
+type Metrics interface {
+	// IncActiveConns is called when a connection to backend is established.
+	IncActiveConns(backend string)
+
+	// DecActiveConns is called when a connection to backend is closed.
+	DecActiveConns(backend string)
+
+	// IncConnErrors is called when dialing backend fails.
+	IncConnErrors(backend string)
+
+	// ObserveConnDuration is called with the lifetime of a closed
+	// connection to backend.
+	ObserveConnDuration(backend string, d time.Duration)
+}
+
+// nopMetrics is the Metrics used when WebsocketProxy.Metrics is nil.
+type nopMetrics struct{}
+
+func (nopMetrics) IncActiveConns(string)                     {}
+func (nopMetrics) DecActiveConns(string)                     {}
+func (nopMetrics) IncConnErrors(string)                      {}
+func (nopMetrics) ObserveConnDuration(string, time.Duration) {}
+
+// metrics returns the Metrics to report to, never nil.
+func (w *WebsocketProxy) metrics() Metrics {
+	if w.Metrics == nil {
+		return nopMetrics{}
+	}
+	return w.Metrics
+}
@@ -0,0 +1,91 @@
+package websocketproxy
+
+import (
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingMetrics counts the events reported per backend.
+type recordingMetrics struct {
+	mu        sync.Mutex
+	active    map[string]int
+	errors    map[string]int
+	durations map[string]int
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{
+		active:    make(map[string]int),
+		errors:    make(map[string]int),
+		durations: make(map[string]int),
+	}
+}
+
+func (m *recordingMetrics) IncActiveConns(backend string) {
+	m.mu.Lock()
+	m.active[backend]++
+	m.mu.Unlock()
+}
+
+func (m *recordingMetrics) DecActiveConns(backend string) {
+	m.mu.Lock()
+	m.active[backend]--
+	m.mu.Unlock()
+}
+
+func (m *recordingMetrics) IncConnErrors(backend string) {
+	m.mu.Lock()
+	m.errors[backend]++
+	m.mu.Unlock()
+}
+
+func (m *recordingMetrics) ObserveConnDuration(backend string, d time.Duration) {
+	m.mu.Lock()
+	m.durations[backend]++
+	m.mu.Unlock()
+}
+
+func (m *recordingMetrics) get(counts map[string]int, backend string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return counts[backend]
+}
+
+func TestMetrics(t *testing.T) {
+	dead := closedURL(t)
+	b := newEchoBackend(t)
+	metrics := newRecordingMetrics()
+
+	proxy := NewProxy()
+	proxy.AddBackend(dead)
+	proxy.AddBackend(b.url)
+	proxy.Metrics = metrics
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	if n := metrics.get(metrics.errors, dead.Host); n != 1 {
+		t.Errorf("expecting 1 connection error for %s, got: %d", dead.Host, n)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for metrics.get(metrics.active, b.url.Host) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("active connection was not reported")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn.Close()
+	for metrics.get(metrics.durations, b.url.Host) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("connection duration was not reported")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := metrics.get(metrics.active, b.url.Host); n != 0 {
+		t.Errorf("expecting no active connection after close, got: %d", n)
+	}
+}
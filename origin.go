@@ -0,0 +1,65 @@
+package websocketproxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// checkOrigin reports whether the Origin of req matches AllowedOrigins.
+// Requests without an Origin header come from non-browser clients and are
+// allowed, as with the Upgrader's default check.
+func (w *WebsocketProxy) checkOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	for _, pattern := range w.AllowedOrigins {
+		if matchOrigin(pattern, u) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameOrigin is the origin check of an Upgrader without CheckOrigin: the
+// Origin header, if any, must name the host the request was sent to.
+func sameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, req.Host)
+}
+
+// originCheckEnabled reports whether AllowedOrigins applies, that is it is
+// set and the Upgrader has no CheckOrigin of its own.
+func (w *WebsocketProxy) originCheckEnabled() bool {
+	return len(w.AllowedOrigins) > 0 && (w.Upgrader == nil || w.Upgrader.CheckOrigin == nil)
+}
+
+// matchOrigin matches origin against pattern, a host optionally preceded by
+// a scheme, where a leading "*." stands for any subdomain.
+func matchOrigin(pattern string, origin *url.URL) bool {
+	pattern = strings.ToLower(pattern)
+	if i := strings.Index(pattern, "://"); i >= 0 {
+		if pattern[:i] != strings.ToLower(origin.Scheme) {
+			return false
+		}
+		pattern = pattern[i+3:]
+	}
+	host := strings.ToLower(origin.Host)
+	if strings.HasPrefix(pattern, "*.") {
+		suffix := pattern[1:]
+		return len(host) > len(suffix) && strings.HasSuffix(host, suffix)
+	}
+	return host == pattern
+}
@@ -0,0 +1,111 @@
+package websocketproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAllowedOrigins(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.AllowedOrigins = []string{"https://app.example.com", "*.example.org"}
+	// The backend only accepts its own origin.
+	proxy.StripHeaders = []string{"Origin"}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"https://app.example.com", true},
+		{"https://APP.example.com", true},
+		{"http://app.example.com", false},
+		{"https://evil.example.com", false},
+		{"https://chat.example.org", true},
+		{"http://a.b.example.org", true},
+		{"https://example.org", false},
+		{"https://example.org.evil.com", false},
+		{"", true},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		if tt.origin != "" {
+			h.Set("Origin", tt.origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(proxyURL, h)
+		if tt.allowed {
+			if err != nil {
+				t.Errorf("origin %q: expecting the handshake to succeed, got: %v", tt.origin, err)
+				continue
+			}
+			conn.Close()
+		} else if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+			t.Errorf("origin %q: expecting status %d, got: %v", tt.origin, http.StatusForbidden, err)
+		}
+	}
+}
+
+func TestAllowedOriginsCheckOriginWins(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.AllowedOrigins = []string{"https://app.example.com"}
+	proxy.StripHeaders = []string{"Origin"}
+	proxy.Upgrader = &websocket.Upgrader{
+		CheckOrigin: func(*http.Request) bool { return true },
+	}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	h := http.Header{"Origin": {"https://other.example.com"}}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), h)
+	if err != nil {
+		t.Fatalf("expecting the explicit CheckOrigin to allow the origin, got: %v", err)
+	}
+	conn.Close()
+	if n := b.Accepted(); n != 1 {
+		t.Errorf("expecting 1 connection on the backend, got: %d", n)
+	}
+}
+
+func TestRejectedOriginSkipsBackend(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	// The backend only accepts its own origin.
+	proxy.StripHeaders = []string{"Origin"}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	h := http.Header{"Origin": {"https://evil.example.com"}}
+	_, resp, err := websocket.DefaultDialer.Dial(proxyURL, h)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expecting status %d for a foreign origin, got: %v", http.StatusForbidden, err)
+	}
+
+	rw := httptest.NewRecorder()
+	req := newHandshakeRequest("/")
+	req.Header.Del("Sec-WebSocket-Key")
+	proxy.ServeHTTP(rw, req)
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("expecting status %d for a handshake without key, got: %d", http.StatusBadRequest, rw.Code)
+	}
+
+	if n := b.Accepted(); n != 0 {
+		t.Errorf("expecting no backend dial for rejected handshakes, got: %d", n)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(proxyURL, http.Header{"Origin": {s.URL}})
+	if err != nil {
+		t.Fatalf("expecting the same origin to be accepted, got: %v", err)
+	}
+	conn.Close()
+}
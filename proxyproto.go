@@ -0,0 +1,185 @@
+package websocketproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout bounds the time a connection may take to send its
+// PROXY protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV2Signature starts every PROXY protocol version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// WrapListener returns l unchanged unless TrustProxyProtocol is set, in
+// which case every accepted connection must start with a PROXY protocol
+// header, version 1 or 2, as sent by L4 load balancers such as HAProxy or
+// AWS NLB. The client address it carries becomes the remote address of the
+// connection, and so the RemoteAddr of its requests, used for
+// X-Forwarded-For, Forwarded and ConnRateLimit. Connections without a valid
+// header are closed. Serve the proxy on the returned listener:
+//
+//	l, err := net.Listen("tcp", ":8080")
+//	if err != nil {
+//		log.Fatalln(err)
+//	}
+//	log.Fatalln(http.Serve(proxy.WrapListener(l), proxy))
+func (w *WebsocketProxy) WrapListener(l net.Listener) net.Listener {
+	if !w.TrustProxyProtocol {
+		return l
+	}
+	return &proxyProtoListener{Listener: l}
+}
+
+// proxyProtoListener wraps the connections of a listener in proxyProtoConn.
+type proxyProtoListener struct {
+	net.Listener
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtoConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtoConn reads the PROXY protocol header of a connection the first
+// time it is read from or asked for its remote address, which the http
+// package does in the goroutine serving the connection rather than in the
+// accept loop.
+type proxyProtoConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+// readHeader parses the header once.
+func (c *proxyProtoConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remoteAddr, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+// RemoteAddr returns the client address from the header, or the address of
+// the peer if the header carries none, for example for health checks of the
+// load balancer.
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a PROXY protocol header from r and returns the
+// client address it carries, or nil if it carries none.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	prefix, err := r.Peek(6)
+	if err != nil {
+		return nil, err
+	}
+	if string(prefix) != "PROXY " {
+		return nil, errProxyProtocol
+	}
+	return readProxyHeaderV1(r)
+}
+
+// readProxyHeaderV1 reads a header such as
+// "PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\n".
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	// The header is at most 107 bytes long.
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyProtocol
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, errProxyProtocol
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, errProxyProtocol
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 reads a binary header, whose signature was peeked.
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if head[12]>>4 != 2 {
+		return nil, errProxyProtocol
+	}
+	switch head[12] & 0xf {
+	case 0:
+		// LOCAL, sent by the load balancer on its own behalf.
+		return nil, nil
+	case 1:
+		// PROXY
+	default:
+		return nil, errProxyProtocol
+	}
+	switch head[13] >> 4 {
+	case 1:
+		if len(body) < 12 {
+			return nil, errProxyProtocol
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2:
+		if len(body) < 36 {
+			return nil, errProxyProtocol
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	// UNSPEC or a UNIX socket, there is no client IP to report.
+	return nil, nil
+}
@@ -0,0 +1,139 @@
+package websocketproxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// serveWrapped serves proxy on a listener wrapped by WrapListener and
+// returns its address.
+func serveWrapped(t *testing.T, proxy *WebsocketProxy) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: proxy}
+	go srv.Serve(proxy.WrapListener(l))
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().String()
+}
+
+// proxyHeaderDialer returns a dialer writing header first on every
+// connection, as a load balancer would.
+func proxyHeaderDialer(header string) *websocket.Dialer {
+	return &websocket.Dialer{
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := conn.Write([]byte(header)); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		},
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	u, headers := newHeaderBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(u)
+	proxy.TrustProxyProtocol = true
+	addr := serveWrapped(t, proxy)
+
+	dialer := proxyHeaderDialer("PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\n")
+	conn, _, err := dialer.Dial("ws://"+addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if got := (<-headers).Get("X-Forwarded-For"); got != "203.0.113.7" {
+		t.Errorf("expecting X-Forwarded-For of the client behind the load balancer, got: %q", got)
+	}
+
+	// A connection without the header did not come through the load
+	// balancer.
+	if _, _, err := websocket.DefaultDialer.Dial("ws://"+addr, nil); err == nil {
+		t.Error("expecting a connection without PROXY header to be rejected")
+	}
+}
+
+func TestProxyProtocolUntrusted(t *testing.T) {
+	u, headers := newHeaderBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(u)
+	addr := serveWrapped(t, proxy)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if got := (<-headers).Get("X-Forwarded-For"); got != "127.0.0.1" {
+		t.Errorf("expecting X-Forwarded-For of the peer, got: %q", got)
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(verCmd, fam byte, body []byte) string {
+		head := append([]byte(nil), proxyV2Signature...)
+		head = append(head, verCmd, fam, 0, 0)
+		binary.BigEndian.PutUint16(head[14:], uint16(len(body)))
+		return string(append(head, body...))
+	}
+	v4 := []byte{198, 51, 100, 9, 10, 0, 0, 1, 0x1f, 0x90, 0x01, 0xbb}
+	v6 := make([]byte, 36)
+	copy(v6, net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(v6[32:], 4242)
+
+	tests := []struct {
+		header string
+		want   string
+		err    bool
+	}{
+		{"PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\n", "203.0.113.7:56324", false},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 4242 443\r\n", "[2001:db8::1]:4242", false},
+		{"PROXY UNKNOWN\r\n", "", false},
+		{"PROXY TCP4 2001:db8::1 10.0.0.1 1 2\r\n", "", true},
+		{"PROXY TCP4 203.0.113.7\r\n", "", true},
+		{"GET / HTTP/1.1\r\n", "", true},
+		{v2(0x21, 0x11, v4), "198.51.100.9:8080", false},
+		{v2(0x21, 0x21, v6), "[2001:db8::1]:4242", false},
+		{v2(0x20, 0x00, nil), "", false},
+		{v2(0x11, 0x11, v4), "", true},
+		{v2(0x21, 0x11, v4[:4]), "", true},
+	}
+	for _, tt := range tests {
+		r := bufio.NewReader(strings.NewReader(tt.header + "GET"))
+		addr, err := readProxyHeader(r)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: expecting an error, got: %v", tt.header, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.header, err)
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != tt.want {
+			t.Errorf("%q: expecting %q, got: %q", tt.header, tt.want, got)
+		}
+		// The request after the header is left to read.
+		if rest, _ := r.Peek(3); string(rest) != "GET" {
+			t.Errorf("%q: expecting the request to follow, got: %q", tt.header, rest)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package websocketproxy
+
+import (
+	"net/http"
+	"time"
+)
+
+// rateLimitSweepInterval is how often buckets of clients that went quiet are
+// dropped.
+const rateLimitSweepInterval = time.Minute
+
+// RateLimit limits how fast a single client may open connections with a
+// token bucket: Burst connections at once, refilled at Rate per second.
+// A zero Rate disables the limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// burst returns the bucket size, at least 1.
+func (l RateLimit) burst() float64 {
+	if l.Burst < 1 {
+		return 1
+	}
+	return float64(l.Burst)
+}
+
+// bucket is the token bucket of one client.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allowConn reports whether the client of req may open a new connection
+// under ConnRateLimit. Clients are identified by clientIP.
+func (w *WebsocketProxy) allowConn(req *http.Request) bool {
+	limit := w.ConnRateLimit
+	if limit.Rate <= 0 {
+		return true
+	}
+	ip := w.clientIP(req)
+	now := time.Now()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.buckets == nil {
+		w.buckets = make(map[string]*bucket)
+		w.bucketsSwept = now
+	}
+	if now.Sub(w.bucketsSwept) >= rateLimitSweepInterval {
+		w.sweepBuckets(now)
+	}
+
+	b, ok := w.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: limit.burst(), last: now}
+		w.buckets[ip] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+	if b.tokens > limit.burst() {
+		b.tokens = limit.burst()
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweepBuckets drops the buckets that are full again at now, which are the
+// same as no bucket at all. This bounds the state to the clients seen within
+// the refill time. Callers must hold mu.
+func (w *WebsocketProxy) sweepBuckets(now time.Time) {
+	limit := w.ConnRateLimit
+	for ip, b := range w.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= limit.burst() {
+			delete(w.buckets, ip)
+		}
+	}
+	w.bucketsSwept = now
+}
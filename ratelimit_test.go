@@ -0,0 +1,86 @@
+package websocketproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConnRateLimit(t *testing.T) {
+	u := closedURL(t)
+	proxy := NewProxy()
+	proxy.AddBackend(u)
+	proxy.ForwardMode = RedirectForwardMode
+	proxy.ConnRateLimit = RateLimit{Rate: 0.01, Burst: 2}
+
+	serve := func(ip string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req := newHandshakeRequest("/")
+		req.RemoteAddr = ip + ":1234"
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	for i := 0; i < 2; i++ {
+		if rw := serve("10.0.0.1"); rw.Code != http.StatusTemporaryRedirect {
+			t.Fatalf("expecting connection %d within the burst, got: %d", i, rw.Code)
+		}
+	}
+	rw := serve("10.0.0.1")
+	if rw.Code != http.StatusTooManyRequests {
+		t.Errorf("expecting status %d, got: %d", http.StatusTooManyRequests, rw.Code)
+	}
+	if rw.Header().Get("Retry-After") == "" {
+		t.Error("expecting a Retry-After header")
+	}
+	if rw := serve("10.0.0.2"); rw.Code != http.StatusTemporaryRedirect {
+		t.Errorf("expecting another client to be allowed, got: %d", rw.Code)
+	}
+}
+
+func TestConnRateLimitForwardedFor(t *testing.T) {
+	proxy := NewProxy()
+	proxy.AddBackend(closedURL(t))
+	proxy.ForwardMode = RedirectForwardMode
+	proxy.ConnRateLimit = RateLimit{Rate: 0.01, Burst: 1}
+
+	serve := func(forwardedFor string) int {
+		rw := httptest.NewRecorder()
+		req := newHandshakeRequest("/")
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		proxy.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	// A forged X-Forwarded-For does not make a new client.
+	serve("192.0.2.1")
+	if code := serve("192.0.2.2"); code != http.StatusTooManyRequests {
+		t.Errorf("expecting a rotating X-Forwarded-For to be limited, got: %d", code)
+	}
+
+	// It does when the proxy trusts the header.
+	proxy.TrustForwardedHeaders = true
+	if code := serve("192.0.2.3"); code != http.StatusTemporaryRedirect {
+		t.Errorf("expecting a trusted X-Forwarded-For to identify the client, got: %d", code)
+	}
+}
+
+func TestSweepBuckets(t *testing.T) {
+	proxy := NewProxy()
+	proxy.ConnRateLimit = RateLimit{Rate: 1, Burst: 1}
+	now := time.Now()
+	proxy.buckets = map[string]*bucket{
+		"idle":   {tokens: 0, last: now.Add(-time.Minute)},
+		"active": {tokens: 0, last: now},
+	}
+
+	proxy.sweepBuckets(now)
+	if _, ok := proxy.buckets["idle"]; ok {
+		t.Error("expecting the refilled bucket to be dropped")
+	}
+	if _, ok := proxy.buckets["active"]; !ok {
+		t.Error("expecting the empty bucket to be kept")
+	}
+}
@@ -0,0 +1,113 @@
+package websocketproxy
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// DefaultRebalanceInterval is used when WebsocketProxy.RebalanceInterval is
+// zero.
+const DefaultRebalanceInterval = time.Second
+
+func (w *WebsocketProxy) rebalanceInterval() time.Duration {
+	if w.RebalanceInterval > 0 {
+		return w.RebalanceInterval
+	}
+	return DefaultRebalanceInterval
+}
+
+// Rebalance gradually closes the connections active when it is called, with
+// a close frame sent to both peers, 1001 (going away) unless
+// RebalanceCloseCode is set, so clients reconnect and spread over the
+// current backends, for example after scaling out. Every
+// RebalanceInterval it closes the oldest remaining ones, at most rate, a
+// fraction between 0 and 1, of the connections it started with, so clients
+// do not all reconnect at once. Unlike MaxConnLifetime it is a one-off.
+// Calling it again restarts with the connections active then; a rate of
+// zero or less only stops a running rebalance, as StopRebalance does. Once
+// Shutdown was called it does nothing.
+func (w *WebsocketProxy) Rebalance(rate float64) {
+	if rate > 1 {
+		rate = 1
+	}
+
+	// Replace a running rebalance and take the connections in one go, so
+	// concurrent calls and Shutdown leave at most one running.
+	var (
+		conns      []*proxyConn
+		stop, done chan struct{}
+	)
+	w.mu.Lock()
+	prevStop, prevDone := w.rebalanceStop, w.rebalanceDone
+	w.rebalanceStop, w.rebalanceDone = nil, nil
+	if rate > 0 && !w.shuttingDown && len(w.conns) > 0 {
+		conns = make([]*proxyConn, 0, len(w.conns))
+		for pc := range w.conns {
+			conns = append(conns, pc)
+		}
+		stop, done = make(chan struct{}), make(chan struct{})
+		w.rebalanceStop, w.rebalanceDone = stop, done
+		w.background.Add(1)
+	}
+	w.mu.Unlock()
+
+	if prevStop != nil {
+		close(prevStop)
+		<-prevDone
+	}
+	if stop == nil {
+		return
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].start.Before(conns[j].start) })
+	batch := int(math.Ceil(rate * float64(len(conns))))
+	code, text := closeFrame(w.RebalanceCloseCode, w.RebalanceCloseReason, DefaultRebalanceCloseReason)
+
+	go func() {
+		defer w.background.Done()
+		defer close(done)
+		ticker := time.NewTicker(w.rebalanceInterval())
+		defer ticker.Stop()
+		for len(conns) > 0 {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			n := 0
+			for n < batch && len(conns) > 0 {
+				pc := conns[0]
+				conns = conns[1:]
+				// Connections that closed on their own do not count
+				// against the batch.
+				if w.isTracked(pc) {
+					pc.close(code, text)
+					n++
+				}
+			}
+		}
+	}()
+}
+
+// StopRebalance stops a rebalance started by Rebalance and waits for it to
+// exit. Connections not closed yet are left open.
+func (w *WebsocketProxy) StopRebalance() {
+	w.mu.Lock()
+	stop, done := w.rebalanceStop, w.rebalanceDone
+	w.rebalanceStop, w.rebalanceDone = nil, nil
+	w.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+// isTracked reports whether pc is still an active connection.
+func (w *WebsocketProxy) isTracked(pc *proxyConn) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, ok := w.conns[pc]
+	return ok
+}
@@ -0,0 +1,138 @@
+package websocketproxy
+
+import (
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRebalance(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.RebalanceInterval = 100 * time.Millisecond
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conns := make([]*websocket.Conn, 10)
+	for i := range conns {
+		conns[i] = dialProxy(t, s)
+		defer conns[i].Close()
+		// Space the connections out so their ages differ.
+		time.Sleep(time.Millisecond)
+	}
+	for len(proxy.ActiveConnections()) != len(conns) {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	proxy.Rebalance(0.2)
+	defer proxy.StopRebalance()
+
+	for {
+		active := len(proxy.ActiveConnections())
+		elapsed := time.Since(start)
+		// At most two connections per elapsed interval, allowing for the
+		// interval in progress.
+		limit := 2 * (int(elapsed/proxy.RebalanceInterval) + 1)
+		if closed := len(conns) - active; closed > limit {
+			t.Fatalf("expecting at most %d connections closed after %s, got: %d", limit, elapsed, closed)
+		}
+		if active == 0 {
+			break
+		}
+		if elapsed > 3*time.Second {
+			t.Fatalf("expecting every connection to be closed, %d left", active)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < 4*proxy.RebalanceInterval {
+		t.Errorf("expecting the closures to be spread over 5 intervals, took: %s", elapsed)
+	}
+
+	for _, conn := range conns {
+		_, _, err := conn.ReadMessage()
+		if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Errorf("expecting a going away close, got: %v", err)
+		}
+	}
+}
+
+func TestRebalanceOldestFirst(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.RebalanceInterval = 50 * time.Millisecond
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	old := dialProxy(t, s)
+	defer old.Close()
+	time.Sleep(10 * time.Millisecond)
+	young := dialProxy(t, s)
+	defer young.Close()
+	for len(proxy.ActiveConnections()) != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	proxy.Rebalance(0.5)
+	if _, _, err := old.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("expecting the oldest connection to be closed first, got: %v", err)
+	}
+	proxy.StopRebalance()
+
+	if err := young.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := young.ReadMessage(); err != nil || string(msg) != "hello" {
+		t.Errorf("expecting the younger connection to stay open after StopRebalance, got: %q, %v", msg, err)
+	}
+}
+
+func TestRebalanceConcurrentAndShutdown(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.RebalanceInterval = time.Hour
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+	for len(proxy.ActiveConnections()) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Concurrent calls leave a single rebalance, stopped by one call.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			proxy.Rebalance(0.5)
+		}()
+	}
+	wg.Wait()
+	proxy.StopRebalance()
+	proxy.mu.Lock()
+	running := proxy.rebalanceStop != nil
+	proxy.mu.Unlock()
+	if running {
+		t.Fatal("expecting StopRebalance to stop the only rebalance running")
+	}
+
+	// Connections still closing during Shutdown are not rebalanced.
+	proxy.mu.Lock()
+	proxy.shuttingDown = true
+	proxy.mu.Unlock()
+	proxy.Rebalance(1)
+	proxy.mu.Lock()
+	running = proxy.rebalanceStop != nil
+	proxy.mu.Unlock()
+	if running {
+		t.Error("expecting no rebalance to start once the proxy is shutting down")
+	}
+}
@@ -0,0 +1,210 @@
+package websocketproxy
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultReplayWindow is used when WebsocketProxy.ReplayWindow is zero.
+const DefaultReplayWindow = 5 * time.Second
+
+// reconnectInterval is the pause between the attempts of failover to reach
+// a backend within BackendReconnectGrace.
+const reconnectInterval = 100 * time.Millisecond
+
+// replayMessage is a client message kept for replay.
+type replayMessage struct {
+	msgType int
+	data    []byte
+}
+
+// replayBuffer keeps the first client messages of a connection so they can
+// be sent again to another backend if the first one drops early.
+type replayBuffer struct {
+	limit    int
+	until    time.Time
+	msgs     []replayMessage
+	overflow bool
+}
+
+func newReplayBuffer(limit int, until time.Time) *replayBuffer {
+	return &replayBuffer{limit: limit, until: until}
+}
+
+// add keeps a message sent to the backend. Once more than limit messages
+// were sent, the buffer can no longer replay the session and is dropped.
+func (r *replayBuffer) add(msgType int, data []byte) {
+	if r.overflow {
+		return
+	}
+	if len(r.msgs) >= r.limit {
+		r.overflow = true
+		r.msgs = nil
+		return
+	}
+	r.msgs = append(r.msgs, replayMessage{msgType: msgType, data: data})
+}
+
+// usable reports whether the buffer can replay the session at now.
+func (r *replayBuffer) usable(now time.Time) bool {
+	return r != nil && !r.overflow && now.Before(r.until)
+}
+
+// droppedConn reports whether err ends a connection that went away without
+// a close frame.
+func droppedConn(err error) bool {
+	if err == websocket.ErrReadLimit {
+		return false
+	}
+	cerr, ok := err.(*websocket.CloseError)
+	return !ok || cerr.Code == websocket.CloseAbnormalClosure
+}
+
+// resumes reports whether connections move to another backend whenever
+// their backend drops, see ResumeOnBackendFailure and BackendReconnectGrace.
+func (w *WebsocketProxy) resumes() bool {
+	return w.ResumeOnBackendFailure || w.BackendReconnectGrace > 0
+}
+
+func (w *WebsocketProxy) replayWindow() time.Duration {
+	if w.ReplayWindow <= 0 {
+		return DefaultReplayWindow
+	}
+	return w.ReplayWindow
+}
+
+// record keeps a client message for replay and returns the backend
+// connection it must be written to.
+func (pc *proxyConn) record(msgType int, data []byte) *websocket.Conn {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.replay.add(msgType, data)
+	return pc.backend
+}
+
+// waitBackend returns the backend connection of pc once the failover in
+// progress, if any, is over, so that messages are not written to the
+// connection being replaced.
+func (pc *proxyConn) waitBackend() *websocket.Conn {
+	pc.mu.Lock()
+	for pc.reconnecting != nil && !pc.closed {
+		reconnecting := pc.reconnecting
+		pc.mu.Unlock()
+		<-reconnecting
+		pc.mu.Lock()
+	}
+	defer pc.mu.Unlock()
+	return pc.backend
+}
+
+// failover replaces the backend of pc after conn, its backend connection,
+// dropped early in the session or, with ResumeOnBackendFailure or
+// BackendReconnectGrace, at any time. It dials another backend, trying again
+// until BackendReconnectGrace is over, replays the recorded client messages
+// if the replay buffer is still usable and returns the new backend
+// connection, or nil if the session cannot fail over.
+//
+// pc.mu is not held while dialing, so closing pc is never delayed by a
+// failover; a copy goroutine failing while the other one reconnects waits
+// for its outcome instead.
+func (w *WebsocketProxy) failover(req *http.Request, pc *proxyConn, conn *websocket.Conn) *websocket.Conn {
+	if conn == pc.client {
+		return nil
+	}
+	pc.mu.Lock()
+	for pc.reconnecting != nil && !pc.closed {
+		reconnecting := pc.reconnecting
+		pc.mu.Unlock()
+		<-reconnecting
+		pc.mu.Lock()
+	}
+	if pc.closed {
+		pc.mu.Unlock()
+		return nil
+	}
+	if conn != pc.backend {
+		// The other copy goroutine failed over already.
+		defer pc.mu.Unlock()
+		return pc.backend
+	}
+	if !pc.replay.usable(time.Now()) && !w.resumes() {
+		pc.mu.Unlock()
+		return nil
+	}
+	pc.backend.Close()
+	reconnecting := make(chan struct{})
+	pc.reconnecting = reconnecting
+	pc.mu.Unlock()
+
+	next, err := w.reconnectBackend(req, pc)
+	if err == nil {
+		w.armBackend(pc, next.backend)
+	}
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.reconnecting = nil
+	close(reconnecting)
+	if err != nil {
+		w.requestLogger(req).Errorf("websocketproxy: failover of client(%s) failed: %v", req.RemoteAddr, err)
+		return nil
+	}
+	if pc.closed {
+		next.backend.Close()
+		w.releaseBackend(next.entry)
+		return nil
+	}
+	// Replay under pc.mu so that messages recorded while reconnecting are
+	// included and none is written to the new backend before them.
+	var msgs []replayMessage
+	if pc.replay.usable(time.Now()) {
+		msgs = pc.replay.msgs
+	}
+	for _, m := range msgs {
+		if err := next.backend.WriteMessage(m.msgType, m.data); err != nil {
+			w.requestLogger(req).Errorf("websocketproxy: failover of client(%s) failed to replay: %v", req.RemoteAddr, err)
+			next.backend.Close()
+			w.releaseBackend(next.entry)
+			return nil
+		}
+	}
+
+	metrics := w.metrics()
+	metrics.DecActiveConns(pc.backendURL.Host)
+	metrics.IncActiveConns(next.backendURL.Host)
+	w.releaseBackend(pc.entry)
+	pc.backend, pc.backendURL, pc.entry = next.backend, next.backendURL, next.entry
+
+	w.requestLogger(req).Debugf("websocketproxy: client(%s) failed over to server(%s), replayed %d messages", req.RemoteAddr, pc.backendURL.Host, len(msgs))
+	return pc.backend
+}
+
+// reconnectBackend connects req to a backend for the failover of pc.
+// Within BackendReconnectGrace it keeps trying every reconnectInterval, for
+// example while the only backend restarts, unless pc is closed meanwhile,
+// for example because the client left.
+func (w *WebsocketProxy) reconnectBackend(req *http.Request, pc *proxyConn) (*proxyConn, error) {
+	deadline := time.Now().Add(w.BackendReconnectGrace)
+	closing := pc.closing()
+	for {
+		next, _, err := w.tryGetBackendConn(req)
+		if err == nil {
+			return next, nil
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 || pc.isClosed() {
+			return nil, err
+		}
+		if wait > reconnectInterval {
+			wait = reconnectInterval
+		}
+		w.requestLogger(req).Debugf("websocketproxy: no backend available for client(%s), reconnecting in %v", req.RemoteAddr, wait)
+		select {
+		case <-closing:
+			return nil, err
+		case <-time.After(wait):
+		}
+	}
+}
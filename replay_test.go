@@ -0,0 +1,304 @@
+package websocketproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/button-chen/websocketproxy/wstest"
+	"github.com/gorilla/websocket"
+)
+
+// newDroppingBackend returns a backend that reads one message and then drops
+// the connection without a close frame.
+func newDroppingBackend(t *testing.T) *url.URL {
+	b := wstest.NewBackend(wstest.Options{DropAfter: 1})
+	t.Cleanup(b.Close)
+	return b.URL
+}
+
+func TestReplayEarlyMessages(t *testing.T) {
+	dropping := newDroppingBackend(t)
+	echo := newEchoBackend(t)
+
+	proxy := NewProxy()
+	proxy.AddBackend(dropping)
+	proxy.AddBackend(echo.url)
+	proxy.ReplayEarlyMessages = 2
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, text := range []string{"auth", "hello"} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(text)); err != nil {
+			t.Fatal(err)
+		}
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg) != text {
+			t.Errorf("expecting %q from the new backend, got: %q", text, msg)
+		}
+	}
+}
+
+func TestReplayBufferOverflow(t *testing.T) {
+	r := newReplayBuffer(2, time.Now().Add(time.Minute))
+	r.add(websocket.TextMessage, []byte("a"))
+	r.add(websocket.TextMessage, []byte("b"))
+	if !r.usable(time.Now()) {
+		t.Fatal("expecting the buffer to be usable within its limit")
+	}
+	r.add(websocket.TextMessage, []byte("c"))
+	if r.usable(time.Now()) {
+		t.Error("expecting the buffer to be unusable once more messages were sent")
+	}
+	if r := newReplayBuffer(2, time.Now()); r.usable(time.Now().Add(time.Second)) {
+		t.Error("expecting the buffer to be unusable after the window")
+	}
+}
+
+func TestResumeOnBackendFailure(t *testing.T) {
+	// The first backend echoes two messages, then dies mid-session.
+	upgrader := websocket.Upgrader{}
+	dying := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		for i := 0; i < 2; i++ {
+			msgType, p, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(msgType, p)
+		}
+		conn.UnderlyingConn().Close()
+	}))
+	defer dying.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(dying.URL, "http"))
+	echo := newEchoBackend(t)
+
+	proxy := NewProxy()
+	proxy.AddBackend(u)
+	proxy.AddBackend(echo.url)
+	proxy.ResumeOnBackendFailure = true
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i, text := range []string{"one", "two", "three", "four"} {
+		if i == 2 {
+			// Wait for the proxy to move to the other backend.
+			deadline := time.Now().Add(5 * time.Second)
+			for echo.Accepted() == 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("expecting the proxy to dial another backend")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(text)); err != nil {
+			t.Fatal(err)
+		}
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("expecting the session to survive the backend failure, got: %v", err)
+		}
+		if string(msg) != text {
+			t.Errorf("expecting %q, got: %q", text, msg)
+		}
+	}
+}
+
+func TestResumeWithoutBackendCloses(t *testing.T) {
+	// The only backend goes away entirely after dropping the connection.
+	var dying *httptest.Server
+	dying = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.ReadMessage()
+		dying.Listener.Close()
+		conn.UnderlyingConn().Close()
+	}))
+	defer dying.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(dying.URL, "http"))
+
+	proxy := NewProxy()
+	proxy.AddBackend(u)
+	proxy.ResumeOnBackendFailure = true
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Error("expecting the client to be closed once no backend is left")
+	}
+}
+
+func TestBackendReconnectGrace(t *testing.T) {
+	// The only backend drops the connection on "bounce" and comes back on
+	// the same address a little later.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	var srv *http.Server
+	srv = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			msgType, p, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if string(p) == "bounce" {
+				l.Close()
+				conn.UnderlyingConn().Close()
+				time.AfterFunc(300*time.Millisecond, func() {
+					if l2, err := net.Listen("tcp", addr); err == nil {
+						go srv.Serve(l2)
+					}
+				})
+				return
+			}
+			conn.WriteMessage(msgType, p)
+		}
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+	u, _ := url.Parse("ws://" + addr)
+
+	proxy := NewProxy()
+	proxy.AddBackend(u)
+	proxy.BackendReconnectGrace = 2 * time.Second
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("bounce")); err != nil {
+		t.Fatal(err)
+	}
+	// Held until the backend is back, once the proxy saw the drop.
+	time.Sleep(100 * time.Millisecond)
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("expecting the client to survive the bounce, got: %v", err)
+	}
+	if string(msg) != "hello" {
+		t.Errorf("expecting hello from the restarted backend, got: %q", msg)
+	}
+}
+
+func TestBackendReconnectGraceExpires(t *testing.T) {
+	var dying *httptest.Server
+	dying = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.ReadMessage()
+		dying.Listener.Close()
+		conn.UnderlyingConn().Close()
+	}))
+	defer dying.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(dying.URL, "http"))
+
+	proxy := NewProxy()
+	proxy.AddBackend(u)
+	proxy.BackendReconnectGrace = 300 * time.Millisecond
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("expecting the client to be closed once the grace is over")
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Errorf("expecting the client to be kept for the grace period, closed after %s", d)
+	}
+}
+
+func TestBackendReconnectGraceInterrupted(t *testing.T) {
+	// newProxy returns a proxy to a backend going away for good after the
+	// first message.
+	newProxy := func() (*WebsocketProxy, *httptest.Server) {
+		var dying *httptest.Server
+		dying = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			conn.ReadMessage()
+			dying.Listener.Close()
+			conn.UnderlyingConn().Close()
+		}))
+		t.Cleanup(dying.Close)
+		u, _ := url.Parse("ws" + strings.TrimPrefix(dying.URL, "http"))
+
+		proxy := NewProxy()
+		proxy.AddBackend(u)
+		proxy.BackendReconnectGrace = 10 * time.Second
+		s := httptest.NewServer(proxy)
+		t.Cleanup(s.Close)
+		return proxy, s
+	}
+
+	// A client leaving stops the reconnection.
+	proxy, s := newProxy()
+	conn := dialProxy(t, s)
+	conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+	time.Sleep(100 * time.Millisecond)
+	conn.Close()
+	deadline := time.Now().Add(time.Second)
+	for len(proxy.ActiveConnections()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expecting the reconnection to stop once the client left")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Closing the connection does not wait for the grace period either.
+	proxy, s = newProxy()
+	conn = dialProxy(t, s)
+	defer conn.Close()
+	conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := proxy.Shutdown(ctx); err != nil {
+		t.Fatalf("expecting Shutdown not to wait for the reconnection, got: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("expecting going away close, got: %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package websocketproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// DefaultRequestIDHeader is used when WebsocketProxy.RequestIDHeader is
+// empty.
+const DefaultRequestIDHeader = "X-Request-Id"
+
+// requestIDKey is the context key of the request ID.
+type requestIDKey struct{}
+
+// RequestID returns the ID the proxy assigned to req, as passed to
+// OnProxyError and ErrorHandler, or "" if it has none.
+func RequestID(req *http.Request) string {
+	id, _ := req.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+func (w *WebsocketProxy) requestIDHeader() string {
+	if w.RequestIDHeader == "" {
+		return DefaultRequestIDHeader
+	}
+	return w.RequestIDHeader
+}
+
+// withRequestID returns req carrying its request ID, taken from the
+// RequestIDHeader of req or, with GenerateRequestID, newly generated.
+func (w *WebsocketProxy) withRequestID(req *http.Request) *http.Request {
+	id := req.Header.Get(w.requestIDHeader())
+	if id == "" && w.GenerateRequestID {
+		id = newRequestID()
+	}
+	if id == "" {
+		return req
+	}
+	return req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id))
+}
+
+// newRequestID returns a random 128-bit ID in hex.
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// requestLogger returns the Logger for messages about req, which prefixes
+// them with the request ID if there is one.
+func (w *WebsocketProxy) requestLogger(req *http.Request) Logger {
+	id := RequestID(req)
+	if id == "" {
+		return w.logger()
+	}
+	return idLogger{w.logger(), id}
+}
+
+// idLogger prefixes the messages of l with a request ID.
+type idLogger struct {
+	l  Logger
+	id string
+}
+
+func (l idLogger) Debugf(format string, v ...interface{}) {
+	l.l.Debugf("[%s] "+format, append([]interface{}{l.id}, v...)...)
+}
+
+func (l idLogger) Errorf(format string, v ...interface{}) {
+	l.l.Errorf("[%s] "+format, append([]interface{}{l.id}, v...)...)
+}
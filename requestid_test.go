@@ -0,0 +1,73 @@
+package websocketproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRequestIDForwarded(t *testing.T) {
+	u, headers := newHeaderBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(u)
+	var stats ConnStats
+	closed := make(chan struct{})
+	proxy.OnConnClose = func(s ConnStats) {
+		stats = s
+		close(closed)
+	}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	h := http.Header{"X-Request-Id": {"abc-123"}}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if got := (<-headers).Get("X-Request-Id"); got != "abc-123" {
+		t.Errorf("expecting the request ID to be forwarded, got: %q", got)
+	}
+	<-closed
+	if stats.RequestID != "abc-123" {
+		t.Errorf("expecting the request ID in the connection stats, got: %q", stats.RequestID)
+	}
+}
+
+func TestRequestIDGenerated(t *testing.T) {
+	logger := &recordingLogger{}
+	proxy := NewProxy()
+	proxy.AddBackend(closedURL(t))
+	proxy.Logger = logger
+	proxy.RequestIDHeader = "X-Correlation-Id"
+	proxy.GenerateRequestID = true
+	var id string
+	proxy.OnProxyError = func(req *http.Request, err error) {
+		id = RequestID(req)
+	}
+
+	proxy.ServeHTTP(httptest.NewRecorder(), newHandshakeRequest("/"))
+	if len(id) != 32 {
+		t.Fatalf("expecting a generated request ID in the error callback, got: %q", id)
+	}
+	if !logger.logged(logger.errors, "["+id+"] ") {
+		t.Errorf("expecting the request ID in the log messages, got: %q", logger.errors)
+	}
+
+	req := newHandshakeRequest("/")
+	req.Header.Set("X-Correlation-Id", "from-client")
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+	if id != "from-client" {
+		t.Errorf("expecting the ID of the client to be kept, got: %q", id)
+	}
+
+	proxy.GenerateRequestID = false
+	proxy.ServeHTTP(httptest.NewRecorder(), newHandshakeRequest("/"))
+	if id != "" {
+		t.Errorf("expecting no request ID without generation, got: %q", id)
+	}
+}
@@ -0,0 +1,110 @@
+package websocketproxy
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// ringReplicas is the number of virtual nodes a backend of weight 1 has on
+// the consistent hash ring.
+const ringReplicas = 100
+
+// ring is the consistent hash ring used by the ConsistentHash strategy.
+type ring struct {
+	// members are the backends the ring was built from, to detect changes.
+	members []*backend
+	hashes  []uint32
+	indexes []int
+}
+
+// hashString returns the 32-bit FNV-1a hash of s.
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// buildRing places ringReplicas virtual nodes per unit of weight for every
+// backend. Nodes are named after the backend URL so a backend keeps its
+// place on the ring when others are added or removed. Callers must hold mu.
+func (w *WebsocketProxy) buildRing() *ring {
+	r := &ring{members: append([]*backend(nil), w.backends[:len(w.Backends)]...)}
+	type node struct {
+		hash  uint32
+		index int
+	}
+	var nodes []node
+	for i, b := range r.members {
+		name := strconv.Itoa(i)
+		if b.target != nil {
+			name = b.target.String()
+		}
+		for j := 0; j < ringReplicas*b.weight; j++ {
+			nodes = append(nodes, node{hashString(name + "#" + strconv.Itoa(j)), i})
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].hash < nodes[j].hash })
+	r.hashes = make([]uint32, len(nodes))
+	r.indexes = make([]int, len(nodes))
+	for i, n := range nodes {
+		r.hashes[i], r.indexes[i] = n.hash, n.index
+	}
+	return r
+}
+
+// current reports whether r was built from the current backends. Callers
+// must hold mu.
+func (r *ring) current(w *WebsocketProxy) bool {
+	return r != nil && w.sameBackends(r.members)
+}
+
+// sameBackends reports whether members are the current backends, in order.
+// Callers must hold mu.
+func (w *WebsocketProxy) sameBackends(members []*backend) bool {
+	if len(members) != len(w.Backends) {
+		return false
+	}
+	for i, b := range members {
+		if w.backends[i] != b {
+			return false
+		}
+	}
+	return true
+}
+
+// consistentHash picks the backend owning the hash of the key of req on the
+// ring, walking clockwise past backends that are not selectable or do not
+// speak any of protocols. Callers must hold mu.
+func (w *WebsocketProxy) consistentHash(req *http.Request, protocols []string) int {
+	if !w.ring.current(w) {
+		w.ring = w.buildRing()
+	}
+	r := w.ring
+	if len(r.hashes) == 0 {
+		return -1
+	}
+
+	var key string
+	if req != nil {
+		key = w.hashKey(req)
+	}
+	h := hashString(key)
+	start := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	for i := 0; i < len(r.hashes); i++ {
+		index := r.indexes[(start+i)%len(r.hashes)]
+		if w.selectable(index) && w.backends[index].speaks(protocols) {
+			return index
+		}
+	}
+	return w.randomBackend(protocols)
+}
+
+// hashKey returns the key req is hashed by, see HashKey.
+func (w *WebsocketProxy) hashKey(req *http.Request) string {
+	if w.HashKey != nil {
+		return w.HashKey(req)
+	}
+	return req.URL.Path
+}
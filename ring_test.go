@@ -0,0 +1,69 @@
+package websocketproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestConsistentHashRemap(t *testing.T) {
+	proxy := NewProxy()
+	proxy.Strategy = ConsistentHash
+	for i := 0; i < 5; i++ {
+		u, _ := url.Parse("ws://10.0.0." + strconv.Itoa(i) + ":9000")
+		proxy.AddBackend(u)
+	}
+
+	const keys = 10000
+	owner := func(key int) string {
+		req := httptest.NewRequest("GET", "/resource/"+strconv.Itoa(key), nil)
+		_, b := proxy.selectBackend(req)
+		return b.target.Host
+	}
+	before := make([]string, keys)
+	for i := range before {
+		before[i] = owner(i)
+	}
+	for i := 0; i < 100; i++ {
+		if got := owner(i); got != before[i] {
+			t.Fatalf("key %d moved from %s to %s without a change", i, before[i], got)
+		}
+	}
+
+	u, _ := url.Parse("ws://10.0.0.5:9000")
+	proxy.AddBackend(u)
+	moved := 0
+	for i := range before {
+		if got := owner(i); got != before[i] {
+			if got != u.Host {
+				t.Fatalf("key %d moved between existing backends: %s to %s", i, before[i], got)
+			}
+			moved++
+		}
+	}
+	// The new backend takes about a sixth of the keys.
+	if rate := float64(moved) / keys; rate < 0.08 || rate > 0.25 {
+		t.Errorf("expecting about 1/6 of the keys to move, got: %.3f", rate)
+	}
+}
+
+func TestConsistentHashSkipsUnavailable(t *testing.T) {
+	proxy := NewProxy()
+	proxy.Strategy = ConsistentHash
+	proxy.HashKey = func(*http.Request) string { return "fixed" }
+	for i := 0; i < 3; i++ {
+		u, _ := url.Parse("ws://10.0.0." + strconv.Itoa(i) + ":9000")
+		proxy.AddBackend(u)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	first, _ := proxy.selectBackend(req)
+	proxy.tripBackend(first, time.Hour)
+	next, _ := proxy.selectBackend(req)
+	if next == first || next < 0 {
+		t.Errorf("expecting another backend while %d is open, got: %d", first, next)
+	}
+}
@@ -0,0 +1,99 @@
+package websocketproxy
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// shadowQueueSize is the number of client messages buffered for a shadow
+// connection. Messages arriving while the queue is full are dropped.
+const shadowQueueSize = 64
+
+// SetShadowBackend mirrors the client messages of proxied connections to
+// target, for example to try a new backend version with real traffic. Each
+// mirrored connection gets its own connection to target, whose messages are
+// discarded. Mirroring is best effort: messages are dropped rather than
+// slowing the client down, and failures of the shadow never affect the
+// proxied connection. ShadowSampleRate selects the connections mirrored. A
+// nil target stops mirroring new connections.
+func (w *WebsocketProxy) SetShadowBackend(target *url.URL) {
+	w.mu.Lock()
+	w.shadow = target
+	w.mu.Unlock()
+}
+
+// shadowConn mirrors the messages of one proxied connection.
+type shadowConn struct {
+	msgs chan replayMessage
+}
+
+// startShadow returns the mirror of the connection of req, or nil if there
+// is no shadow backend or the connection is not sampled. The shadow is
+// dialed in the background so the client never waits for it, with a copy of
+// requestHeader, the headers built for the proxied connection, so that
+// Director runs once per connection.
+func (w *WebsocketProxy) startShadow(req *http.Request, requestHeader http.Header) *shadowConn {
+	w.mu.Lock()
+	target := w.shadow
+	w.mu.Unlock()
+	if target == nil {
+		return nil
+	}
+	if rate := w.ShadowSampleRate; rate > 0 && rate < 1 && randomFloat64() >= rate {
+		return nil
+	}
+
+	s := &shadowConn{msgs: make(chan replayMessage, shadowQueueSize)}
+	dialer := w.dialer()
+	dialer.Subprotocols = subprotocols(req)
+	requestHeader = requestHeader.Clone()
+	go func() {
+		conn, _, err := dialer.Dial(target.String(), requestHeader)
+		if err != nil {
+			w.requestLogger(req).Debugf("websocketproxy: shadow server(%s) not available: %v", target.Host, err)
+			for range s.msgs {
+			}
+			return
+		}
+		defer conn.Close()
+
+		// Discard whatever the shadow answers.
+		go func() {
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+
+		failed := false
+		for m := range s.msgs {
+			if failed {
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(closeWriteTimeout))
+			if err := conn.WriteMessage(m.msgType, m.data); err != nil {
+				w.requestLogger(req).Debugf("websocketproxy: error when mirroring to shadow server(%s): %v", target.Host, err)
+				failed = true
+			}
+		}
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(closeWriteTimeout))
+	}()
+	return s
+}
+
+// send queues a message for the shadow, dropping it if the queue is full.
+func (s *shadowConn) send(msgType int, data []byte) {
+	select {
+	case s.msgs <- replayMessage{msgType, data}:
+	default:
+	}
+}
+
+// close ends the mirror once the proxied connection is done.
+func (s *shadowConn) close() {
+	close(s.msgs)
+}
@@ -0,0 +1,120 @@
+package websocketproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestShadowBackend(t *testing.T) {
+	mirrored := make(chan string, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, p, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			mirrored <- string(p)
+			// Answers of the shadow must never reach the client.
+			conn.WriteMessage(websocket.TextMessage, []byte("shadow"))
+		}
+	}))
+	defer shadow.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(shadow.URL, "http"))
+
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.SetShadowBackend(u)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+	for _, msg := range []string{"one", "two", "three"} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		_, p, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(p) != msg {
+			t.Errorf("expecting the primary echo %q, got: %q", msg, p)
+		}
+	}
+	for _, want := range []string{"one", "two", "three"} {
+		select {
+		case got := <-mirrored:
+			if got != want {
+				t.Errorf("expecting mirrored %q, got: %q", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expecting %q to be mirrored", want)
+		}
+	}
+}
+
+func TestShadowBackendDirector(t *testing.T) {
+	shadowURL, shadowHeaders := newHeaderBackend(t)
+	backendURL, headers := newHeaderBackend(t)
+
+	calls := 0
+	proxy := NewProxy()
+	proxy.AddBackendWithHeaders(backendURL, http.Header{"X-Api-Key": {"secret"}})
+	proxy.SetShadowBackend(shadowURL)
+	proxy.Director = func(incoming *http.Request, out http.Header) {
+		calls++
+		out.Set("X-Token", "token-"+strconv.Itoa(calls))
+	}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+	h := <-headers
+	var shadowed http.Header
+	select {
+	case shadowed = <-shadowHeaders:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expecting the shadow to be dialed")
+	}
+	if calls != 1 {
+		t.Errorf("expecting Director to run once per connection, got: %d", calls)
+	}
+	if got, want := shadowed.Get("X-Token"), h.Get("X-Token"); got != want {
+		t.Errorf("expecting the shadow to get the token of the backend %q, got: %q", want, got)
+	}
+	if got := shadowed.Get("X-Api-Key"); got != "" {
+		t.Errorf("expecting the shadow not to get the headers of the backend, got: %q", got)
+	}
+}
+
+func TestShadowBackendDown(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.SetShadowBackend(closedURL(t))
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, p, err := conn.ReadMessage(); err != nil || string(p) != "hello" {
+		t.Errorf("expecting the primary path to work without the shadow, got: %q, %v", p, err)
+	}
+}
@@ -0,0 +1,131 @@
+package websocketproxy
+
+import (
+	"net/url"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// BackendInfo is a snapshot of the state of one backend, as returned by
+// BackendStatus and passed to Selector.
+type BackendInfo struct {
+	// URL is the backend URL. It is nil for entries appended to Backends
+	// directly, whose URL depends on the request.
+	URL *url.URL
+
+	// Weight is the weight given to AddBackendWeighted and Protocols the
+	// subprotocols given to AddBackend, if any.
+	Weight    int
+	Protocols []string
+
+	// Healthy is false while the backend fails its health checks.
+	Healthy bool
+
+	// Draining is true between DrainBackend and UndrainBackend.
+	Draining bool
+
+	// Available reports whether the backend may receive new connections,
+	// that is it is healthy, not draining, not full, its circuit is not open
+	// and, if half-open, it has a probe to spare.
+	Available bool
+
+	// ActiveConns is the number of connections currently proxied to the
+	// backend and TotalConns the number proxied to it so far. MaxConns is
+	// the limit given to AddBackendWithLimit, zero if none.
+	ActiveConns int
+	TotalConns  int
+	MaxConns    int
+
+	// Load is the load score given to SetBackendLoad, decayed by the time
+	// elapsed since.
+	Load float64
+}
+
+// BackendStatus returns the state of every backend, in the order of
+// Backends. The result is a copy and may be kept or modified freely.
+func (w *WebsocketProxy) BackendStatus() []BackendInfo {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.syncBackends()
+	return w.backendStatus()
+}
+
+// backendStatus returns the state of every backend. Callers must hold mu.
+func (w *WebsocketProxy) backendStatus() []BackendInfo {
+	now := time.Now()
+	status := make([]BackendInfo, len(w.Backends))
+	for i := range status {
+		b := w.backends[i]
+		info := BackendInfo{
+			Weight:      b.weight,
+			Protocols:   append([]string(nil), b.protocols...),
+			Healthy:     !b.unhealthy,
+			Draining:    b.draining,
+			Available:   w.selectable(i),
+			ActiveConns: b.conns,
+			TotalConns:  b.served,
+			MaxConns:    b.maxConns,
+			Load:        w.currentLoad(b, now),
+		}
+		if b.target != nil {
+			u := *b.target
+			info.URL = &u
+		}
+		status[i] = info
+	}
+	return status
+}
+
+// ConnInfo is a snapshot of one active proxied connection, as returned by
+// ActiveConnections.
+type ConnInfo struct {
+	// ID identifies the connection for CloseConnection.
+	ID string
+
+	// ClientAddr is the remote address of the client, Backend the URL the
+	// connection is proxied to and Subprotocol the one agreed with the
+	// backend, if any.
+	ClientAddr  string
+	Backend     *url.URL
+	Subprotocol string
+
+	// ConnectedAt is when the client connection was upgraded.
+	ConnectedAt time.Time
+
+	// BytesFromClient and BytesFromBackend are the message payload bytes
+	// copied so far in each direction.
+	BytesFromClient  int64
+	BytesFromBackend int64
+}
+
+// ActiveConnections returns the connections currently proxied, oldest
+// first. The result is a copy and may be kept or modified freely.
+func (w *WebsocketProxy) ActiveConnections() []ConnInfo {
+	w.mu.Lock()
+	conns := make([]*proxyConn, 0, len(w.conns))
+	for pc := range w.conns {
+		conns = append(conns, pc)
+	}
+	w.mu.Unlock()
+
+	infos := make([]ConnInfo, len(conns))
+	for i, pc := range conns {
+		pc.mu.Lock()
+		u := *pc.backendURL
+		info := ConnInfo{
+			ID:               pc.id,
+			ClientAddr:       pc.client.RemoteAddr().String(),
+			Backend:          &u,
+			Subprotocol:      pc.backend.Subprotocol(),
+			ConnectedAt:      pc.start,
+			BytesFromClient:  atomic.LoadInt64(&pc.fromClient),
+			BytesFromBackend: atomic.LoadInt64(&pc.fromBackend),
+		}
+		pc.mu.Unlock()
+		infos[i] = info
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ConnectedAt.Before(infos[j].ConnectedAt) })
+	return infos
+}
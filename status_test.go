@@ -0,0 +1,197 @@
+package websocketproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestBackendStatus(t *testing.T) {
+	a := newEchoBackend(t)
+	b := newEchoBackend(t)
+
+	proxy := NewProxy()
+	proxy.AddBackend(a.url)
+	proxy.AddBackendWeighted(b.url, 3)
+	proxy.tripBackend(1, time.Hour)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+	dialProxy(t, s).Close()
+
+	status := proxy.BackendStatus()
+	if len(status) != 2 {
+		t.Fatalf("expecting 2 backends, got: %d", len(status))
+	}
+	if status[0].URL.String() != a.url.String() || !status[0].Available || status[0].TotalConns != 2 {
+		t.Errorf("unexpected status for first backend: %+v", status[0])
+	}
+	if status[0].ActiveConns < 1 {
+		t.Errorf("expecting an active connection on first backend, got: %d", status[0].ActiveConns)
+	}
+	if status[1].Weight != 3 || !status[1].Healthy || status[1].Available || status[1].TotalConns != 0 {
+		t.Errorf("unexpected status for tripped backend: %+v", status[1])
+	}
+
+	// The snapshot does not alias the proxy's state.
+	status[0].URL.Host = "changed"
+	if proxy.BackendStatus()[0].URL.Host == "changed" {
+		t.Error("expecting BackendStatus to return a copy")
+	}
+}
+
+func TestBackendStatusSetBackends(t *testing.T) {
+	a := newEchoBackend(t)
+	b := newEchoBackend(t)
+	c := newEchoBackend(t)
+
+	proxy := NewProxy()
+	proxy.AddBackendWeighted(a.url, 3)
+	proxy.AddBackend(b.url)
+	proxy.tripBackend(1, time.Hour)
+	proxy.SetBackends([]*url.URL{a.url, c.url})
+
+	status := proxy.BackendStatus()
+	if len(status) != 2 {
+		t.Fatalf("expecting 2 backends, got: %d", len(status))
+	}
+	if status[0].URL.String() != a.url.String() || status[0].Weight != 3 || !status[0].Available {
+		t.Errorf("expecting the kept backend to keep its weight, got: %+v", status[0])
+	}
+	if status[1].URL.String() != c.url.String() || status[1].Weight != 1 || !status[1].Available {
+		t.Errorf("expecting the new backend with a weight of 1, got: %+v", status[1])
+	}
+}
+
+func TestDrainBackend(t *testing.T) {
+	a := newEchoBackend(t)
+	b := newEchoBackend(t)
+
+	proxy := NewProxy()
+	proxy.AddBackend(a.url)
+	proxy.AddBackend(b.url)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	// One connection on each backend before draining.
+	c1 := dialProxy(t, s)
+	defer c1.Close()
+	c2 := dialProxy(t, s)
+	defer c2.Close()
+
+	if !proxy.DrainBackend(a.url) {
+		t.Fatal("expecting the backend to be found")
+	}
+	for i := 0; i < 4; i++ {
+		dialProxy(t, s).Close()
+	}
+	if n := a.Accepted(); n != 1 {
+		t.Errorf("expecting no new connection on the draining backend, got: %d", n-1)
+	}
+	status := proxy.BackendStatus()
+	if !status[0].Draining || status[0].Available || status[0].ActiveConns != 1 {
+		t.Errorf("unexpected status for draining backend: %+v", status[0])
+	}
+
+	// The connection proxied before draining still works.
+	for _, conn := range []*websocket.Conn{c1, c2} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "hello" {
+			t.Errorf("expecting the existing connection to keep working, got: %q, %v", msg, err)
+		}
+	}
+
+	proxy.UndrainBackend(a.url)
+	for i := 0; i < 2; i++ {
+		dialProxy(t, s).Close()
+	}
+	if n := a.Accepted(); n == 1 {
+		t.Error("expecting the undrained backend to be selected again")
+	}
+}
+
+func TestActiveConnections(t *testing.T) {
+	upgrader := websocket.Upgrader{Subprotocols: []string{"chat"}}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			msgType, p, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(msgType, p)
+		}
+	}))
+	defer backend.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(backend.URL, "http"))
+
+	proxy := NewProxy()
+	proxy.AddBackend(u)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	// waitConns waits for the proxy to list n connections.
+	waitConns := func(n int) []ConnInfo {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			conns := proxy.ActiveConnections()
+			if len(conns) == n {
+				return conns
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expecting %d connections, got: %d", n, len(conns))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	dialer := websocket.Dialer{Subprotocols: []string{"chat"}}
+	proxyURL := "ws" + strings.TrimPrefix(s.URL, "http")
+	first, _, err := dialer.Dial(proxyURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	waitConns(1)
+	second, _, err := dialer.Dial(proxyURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	first.WriteMessage(websocket.TextMessage, []byte("hello"))
+	first.ReadMessage()
+
+	conns := waitConns(2)
+	info := conns[0]
+	if info.ClientAddr != first.LocalAddr().String() {
+		t.Errorf("expecting the oldest connection first, got: %s", info.ClientAddr)
+	}
+	if info.Backend.Host != u.Host || info.Subprotocol != "chat" {
+		t.Errorf("expecting backend %s with subprotocol chat, got: %s %q", u.Host, info.Backend, info.Subprotocol)
+	}
+	if info.BytesFromClient != 5 || info.BytesFromBackend != 5 {
+		t.Errorf("expecting 5 bytes each way, got: %d and %d", info.BytesFromClient, info.BytesFromBackend)
+	}
+	if info.ConnectedAt.IsZero() || conns[1].ConnectedAt.Before(info.ConnectedAt) {
+		t.Error("expecting the connect times in order")
+	}
+
+	second.Close()
+	if conns := waitConns(1); conns[0].ID != info.ID {
+		t.Errorf("expecting the first connection to remain, got: %s", conns[0].ID)
+	}
+}
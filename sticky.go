@@ -0,0 +1,91 @@
+package websocketproxy
+
+import (
+	"hash/fnv"
+	"net/http"
+	"strconv"
+)
+
+// StickyMode selects how a client is pinned to a backend across
+// connections.
+type StickyMode int
+
+const (
+	// StickyNone disables session affinity. This is the default.
+	StickyNone StickyMode = iota
+
+	// StickyIPHash pins clients by hashing their IP address, taken from the
+	// remote address or, with TrustForwardedHeaders, from the first
+	// X-Forwarded-For entry. The mapping changes when backends are added or
+	// removed.
+	StickyIPHash
+
+	// StickyCookie pins clients with a cookie naming their backend, set on
+	// the handshake response and read on later handshakes. Only the reverse
+	// forward mode sets the cookie.
+	StickyCookie
+)
+
+// DefaultStickyCookieName is the cookie used by StickyCookie when
+// WebsocketProxy.StickyCookieName is empty.
+const DefaultStickyCookieName = "websocketproxy_backend"
+
+// stickyBackend returns the index of the backend req is pinned to, or -1 if
+// it is not pinned or the pinned backend is not selectable or does not speak
+// any of protocols. Callers must hold mu.
+func (w *WebsocketProxy) stickyBackend(req *http.Request, protocols []string) int {
+	if len(w.Backends) == 0 {
+		return -1
+	}
+
+	index := -1
+	switch w.StickyMode {
+	case StickyIPHash:
+		h := fnv.New32a()
+		h.Write([]byte(w.clientIP(req)))
+		index = int(h.Sum32() % uint32(len(w.Backends)))
+	case StickyCookie:
+		cookie, err := req.Cookie(w.stickyCookieName())
+		if err != nil {
+			return -1
+		}
+		for i := range w.Backends {
+			if stickyID(i, w.backends[i]) == cookie.Value {
+				index = i
+				break
+			}
+		}
+	}
+	if index < 0 || !w.selectable(index) || !w.backends[index].speaks(protocols) {
+		return -1
+	}
+	return index
+}
+
+// stickyCookie returns the affinity cookie pinning a client to b, selected
+// at index, or nil if StickyCookie is not enabled. It does not look b up
+// again, since the backends may have changed since it was selected.
+func (w *WebsocketProxy) stickyCookie(index int, b *backend) *http.Cookie {
+	if w.StickyMode != StickyCookie {
+		return nil
+	}
+	return &http.Cookie{Name: w.stickyCookieName(), Value: stickyID(index, b), HttpOnly: true}
+}
+
+// stickyID identifies b, the backend at index, in the affinity cookie. It
+// hashes the backend URL so it survives changes to the order of backends.
+func stickyID(index int, b *backend) string {
+	if b.target == nil {
+		return strconv.Itoa(index)
+	}
+	h := fnv.New32a()
+	h.Write([]byte(b.target.String()))
+	return strconv.FormatUint(uint64(h.Sum32()), 16)
+}
+
+func (w *WebsocketProxy) stickyCookieName() string {
+	if w.StickyCookieName == "" {
+		return DefaultStickyCookieName
+	}
+	return w.StickyCookieName
+}
@@ -0,0 +1,160 @@
+package websocketproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func newStickyProxy(mode StickyMode, n int) *WebsocketProxy {
+	proxy := NewProxy()
+	proxy.StickyMode = mode
+	for i := 0; i < n; i++ {
+		u, _ := url.Parse("ws://127.0.0.1:900" + strconv.Itoa(i))
+		proxy.AddBackend(u)
+	}
+	return proxy
+}
+
+func TestStickyIPHash(t *testing.T) {
+	proxy := newStickyProxy(StickyIPHash, 4)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.1.2.3:5555"
+	first, _ := proxy.selectBackend(req)
+	for i := 0; i < 20; i++ {
+		req.RemoteAddr = "10.1.2.3:" + strconv.Itoa(6000+i)
+		if index, _ := proxy.selectBackend(req); index != first {
+			t.Fatalf("expecting backend %d for the same client, got: %d", first, index)
+		}
+	}
+
+	// A pinned backend with an open circuit falls back to normal selection.
+	proxy.tripBackend(first, time.Hour)
+	if index, _ := proxy.selectBackend(req); index == first {
+		t.Errorf("expecting backend %d with open circuit to be skipped", first)
+	}
+}
+
+func TestStickyIPHashForwardedFor(t *testing.T) {
+	proxy := newStickyProxy(StickyIPHash, 4)
+
+	// A forged X-Forwarded-For cannot move the client to another backend.
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.1.2.3:5555"
+	first, _ := proxy.selectBackend(req)
+	for i := 0; i < 20; i++ {
+		req.Header.Set("X-Forwarded-For", "192.0.2."+strconv.Itoa(i))
+		if index, _ := proxy.selectBackend(req); index != first {
+			t.Fatalf("expecting backend %d whatever X-Forwarded-For says, got: %d", first, index)
+		}
+	}
+
+	// A trusted one identifies the client.
+	proxy.TrustForwardedHeaders = true
+	seen := map[int]bool{}
+	for i := 0; i < 20; i++ {
+		req.Header.Set("X-Forwarded-For", "192.0.2."+strconv.Itoa(i))
+		index, _ := proxy.selectBackend(req)
+		seen[index] = true
+	}
+	if len(seen) < 2 {
+		t.Error("expecting trusted X-Forwarded-For addresses to spread over backends")
+	}
+}
+
+func TestStickyCookie(t *testing.T) {
+	b1 := newEchoBackend(t)
+	b2 := newEchoBackend(t)
+
+	proxy := NewProxy()
+	proxy.StickyMode = StickyCookie
+	proxy.AddBackend(b1.url)
+	proxy.AddBackend(b2.url)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	proxyURL := "ws" + strings.TrimPrefix(s.URL, "http")
+	conn, resp, err := websocket.DefaultDialer.Dial(proxyURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == DefaultStickyCookieName {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatal("expecting an affinity cookie on the handshake response")
+	}
+
+	h := http.Header{}
+	h.Set("Cookie", cookie.String())
+	for i := 0; i < 4; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial(proxyURL, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+
+	n1, n2 := b1.Accepted(), b2.Accepted()
+	if n1 != 5 || n2 != 0 {
+		t.Errorf("expecting all connections on the first backend, got: %d/%d", n1, n2)
+	}
+}
+
+func TestStickyCookieBackendsChanged(t *testing.T) {
+	b := newEchoBackend(t)
+	handshaking := make(chan struct{}, 1)
+	upgrader := websocket.Upgrader{}
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handshaking <- struct{}{}
+		time.Sleep(100 * time.Millisecond)
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.ReadMessage()
+	}))
+	defer slow.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(slow.URL, "http"))
+
+	proxy := NewProxy()
+	proxy.StickyMode = StickyCookie
+	proxy.AddBackend(u)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	// The backends change while the selected one completes the handshake.
+	go func() {
+		<-handshaking
+		proxy.SetBackends([]*url.URL{b.url})
+	}()
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	want := stickyID(0, &backend{target: u})
+	var got string
+	for _, c := range resp.Cookies() {
+		if c.Name == DefaultStickyCookieName {
+			got = c.Value
+		}
+	}
+	if got != want {
+		t.Errorf("expecting the cookie of the backend dialed, %q, got: %q", want, got)
+	}
+}
@@ -0,0 +1,39 @@
+package websocketproxy
+
+import (
+	"io"
+
+	"github.com/gorilla/websocket"
+)
+
+// streamBufferSize is the size of the buffer copying messages under
+// StreamMessages, which bounds the memory used per message.
+const streamBufferSize = 32 * 1024
+
+// copyMessage copies the message read from r to a new message of msgType
+// on dst through buf and returns the number of bytes copied. Errors reading
+// r and writing dst are returned separately since the caller handles them
+// for different peers.
+func copyMessage(dst *websocket.Conn, msgType int, r io.Reader, buf []byte) (n int64, readErr, writeErr error) {
+	wr, err := dst.NextWriter(msgType)
+	if err != nil {
+		return 0, nil, err
+	}
+	for {
+		nr, err := r.Read(buf)
+		if nr > 0 {
+			nw, err := wr.Write(buf[:nr])
+			n += int64(nw)
+			if err != nil {
+				return n, nil, err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err, nil
+		}
+	}
+	return n, nil, wr.Close()
+}
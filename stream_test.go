@@ -0,0 +1,124 @@
+package websocketproxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestStreamMessages(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.StreamMessages = true
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+
+	// Several buffers worth, not a multiple of the buffer size.
+	payload := make([]byte, 5*streamBufferSize+123)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, payload); err != nil {
+		t.Fatal(err)
+	}
+	msgType, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgType != websocket.BinaryMessage || !bytes.Equal(msg, payload) {
+		t.Errorf("expecting the binary message echoed intact, got type %d and %d bytes", msgType, len(msg))
+	}
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "hello" {
+		t.Errorf("expecting the next message echoed, got: %q, %v", msg, err)
+	}
+}
+
+func TestStreamMessagesMaxMessageSize(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.StreamMessages = true
+	proxy.MaxMessageSize = 16
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("expecting close 1009, got: %v", err)
+	}
+}
+
+// BenchmarkLargeMessage reports the allocations of proxying a 10MB message
+// from the client to a backend discarding it, with and without
+// StreamMessages.
+func BenchmarkLargeMessage(b *testing.B) {
+	upgrader := websocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, r, err := conn.NextReader()
+			if err != nil {
+				return
+			}
+			io.Copy(io.Discard, r)
+			conn.WriteMessage(websocket.TextMessage, []byte("ok"))
+		}
+	}))
+	defer backend.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(backend.URL, "http"))
+	payload := make([]byte, 10<<20)
+
+	for _, stream := range []bool{false, true} {
+		name := "ReadMessage"
+		if stream {
+			name = "Stream"
+		}
+		b.Run(name, func(b *testing.B) {
+			proxy := NewProxy()
+			proxy.AddBackend(u)
+			proxy.StreamMessages = stream
+			s := httptest.NewServer(proxy)
+			defer s.Close()
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := conn.WriteMessage(websocket.BinaryMessage, payload); err != nil {
+					b.Fatal(err)
+				}
+				if _, _, err := conn.ReadMessage(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package websocketproxy
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// templateVar matches a {name} placeholder of a backend URL template.
+var templateVar = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// templateMarker stands in for the placeholders when a template is checked.
+const templateMarker = "templatevar"
+
+// AddBackendTemplate appends a backend whose URL is built from tmpl for each
+// request, for example "ws://host/ws/{X-Tenant}". A {name} placeholder is
+// replaced by the request header name or, if it is not set, the query
+// parameter name, escaped for use in a path or, after the '?', in a query.
+// Placeholders are only allowed in the path and the query, so clients
+// cannot choose the host dialed. The query of the incoming request is added
+// to the one of the template. If a placeholder has no value, the backend is
+// skipped for that request.
+func (w *WebsocketProxy) AddBackendTemplate(tmpl string) error {
+	u, err := url.Parse(templateVar.ReplaceAllString(tmpl, templateMarker))
+	if err != nil {
+		return err
+	}
+	if strings.Contains(u.Scheme, templateMarker) || strings.Contains(u.Host, templateMarker) ||
+		u.User != nil && strings.Contains(u.User.String(), templateMarker) {
+		return errTemplateAuthority
+	}
+	query := strings.Index(tmpl, "?")
+	backendFunc := func(r *http.Request) *url.URL {
+		missing := false
+		var sb strings.Builder
+		last := 0
+		for _, m := range templateVar.FindAllStringSubmatchIndex(tmpl, -1) {
+			v := templateValue(r, tmpl[m[2]:m[3]])
+			if v == "" {
+				missing = true
+			}
+			sb.WriteString(tmpl[last:m[0]])
+			if query >= 0 && m[0] > query {
+				sb.WriteString(url.QueryEscape(v))
+			} else {
+				sb.WriteString(url.PathEscape(v))
+			}
+			last = m[1]
+		}
+		sb.WriteString(tmpl[last:])
+		s := sb.String()
+		if missing {
+			return nil
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil
+		}
+		if u.RawQuery == "" || r.URL.RawQuery == "" {
+			u.RawQuery += r.URL.RawQuery
+		} else {
+			u.RawQuery += "&" + r.URL.RawQuery
+		}
+		return u
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.syncBackends()
+	w.Backends = append(w.Backends, backendFunc)
+	w.backends = append(w.backends, &backend{url: backendFunc, weight: 1})
+	return nil
+}
+
+// templateValue returns the value of the placeholder name for r.
+func templateValue(r *http.Request, name string) string {
+	if v := r.Header.Get(name); v != "" {
+		return v
+	}
+	return r.URL.Query().Get(name)
+}
@@ -0,0 +1,85 @@
+package websocketproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAddBackendTemplate(t *testing.T) {
+	proxy := NewProxy()
+	if err := proxy.AddBackendTemplate("ws://backend:9001/ws/{X-Tenant}?region={region}"); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/chat?region=eu&room=1", nil)
+	req.Header.Set("X-Tenant", "acme corp")
+	want := "ws://backend:9001/ws/acme%20corp?region=eu&region=eu&room=1"
+	if got := proxy.Backends[0](req).String(); got != want {
+		t.Errorf("expecting %s, got: %s", want, got)
+	}
+
+	if err := proxy.AddBackendTemplate("ws://{host"); err == nil {
+		t.Error("expecting an invalid template to be rejected")
+	}
+}
+
+func TestBackendTemplateMissingVariable(t *testing.T) {
+	proxy := NewProxy()
+	proxy.ForwardMode = RedirectForwardMode
+	proxy.AddBackendTemplate("ws://backend:9001/ws/{X-Tenant}")
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, newHandshakeRequest("/"))
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("expecting status %d without a tenant, got: %d", http.StatusServiceUnavailable, rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	req := newHandshakeRequest("/")
+	req.Header.Set("X-Tenant", "acme")
+	proxy.ServeHTTP(rw, req)
+	if loc := rw.Header().Get("Location"); loc != "ws://backend:9001/ws/acme" {
+		t.Errorf("expecting the tenant backend, got: %d %s", rw.Code, loc)
+	}
+}
+
+func TestBackendTemplateFallsThrough(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackendTemplate("ws://backend.invalid/ws/{X-Tenant}")
+	proxy.AddBackend(b.url)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	// Without a tenant the template backend is skipped.
+	dialProxy(t, s).Close()
+	if proxy.BackendStatus()[0].Available != true {
+		t.Error("expecting a skipped template backend to stay available")
+	}
+}
+
+func TestBackendTemplateInjection(t *testing.T) {
+	proxy := NewProxy()
+	if err := proxy.AddBackendTemplate("ws://backend:9001/ws/{tenant}?region={region}"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A value cannot add query parameters nor change the host.
+	req := httptest.NewRequest("GET", "/chat", nil)
+	req.Header.Set("Tenant", "evil.com:80@x")
+	req.Header.Set("Region", "eu&admin=1")
+	u := proxy.Backends[0](req)
+	if u.Host != "backend:9001" {
+		t.Errorf("expecting the template host, got: %s", u.Host)
+	}
+	if q := u.Query(); q.Get("region") != "eu&admin=1" || q.Get("admin") != "" {
+		t.Errorf("expecting the value escaped in the query, got: %s", u.RawQuery)
+	}
+
+	for _, tmpl := range []string{"ws://{host}/ws", "ws://backend-{host}:9001/ws", "{scheme}://backend/ws", "ws://{user}@backend/ws"} {
+		if err := proxy.AddBackendTemplate(tmpl); err != errTemplateAuthority {
+			t.Errorf("%s: expecting %v, got: %v", tmpl, errTemplateAuthority, err)
+		}
+	}
+}
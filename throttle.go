@@ -0,0 +1,119 @@
+package websocketproxy
+
+import (
+	"time"
+)
+
+// ThrottlePolicy selects what happens to a client exceeding MaxFramesPerSec
+// or MaxBytesPerSec.
+type ThrottlePolicy int
+
+const (
+	// ThrottlePause stops reading from the client until its rate is back
+	// under the limit, which slows a flooding client down through TCP flow
+	// control. This is the default.
+	ThrottlePause ThrottlePolicy = iota
+
+	// ThrottleClose closes the connection with a policy violation (1008).
+	ThrottleClose
+)
+
+// tokenBucket allows rate units per second with bursts of one second's
+// worth. Units taken beyond the bucket are owed and delay the next ones.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: rate, last: now}
+}
+
+// take takes n units at now and returns how long to wait before the bucket
+// is out of debt again.
+func (b *tokenBucket) take(n float64, now time.Time) time.Duration {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// throttle applies MaxFramesPerSec and MaxBytesPerSec to the messages of a
+// client.
+type throttle struct {
+	frames *tokenBucket
+	bytes  *tokenBucket
+	policy ThrottlePolicy
+	done   chan struct{}
+}
+
+// newThrottle returns the throttle of a new connection, or nil if no limit
+// is set.
+func (w *WebsocketProxy) newThrottle() *throttle {
+	if w.MaxFramesPerSec <= 0 && w.MaxBytesPerSec <= 0 {
+		return nil
+	}
+	now := time.Now()
+	t := &throttle{policy: w.ThrottlePolicy, done: make(chan struct{})}
+	if w.MaxFramesPerSec > 0 {
+		t.frames = newTokenBucket(w.MaxFramesPerSec, now)
+	}
+	if w.MaxBytesPerSec > 0 {
+		t.bytes = newTokenBucket(w.MaxBytesPerSec, now)
+	}
+	return t
+}
+
+// hook returns a message hook applying the throttle before next, which may
+// be nil.
+func (t *throttle) hook(next func(int, []byte) (int, []byte, error)) func(int, []byte) (int, []byte, error) {
+	return func(msgType int, data []byte) (int, []byte, error) {
+		if err := t.wait(len(data)); err != nil {
+			return msgType, data, err
+		}
+		if next == nil {
+			return msgType, data, nil
+		}
+		return next(msgType, data)
+	}
+}
+
+// wait accounts for a message of n bytes and, under ThrottlePause, waits
+// until it may be forwarded or stop is called.
+func (t *throttle) wait(n int) error {
+	now := time.Now()
+	var delay time.Duration
+	if t.frames != nil {
+		delay = t.frames.take(1, now)
+	}
+	if t.bytes != nil {
+		if d := t.bytes.take(float64(n), now); d > delay {
+			delay = d
+		}
+	}
+	if delay == 0 {
+		return nil
+	}
+	if t.policy == ThrottleClose {
+		return errThrottled
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-t.done:
+	}
+	return nil
+}
+
+// stop ends any wait so the connection can be torn down.
+func (t *throttle) stop() {
+	close(t.done)
+}
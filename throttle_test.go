@@ -0,0 +1,93 @@
+package websocketproxy
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(10, now)
+	for i := 0; i < 10; i++ {
+		if d := b.take(1, now); d != 0 {
+			t.Fatalf("expecting a burst of 10, got a delay of %s at %d", d, i)
+		}
+	}
+	if d := b.take(1, now); d != 100*time.Millisecond {
+		t.Errorf("expecting a delay of 100ms past the burst, got: %s", d)
+	}
+	if d := b.take(1, now.Add(time.Second)); d != 0 {
+		t.Errorf("expecting the bucket to refill, got: %s", d)
+	}
+}
+
+// echoMessages sends n messages through conn and reads their echoes.
+func echoMessages(conn *websocket.Conn, n int) error {
+	for i := 0; i < n; i++ {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte("x")); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < n; i++ {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestThrottlePause(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.MaxFramesPerSec = 50
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	polite := dialProxy(t, s)
+	defer polite.Close()
+	start := time.Now()
+	if err := echoMessages(polite, 5); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("expecting a client within the limit not to be slowed down, took: %s", d)
+	}
+
+	flooding := dialProxy(t, s)
+	defer flooding.Close()
+	start = time.Now()
+	if err := echoMessages(flooding, 100); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 800*time.Millisecond {
+		t.Errorf("expecting a flooding client to be slowed down to 50 messages per second, took: %s", d)
+	}
+}
+
+func TestThrottleClose(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.MaxBytesPerSec = 1000
+	proxy.ThrottlePolicy = ThrottleClose
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	conn.WriteMessage(websocket.BinaryMessage, make([]byte, 600))
+	conn.WriteMessage(websocket.BinaryMessage, make([]byte, 600))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Errorf("expecting a policy violation close, got: %v", err)
+			}
+			return
+		}
+	}
+}
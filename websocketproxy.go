@@ -2,14 +2,18 @@
 package websocketproxy
 
 import (
-	"log"
+	"crypto/tls"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"runtime/debug"
 	"strings"
 	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
-    "math/rand"
 
 	"github.com/gorilla/websocket"
 )
@@ -25,11 +29,41 @@ var (
 	// DefaultDialer is a dialer with all fields set to the default zero values.
 	DefaultDialer = websocket.DefaultDialer
 
-	// DefaultForwardMode default mode
-	DefaultForwardMode = 0
+	errNoBackend          = errors.New("No backend available")
+	errTooManyConnections = errors.New("Too many connections")
+	errRateLimited        = errors.New("Connection rate limit exceeded")
+	errOriginNotAllowed   = errors.New("Origin not allowed")
+	errNotWebSocket       = errors.New("Not a WebSocket handshake")
+	errNoBackendURL       = errors.New("Backend has no URL for the request")
+	errHealthCheckStopped = errors.New("Health check not running")
+	errThrottled          = errors.New("Message rate limit exceeded")
+	errShuttingDown       = errors.New("Proxy is shutting down")
+	errHTTP2              = errors.New("WebSocket over HTTP/2 (RFC 8441) is not supported, connect with HTTP/1.1")
+	errSubprotocol        = errors.New("Backend selected a subprotocol the client cannot use")
+	errProxyProtocol      = errors.New("Invalid PROXY protocol header")
+	errUnsupportedVersion = errors.New("Unsupported WebSocket version")
+	errBackendRedirect    = errors.New("Backend redirected the handshake")
+	errBackendProxyScheme = errors.New("Unsupported BackendProxyURL scheme, use http or socks5")
+	errTemplateAuthority  = errors.New("Backend URL template placeholders are only allowed in the path and query")
+)
+
+// retryAfter is the Retry-After value, in seconds, sent with 503 and 429
+// responses.
+const retryAfter = "1"
+
+const (
+	// ReverseForwardMode dials the selected backend and copies frames between
+	// the client and the backend. This is the default mode.
+	ReverseForwardMode = iota
 
-	// RedirectForwardMode default mode
-	RedirectForwardMode = 1
+	// RedirectForwardMode answers the handshake with a 307 Temporary Redirect
+	// to the selected backend so the client connects to it directly. The
+	// Location keeps the backend's scheme (ws or wss) and host together with
+	// the path and query of the incoming request.
+	RedirectForwardMode
+
+	// DefaultForwardMode is the mode used by NewProxy.
+	DefaultForwardMode = ReverseForwardMode
 )
 
 // WebsocketProxy is an HTTP Handler that takes an incoming WebSocket
@@ -37,28 +71,484 @@ var (
 type WebsocketProxy struct {
 	// Director, if non-nil, is a function that may copy additional request
 	// headers from the incoming WebSocket connection into the output headers
-	// which will be forwarded to another server.
+	// which will be forwarded to another server. It runs last, after
+	// ForwardHeaders and StripHeaders have been applied.
 	Director func(incoming *http.Request, out http.Header)
 
 	// Backend returns the backend URL which the proxy uses to reverse proxy
 	// the incoming WebSocket connection. Request is the initial incoming and
-	// unmodified request.
+	// unmodified request. It is guarded by mu: once the proxy serves
+	// requests, change it only through AddBackend, RemoveBackend,
+	// SetBackends and the like, which are safe to call concurrently with
+	// ServeHTTP.
 	Backends []func(*http.Request) *url.URL
 
 	// Upgrader specifies the parameters for upgrading a incoming HTTP
 	// connection to a WebSocket connection. If nil, DefaultUpgrader is used.
+	// If its Subprotocols are set, the subprotocol selected by the backend
+	// must be one of them or the connection fails with 502 Bad Gateway.
 	Upgrader *websocket.Upgrader
 
 	//  Dialer contains options for connecting to the backend WebSocket server.
 	//  If nil, DefaultDialer is used.
 	Dialer *websocket.Dialer
 
+	// ReqCount counts backend selections. It is guarded by mu.
 	ReqCount int
 
-	DesolateBackend map[int]int
+	// FailureThreshold is the number of consecutive failed dials after
+	// which a backend is skipped for CooldownDuration. Once the cooldown is
+	// over a single dial probes the backend again. If zero,
+	// DefaultFailureThreshold and DefaultCooldownDuration are used.
+	FailureThreshold int
+	CooldownDuration time.Duration
+
+	// CooldownJitter, if non-zero, lengthens every cooldown by a random
+	// duration of up to CooldownJitter, so that proxies which saw the same
+	// backend fail do not all probe it again at the same moment.
+	CooldownJitter time.Duration
 
-	//  ForwardMode if set 0 reverse mode, set 1 http redirect mode
+	// HalfOpenMaxProbes is the number of connections let through to a
+	// backend once its cooldown is over, until one of them tells whether
+	// it recovered. The others skip the backend meanwhile, so that it is
+	// not overwhelmed right after recovering. DefaultHalfOpenMaxProbes is
+	// used if zero.
+	HalfOpenMaxProbes int
+
+	// BackendErrorStatus is the status answered when no backend could be
+	// reached, as opposed to a failed upgrade of the client connection.
+	// DefaultBackendErrorStatus is used if zero.
+	BackendErrorStatus int
+
+	// ForwardMode selects how incoming connections reach the backend, either
+	// ReverseForwardMode or RedirectForwardMode.
 	ForwardMode int
+
+	// Strategy is the algorithm used to pick a backend. The zero value is
+	// RoundRobin.
+	Strategy Strategy
+
+	// Selector, if non-nil, replaces Strategy. It is given the handshake
+	// request, nil when there is none, and the state of every backend, in
+	// the order of Backends, and returns the index of the backend for a new
+	// connection, or -1 to reject it as if no backend was available. A
+	// backend that is not Available or lacks the subprotocols requested by
+	// the client is rejected the same way. StickyMode still applies first.
+	// Selector is called with the proxy locked and must not call its
+	// methods.
+	Selector func(req *http.Request, backends []BackendInfo) int
+
+	// HashKey, if non-nil, returns the key a request is hashed by with the
+	// ConsistentHash strategy. The default key is the request path.
+	HashKey func(req *http.Request) string
+
+	// LoadHalfLife is the time after which a load score given to
+	// SetBackendLoad counts half, so backends whose controller stopped
+	// reporting drift back to idle. If zero, DefaultLoadHalfLife is used.
+	LoadHalfLife time.Duration
+
+	// RewritePath, if non-nil, returns the path, optionally followed by
+	// "?" and a query, requested from the backend for the incoming URL in.
+	// It replaces the path and query of the backend URL entirely. By
+	// default the incoming path is joined to the backend's base path and
+	// the queries of both are merged.
+	RewritePath func(in *url.URL) string
+
+	// Router, if non-nil, picks the backend URL for a request, for example
+	// from its path. The returned URL is dialed as is, bypassing the
+	// balancer: health checks, circuit breakers and StickyMode do not apply
+	// and there is no failover if the dial fails. If Router returns nil, the
+	// backend is selected from Backends as usual.
+	Router func(req *http.Request) *url.URL
+
+	// RewriteBackendURL, if non-nil, is called with the URL of the backend
+	// selected for req before it is dialed, and returns the URL to dial
+	// instead, for example with a token added to its query. selected is a
+	// copy that may be modified and returned. Returning nil skips the
+	// backend as if it had no URL for req, and the next one is tried. It
+	// does not apply to URLs returned by Router.
+	RewriteBackendURL func(req *http.Request, selected *url.URL) *url.URL
+
+	// MaxBackendRedirects is the number of 3xx redirects followed when a
+	// backend answers the handshake with one, with http and https
+	// locations dialed as ws and wss. The backend it was selected from
+	// keeps its health and connection counts. A redirect to another host
+	// drops the backend's own headers and Host along with the
+	// Authorization, Cookie and Proxy-Authorization headers. If zero, the
+	// default, redirects are not followed: a redirect, or one too many,
+	// counts as a failed dial and the next backend is tried.
+	MaxBackendRedirects int
+
+	// FanOutBackends, if set, connects every client to all of these
+	// backends at once instead of balancing it to one of them, for pub/sub
+	// protocols. Each client message is sent to all of them and their
+	// messages are merged back to the client. A backend that cannot be
+	// dialed or leaves is dropped while the others carry on, and the client
+	// is closed once none is left. IdleTimeout, MaxConnLifetime,
+	// MaxMessageSize, WriteTimeout, OnConnClose and the connection metrics
+	// apply as to other connections, reported for the first backend.
+	// Message hooks, AllowedMessageTypes, throttling, StreamMessages,
+	// ForwardPings, replay, failover, BackendReconnectGrace and shadowing
+	// do not apply to fan-out connections.
+	FanOutBackends []*url.URL
+
+	// StickyMode pins clients to the same backend across connections. A
+	// pinned backend that is unhealthy or skipped after failures is
+	// ignored and the Strategy picks another one.
+	StickyMode StickyMode
+
+	// StickyCookieName is the cookie used by StickyCookie. If empty,
+	// DefaultStickyCookieName is used.
+	StickyCookieName string
+
+	// OnBackendDown, if non-nil, is called with the backend URL and the error
+	// whenever dialing a backend or checking its health fails.
+	OnBackendDown func(backend *url.URL, err error)
+
+	// OnBackendUp, if non-nil, is called when a backend for which
+	// OnBackendDown was called is reachable again.
+	OnBackendUp func(backend *url.URL)
+
+	// OnProxyError, if non-nil, is called when an incoming request cannot be
+	// proxied, for example because no backend is available or the upgrade
+	// failed.
+	OnProxyError func(req *http.Request, err error)
+
+	// ErrorHandler, if non-nil, writes every error response sent to clients
+	// instead of the built-in plain text ones. err is a *StatusError holding
+	// the default status and the reason. Headers such as Retry-After are set
+	// on rw before ErrorHandler is called.
+	ErrorHandler func(rw http.ResponseWriter, req *http.Request, err error)
+
+	// OnConnClose, if non-nil, is called with the statistics of every
+	// proxied connection once both of its sides are closed.
+	OnConnClose func(stats ConnStats)
+
+	// ShadowSampleRate is the fraction, between 0 and 1, of connections
+	// whose client messages are mirrored to the backend given to
+	// SetShadowBackend. If zero, every connection is mirrored.
+	ShadowSampleRate float64
+
+	// RequestIDHeader is the header carrying the ID of a request, forwarded
+	// to the backend and prefixed to the log messages about the request. It
+	// is also available to callbacks through RequestID and in ConnStats. If
+	// empty, DefaultRequestIDHeader is used.
+	RequestIDHeader string
+
+	// GenerateRequestID assigns a random ID to requests that have none in
+	// RequestIDHeader.
+	GenerateRequestID bool
+
+	// MaxFramesPerSec and MaxBytesPerSec, if non-zero, limit the rate of
+	// messages and payload bytes each client may send, with bursts of one
+	// second's worth. ThrottlePolicy selects whether a client exceeding them
+	// is paused or disconnected.
+	MaxFramesPerSec float64
+	MaxBytesPerSec  float64
+	ThrottlePolicy  ThrottlePolicy
+
+	// AllowedMessageTypes restricts the data messages clients may send, for
+	// backends that only accept text or binary messages. A client sending
+	// another type is closed with 1003 (unsupported data) instead of having
+	// its message forwarded.
+	AllowedMessageTypes MessageTypes
+
+	// NonUpgradeHandler, if non-nil, serves the requests that are not a
+	// WebSocket handshake, for example a health page on the same port.
+	// Otherwise they are answered with 426 Upgrade Required.
+	NonUpgradeHandler http.Handler
+
+	// OnClientMessage, if non-nil, is called with every message read from
+	// the client before it is forwarded to the backend. The returned type and
+	// data are forwarded instead, a non-nil error closes the connection.
+	OnClientMessage func(msgType int, data []byte) (int, []byte, error)
+
+	// OnBackendMessage is like OnClientMessage for messages read from the
+	// backend.
+	OnBackendMessage func(msgType int, data []byte) (int, []byte, error)
+
+	// Logger receives the log messages of the proxy. If nil, messages are
+	// written with the standard log package.
+	Logger Logger
+
+	// LogHandshakes logs every backend handshake at debug level: the
+	// selected backend, the URL dialed, the request headers sent, the
+	// negotiated subprotocol and the response status. The headers may
+	// carry credentials, so only enable it while debugging.
+	LogHandshakes bool
+
+	// AllowedOrigins, if non-empty, lists the origins browsers may connect
+	// from, for example "https://app.example.com" or "*.example.com". An
+	// entry without a scheme matches any scheme and "*." matches any
+	// subdomain. Handshakes from other origins are rejected with 403 before
+	// a backend is dialed. A CheckOrigin set on Upgrader always wins over
+	// AllowedOrigins.
+	AllowedOrigins []string
+
+	// EnableCompression negotiates permessage-deflate (RFC 7692) on both
+	// the client and the backend connection, so that both agree: the
+	// backend is only offered compression if the client asked for it, and
+	// the client only gets it if the backend accepted it. Other extensions
+	// are never negotiated, and the connections fall back to uncompressed
+	// frames if either peer does not support compression. A backend reached
+	// by failover negotiates on its own.
+	EnableCompression bool
+
+	// ReadBufferSize and WriteBufferSize, if non-zero, set the I/O buffer
+	// sizes of both the client and the backend connections, unless Upgrader
+	// or Dialer is set. Matching sizes on both sides avoid extra copying of
+	// large messages.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// WriteBufferPool, if non-nil, is used for the write buffers of both
+	// the client and the backend connections unless Upgrader or Dialer set
+	// their own. Without a pool every connection holds its write buffers
+	// for its whole lifetime; with one, a buffer is only held while a
+	// message is written, which saves most of that memory when many
+	// connections sit idle, at the cost of taking a buffer from the pool
+	// for every message. A *sync.Pool can be used as is.
+	WriteBufferPool websocket.BufferPool
+
+	// DialTimeout bounds the whole backend handshake unless Dialer sets its
+	// own HandshakeTimeout. A backend exceeding it counts as a failed dial,
+	// which opens its circuit, and the next backend is tried. If zero,
+	// DefaultDialTimeout is used.
+	DialTimeout time.Duration
+
+	// UpgradeTimeout bounds the client handshake, which happens after the
+	// backend was dialed, so a client stalling in it cannot hold a backend
+	// connection. If zero, the HandshakeTimeout of Upgrader is used or, if
+	// that is zero too, DefaultUpgradeTimeout.
+	UpgradeTimeout time.Duration
+
+	// ConnectTimeout, if non-zero, bounds the time spent establishing the
+	// TCP connection to a backend.
+	ConnectTimeout time.Duration
+
+	// KeepAlive, if non-zero, is the TCP keep-alive period of backend
+	// connections, so half-open connections to vanished backends are
+	// detected by the operating system.
+	KeepAlive time.Duration
+
+	// BackendLocalAddr, if set, is the local address backend connections
+	// are made from, for example a source IP allowed by a network policy.
+	// Its port is usually left zero to pick any.
+	//
+	// ConnectTimeout, KeepAlive and BackendLocalAddr are ignored if Dialer
+	// sets its own NetDial or NetDialContext.
+	BackendLocalAddr *net.TCPAddr
+
+	// BackendProxyURL, if set, routes backend connections through the given
+	// outbound proxy, for backends only reachable through one. The http
+	// and socks5 schemes are supported, with credentials taken from the
+	// URL's user info. Any other scheme fails every handshake with a 500
+	// before a backend is dialed. It replaces the Proxy of Dialer.
+	BackendProxyURL *url.URL
+
+	// Metrics receives the connection metrics of the proxy. If nil, metrics
+	// are not collected.
+	Metrics Metrics
+
+	// ForwardedHeaderMode selects the headers telling the backend about the
+	// client: X-Forwarded-For and X-Forwarded-Proto by default, the RFC 7239
+	// Forwarded header, both or none.
+	ForwardedHeaderMode ForwardedHeaderMode
+
+	// TrustForwardedHeaders passes the X-Forwarded-For, X-Forwarded-Proto,
+	// X-Forwarded-Host and Forwarded headers of the incoming request to the
+	// backend untouched, instead of adding the ones selected by
+	// ForwardedHeaderMode. Only enable it when the proxy is reachable solely
+	// through a trusted proxy that sets these headers, since clients can
+	// otherwise forge their address and protocol.
+	TrustForwardedHeaders bool
+
+	// ForwardHeaders lists additional headers copied verbatim from the
+	// incoming request to the backend handshake, next to Origin,
+	// Sec-WebSocket-Protocol, Cookie and the headers selected by
+	// ForwardedHeaderMode that are always forwarded. Headers managed by the
+	// WebSocket handshake itself, such as Sec-WebSocket-Key, are never
+	// copied.
+	ForwardHeaders []string
+
+	// StripHeaders lists headers removed from the backend handshake even if
+	// they are forwarded by default or listed in ForwardHeaders. Director
+	// runs after StripHeaders and may still set any of them.
+	StripHeaders []string
+
+	// ForwardResponseHeaders lists headers of the backend's handshake
+	// response passed on to the client's handshake response, next to
+	// Sec-WebSocket-Protocol and Set-Cookie that are always passed on.
+	ForwardResponseHeaders []string
+
+	// MaxConnections, if non-zero, limits the number of connections proxied
+	// at the same time. Handshakes beyond the limit are rejected with 503
+	// Service Unavailable and a Retry-After header.
+	MaxConnections int
+
+	// IdleTimeout, if non-zero, closes a proxied connection when either peer
+	// stays silent for longer than the timeout. Both peers are pinged every
+	// half IdleTimeout, so a live peer keeps the connection open by answering
+	// with a pong even when no messages are exchanged.
+	IdleTimeout time.Duration
+
+	// ForwardPings passes ping and pong frames, with their payload, from
+	// each peer to the other instead of answering pings in the proxy, so
+	// heartbeats of the application pass through end to end. By default the
+	// proxy answers pings itself and drops pongs.
+	ForwardPings bool
+
+	// MaxConnLifetime, if non-zero, closes proxied connections older than
+	// about this duration, so clients reconnect and get spread over
+	// backends added in between. Each connection closes up to a tenth
+	// earlier, at random, so that connections opened together do not all
+	// reconnect at once. LifetimeCloseCode and LifetimeCloseReason are
+	// sent to both peers then. If the code is zero, 1001 (going away) is
+	// sent with LifetimeCloseReason, or DefaultLifetimeCloseReason if that
+	// is empty too.
+	MaxConnLifetime     time.Duration
+	LifetimeCloseCode   int
+	LifetimeCloseReason string
+
+	// ConnDeadline, if non-nil, is called with the request of every proxied
+	// connection and returns when to close it, for example when the token
+	// that authorized it expires. ConnDeadlineCloseCode is sent to both
+	// peers then, DefaultConnDeadlineCloseCode if zero. A zero time leaves
+	// the connection open. It applies to FanOutBackends connections too.
+	ConnDeadline          func(req *http.Request) time.Time
+	ConnDeadlineCloseCode int
+
+	// RebalanceInterval is the period at which Rebalance closes its next
+	// batch of connections. If zero, DefaultRebalanceInterval is used.
+	// RebalanceCloseCode and RebalanceCloseReason are sent to both peers of
+	// the connections it closes, with the same defaults as for
+	// MaxConnLifetime and DefaultRebalanceCloseReason.
+	RebalanceInterval    time.Duration
+	RebalanceCloseCode   int
+	RebalanceCloseReason string
+
+	// ShutdownCloseCode and ShutdownCloseReason are the close code and
+	// reason sent to both peers of the connections closed by Shutdown, for
+	// example so clients can tell maintenance from an error. If the code
+	// is zero, DefaultShutdownCloseCode is sent with ShutdownCloseReason,
+	// or DefaultShutdownCloseReason if that is empty too. They only cover
+	// Shutdown, the other closes initiated by the proxy have their own.
+	ShutdownCloseCode   int
+	ShutdownCloseReason string
+
+	// MaxMessageSize, if non-zero, is the largest message in bytes accepted
+	// from either peer. A larger message closes the connection with 1009
+	// (message too big) sent to both peers.
+	MaxMessageSize int64
+
+	// StreamMessages copies each message frame by frame through a buffer of
+	// streamBufferSize bytes instead of reading it whole first, so large
+	// messages do not need their full size in memory. A direction with
+	// OnClientMessage, OnBackendMessage, MaxFramesPerSec, MaxBytesPerSec,
+	// ReplayEarlyMessages or SetShadowBackend in effect still reads whole
+	// messages, since those need them.
+	StreamMessages bool
+
+	// WriteTimeout, if non-zero, bounds the time spent writing a message to
+	// either peer. A peer not reading fast enough closes the connection.
+	WriteTimeout time.Duration
+
+	// MaxRetries is the number of extra passes over the backends made when
+	// none of them accepted the connection, waiting RetryBackoff before the
+	// first retry and twice as long before each next one. The default of
+	// zero makes a single pass.
+	MaxRetries   int
+	RetryBackoff time.Duration
+
+	// ReplayEarlyMessages, if non-zero, lets a connection fail over to
+	// another backend when its backend drops without a close frame within
+	// ReplayWindow of the handshake, or DefaultReplayWindow if zero. Up to
+	// ReplayEarlyMessages client messages are kept and sent again to the
+	// new backend; a session that sent more cannot fail over. Only enable
+	// it for protocols where replaying these messages is safe.
+	ReplayEarlyMessages int
+	ReplayWindow        time.Duration
+
+	// ResumeOnBackendFailure moves a connection to another backend whenever
+	// its backend drops without a close frame, at any time in the session,
+	// and only closes the client if no backend is left. The client is not
+	// told. Messages in flight to or from the failed backend are lost and,
+	// beyond what ReplayEarlyMessages replays within its window, the new
+	// backend knows nothing of the session. Only enable it for stateless
+	// backends, where any backend can serve any message.
+	ResumeOnBackendFailure bool
+
+	// BackendReconnectGrace, if non-zero, implies ResumeOnBackendFailure
+	// and lets a connection whose backend dropped wait up to this long for
+	// a backend to come back, for example while the only backend restarts,
+	// before the client is closed. Client messages are held meanwhile. As
+	// with ResumeOnBackendFailure, only enable it for stateless backends.
+	BackendReconnectGrace time.Duration
+
+	// ConnRateLimit, if its Rate is non-zero, limits how fast a single
+	// client IP, taken from the remote address or, with
+	// TrustForwardedHeaders, from X-Forwarded-For, may open connections. Handshakes beyond the limit are rejected with 429 Too
+	// Many Requests and a Retry-After header.
+	ConnRateLimit RateLimit
+
+	// TrustProxyProtocol makes WrapListener read the PROXY protocol header
+	// sent by an L4 load balancer to learn the real client address. Only
+	// enable it if every connection comes through such a load balancer,
+	// since anyone able to connect directly could claim any address.
+	TrustProxyProtocol bool
+
+	mu       sync.Mutex
+	backends []*backend
+
+	// healthStop and healthDone control the goroutine started by
+	// StartHealthCheck.
+	healthStop chan struct{}
+	healthDone chan struct{}
+
+	// providerStop and providerDone control the goroutine started by
+	// SetBackendProvider.
+	providerStop chan struct{}
+	providerDone chan struct{}
+
+	// rebalanceStop and rebalanceDone control the goroutine started by
+	// Rebalance.
+	rebalanceStop chan struct{}
+	rebalanceDone chan struct{}
+
+	// background counts the goroutines started by StartHealthCheck,
+	// SetBackendProvider and Rebalance, all waited for by Shutdown.
+	background sync.WaitGroup
+
+	// healthChecked is closed and replaced after every round of health
+	// checks and when the checker stops, to wake WaitReady.
+	healthChecked chan struct{}
+
+	// conns holds the active proxied connections, shuttingDown is set by
+	// Shutdown.
+	conns        map[*proxyConn]struct{}
+	shuttingDown bool
+	// reserved counts the connections admitted under MaxConnections.
+	reserved int
+	// connSeq numbers the tracked connections for their IDs.
+	connSeq uint64
+
+	// ring is the ConsistentHash ring, rebuilt when the backends change.
+	ring *ring
+
+	// alias is the WeightedRandom alias table, rebuilt when the backends
+	// change.
+	alias *aliasTable
+
+	// tlsConfig is set by SetBackendTLSConfig.
+	tlsConfig *tls.Config
+
+	// shadow is set by SetShadowBackend.
+	shadow *url.URL
+
+	// buckets holds the ConnRateLimit state per client IP, swept of idle
+	// clients every rateLimitSweepInterval.
+	buckets      map[string]*bucket
+	bucketsSwept time.Time
 }
 
 // ProxyHandler returns a new http.Handler interface that reverse proxies the
@@ -69,8 +559,7 @@ func ProxyHandler() http.Handler { return NewProxy() }
 // URL's to the scheme, host and base path provider in target.
 func NewProxy() *WebsocketProxy {
 	var backends = make([]func(r *http.Request) *url.URL, 0)
-	var desolateBackend = make(map[int]int)
-	return &WebsocketProxy{Backends: backends, DesolateBackend: desolateBackend, ForwardMode:DefaultForwardMode}
+	return &WebsocketProxy{Backends: backends, ForwardMode: DefaultForwardMode}
 }
 
 func (w *WebsocketProxy) getRequestURL(target *url.URL) func(r *http.Request) *url.URL {
@@ -78,196 +567,881 @@ func (w *WebsocketProxy) getRequestURL(target *url.URL) func(r *http.Request) *u
 		// Shallow copy
 		u := *target
 		u.Fragment = r.URL.Fragment
-		u.Path = r.URL.Path
-		u.RawQuery = r.URL.RawQuery
+		if w.RewritePath != nil {
+			path := w.RewritePath(r.URL)
+			u.Path, u.RawPath, u.RawQuery = path, "", ""
+			if i := strings.IndexByte(path, '?'); i >= 0 {
+				u.Path, u.RawQuery = path[:i], path[i+1:]
+			}
+			return &u
+		}
+		u.Path = singleJoiningSlash(target.Path, r.URL.Path)
+		u.RawPath = ""
+		if target.RawQuery == "" || r.URL.RawQuery == "" {
+			u.RawQuery = target.RawQuery + r.URL.RawQuery
+		} else {
+			u.RawQuery = target.RawQuery + "&" + r.URL.RawQuery
+		}
 		return &u
 	}
 	return backend
 }
 
-func (w *WebsocketProxy) selectBackend() int {
-	var index, selectcnt int
-	backendcnt := len(w.Backends)
-	for{
-		if selectcnt >= backendcnt{
-			r := rand.New(rand.NewSource(time.Now().UnixNano()))
-			index = r.Intn(backendcnt)
-			break
+// singleJoiningSlash joins a and b with exactly one slash, as
+// httputil.NewSingleHostReverseProxy does.
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// AddBackend append backend to proxy. If protocols are given, the backend
+// only receives clients requesting one of these subprotocols or none at all.
+func (w *WebsocketProxy) AddBackend(target *url.URL, protocols ...string) {
+	w.AddBackendWeighted(target, 1, protocols...)
+}
+
+// AddBackendWithHeaders appends a backend like AddBackend whose dial
+// requests carry header, for example an API key of this backend alone. The
+// values replace those of the same headers set by the proxy or Director.
+// The WebSocket handshake headers cannot be set this way and are ignored.
+func (w *WebsocketProxy) AddBackendWithHeaders(target *url.URL, header http.Header, protocols ...string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.syncBackends()
+	backendFunc := w.getRequestURL(target)
+	w.Backends = append(w.Backends, backendFunc)
+	w.backends = append(w.backends, &backend{target: target, url: backendFunc, weight: 1, protocols: protocols, header: header.Clone()})
+}
+
+// AddBackendWithLimit appends a backend like AddBackend that is proxied at
+// most maxConns connections at a time. New connections go to the other
+// backends while it is full and fail as if no backend was available once
+// every backend is. The limit is checked when a backend is selected, so
+// handshakes under way at that moment may briefly exceed it. A maxConns of
+// zero or less means no limit.
+func (w *WebsocketProxy) AddBackendWithLimit(target *url.URL, maxConns int, protocols ...string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.syncBackends()
+	backendFunc := w.getRequestURL(target)
+	w.Backends = append(w.Backends, backendFunc)
+	w.backends = append(w.backends, &backend{target: target, url: backendFunc, weight: 1, protocols: protocols, maxConns: maxConns})
+}
+
+// AddBackendWeighted appends a backend that receives a share of the
+// connections proportional to weight. Weights below 1 are treated as 1.
+// protocols restrict the backend as with AddBackend.
+func (w *WebsocketProxy) AddBackendWeighted(target *url.URL, weight int, protocols ...string) {
+	if weight < 1 {
+		weight = 1
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.syncBackends()
+	backendFunc := w.getRequestURL(target)
+	w.Backends = append(w.Backends, backendFunc)
+	w.backends = append(w.backends, &backend{target: target, url: backendFunc, weight: weight, protocols: protocols})
+}
+
+// RemoveBackend removes the first backend added with a URL equal to target
+// and reports whether one was found. Connections already proxied to it are
+// left untouched.
+func (w *WebsocketProxy) RemoveBackend(target *url.URL) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	index := w.findBackend(target)
+	if index < 0 {
+		return false
+	}
+
+	w.Backends = append(w.Backends[:index], w.Backends[index+1:]...)
+	w.backends = append(w.backends[:index], w.backends[index+1:]...)
+	return true
+}
+
+// DrainBackend stops selecting the first backend added with a URL equal to
+// target, for example before taking it down, and reports whether one was
+// found. Connections already proxied to it are left to finish.
+func (w *WebsocketProxy) DrainBackend(target *url.URL) bool {
+	return w.setDraining(target, true)
+}
+
+// UndrainBackend puts a backend drained by DrainBackend back in rotation and
+// reports whether one was found.
+func (w *WebsocketProxy) UndrainBackend(target *url.URL) bool {
+	return w.setDraining(target, false)
+}
+
+func (w *WebsocketProxy) setDraining(target *url.URL, draining bool) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	index := w.findBackend(target)
+	if index < 0 {
+		return false
+	}
+	w.backends[index].draining = draining
+	return true
+}
+
+// SetBackendHost makes the handshakes with the backend added with a URL
+// equal to target send host, a host optionally followed by a port, as Host
+// header and TLS server name instead of the host of target, which is still
+// dialed. This reaches backends behind a shared endpoint routing by SNI or
+// Host. An empty host restores the default. It reports whether a backend
+// was found.
+func (w *WebsocketProxy) SetBackendHost(target *url.URL, host string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	index := w.findBackend(target)
+	if index < 0 {
+		return false
+	}
+	w.backends[index].host = host
+	return true
+}
+
+// findBackend returns the index of the first backend added with a URL equal
+// to target, or -1. Callers must hold mu.
+func (w *WebsocketProxy) findBackend(target *url.URL) int {
+	w.syncBackends()
+	for i := range w.Backends {
+		if b := w.backends[i]; b.target != nil && b.target.String() == target.String() {
+			return i
 		}
-		w.ReqCount++
-		index = w.ReqCount % backendcnt
-		if waitcnt, ok := w.DesolateBackend[index]; ok{
-			if waitcnt <= 0{
-				break
-			}else{
-				selectcnt++
-				w.DesolateBackend[index]--
-				continue
-			}
+	}
+	return -1
+}
+
+// SetBackends replaces the backends with targets in one step, for example
+// when the set changes as the service scales. Backends that stay keep their
+// weight, health and circuit state; new ones get a weight of 1. Connections
+// already proxied are left untouched, only new connections use the new set.
+func (w *WebsocketProxy) SetBackends(targets []*url.URL) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.syncBackends()
+	existing := make(map[string]*backend, len(w.backends))
+	for _, b := range w.backends {
+		if b.target != nil {
+			existing[b.target.String()] = b
 		}
-		break
 	}
 
-	return index
+	funcs := make([]func(*http.Request) *url.URL, 0, len(targets))
+	backends := make([]*backend, 0, len(targets))
+	for _, target := range targets {
+		b, ok := existing[target.String()]
+		if ok {
+			delete(existing, target.String())
+		} else {
+			b = &backend{target: target, url: w.getRequestURL(target), weight: 1}
+		}
+		funcs = append(funcs, b.url)
+		backends = append(backends, b)
+	}
+	w.Backends, w.backends = funcs, backends
 }
 
-// AddBackend append backend to proxy
-func (w *WebsocketProxy) AddBackend(target *url.URL) {
-	w.Backends = append(w.Backends, w.getRequestURL(target))
+// backendCount returns the number of registered backends.
+func (w *WebsocketProxy) backendCount() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.Backends)
 }
 
-func (w *WebsocketProxy) tryGetBackendConn(req *http.Request) (*websocket.Conn, http.Header, error){
-	backendCount := len(w.Backends)
-	for i := 0; i < backendCount; i++{
-		connBackend, upgradeHeader, err := w.connectBackend(req)
-		if err != nil{
-			continue
+func (w *WebsocketProxy) tryGetBackendConn(req *http.Request) (*proxyConn, http.Header, error) {
+	if target := w.route(req); target != nil {
+		pc, upgradeHeader, err := w.dialBackend(req, -1, nil, target)
+		if err != nil {
+			return nil, nil, err
+		}
+		w.requestLogger(req).Debugf("client(%s) through reverse proxy routed to server(%s)", req.RemoteAddr, pc.backend.RemoteAddr())
+		return pc, upgradeHeader, nil
+	}
+
+	backoff := w.RetryBackoff
+	for pass := 0; ; pass++ {
+		pc, upgradeHeader, err := w.tryBackends(req)
+		if err == nil {
+			return pc, upgradeHeader, nil
+		}
+		// A rejection is the backends' answer, trying again won't change it.
+		if _, ok := err.(*HandshakeError); ok || pass >= w.MaxRetries || w.backendCount() == 0 {
+			return nil, nil, err
 		}
-		log.Printf("client(%s) through reverse proxy connected to server(%s)\r\n", req.RemoteAddr, connBackend.RemoteAddr())
-		return connBackend, upgradeHeader, err
-	}
-	return nil, nil, errors.New("No backend available")
-}
-
-func (w *WebsocketProxy) connectBackend(req *http.Request) (*websocket.Conn, http.Header, error){
-	index := w.selectBackend()
-	backendURL := w.Backends[index](req)
-	dialer := w.Dialer
-	if w.Dialer == nil {	
-		dialer = DefaultDialer
-	}
-	// Pass headers from the incoming request to the dialer to forward them to
-	// the final destinations.
-	requestHeader := http.Header{}
-	if origin := req.Header.Get("Origin"); origin != "" {
-		requestHeader.Add("Origin", origin)
-	}
-	for _, prot := range req.Header[http.CanonicalHeaderKey("Sec-WebSocket-Protocol")] {
-		requestHeader.Add("Sec-WebSocket-Protocol", prot)
-	}
-	for _, cookie := range req.Header[http.CanonicalHeaderKey("Cookie")] {
-		requestHeader.Add("Cookie", cookie)
-	}
-
-	// Pass X-Forwarded-For headers too, code below is a part of
-	// httputil.ReverseProxy. See http://en.wikipedia.org/wiki/X-Forwarded-For
-	// for more information
-	// TODO: use RFC7239 http://tools.ietf.org/html/rfc7239
-	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
-		// If we aren't the first proxy retain prior
-		// X-Forwarded-For information as a comma+space
-		// separated list and fold multiple headers into one.
-		if prior, ok := req.Header["X-Forwarded-For"]; ok {
-			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+		w.requestLogger(req).Debugf("websocketproxy: no backend available for client(%s), retrying in %v", req.RemoteAddr, backoff)
+		select {
+		case <-req.Context().Done():
+			return nil, nil, err
+		case <-time.After(backoff):
 		}
-		requestHeader.Set("X-Forwarded-For", clientIP)
+		backoff *= 2
 	}
+}
 
-	// Set the originating protocol of the incoming HTTP request. The SSL might
-	// be terminated on our site and because we doing proxy adding this would
-	// be helpful for applications on the backend.
-	requestHeader.Set("X-Forwarded-Proto", "http")
-	if req.TLS != nil {
-		requestHeader.Set("X-Forwarded-Proto", "https")
+// tryBackends makes one pass over the backends, dialing them in turn until
+// one accepts the connection.
+func (w *WebsocketProxy) tryBackends(req *http.Request) (*proxyConn, http.Header, error) {
+	backendCount := w.backendCount()
+	if backendCount == 0 {
+		return nil, nil, errNoBackend
+	}
+	var rejected *HandshakeError
+	for i := 0; i < backendCount; i++ {
+		pc, upgradeHeader, err := w.connectBackend(req)
+		if err != nil && req.Context().Err() != nil {
+			return nil, nil, err
+		}
+		if err != nil {
+			// Remember the rejection as long as every backend answered
+			// with the same client error.
+			herr, ok := err.(*HandshakeError)
+			if i == 0 && ok {
+				rejected = herr
+			} else if !ok || rejected == nil || herr.StatusCode != rejected.StatusCode {
+				rejected = nil
+			}
+			continue
+		}
+		w.requestLogger(req).Debugf("client(%s) through reverse proxy connected to server(%s)", req.RemoteAddr, pc.backend.RemoteAddr())
+		return pc, upgradeHeader, err
 	}
+	if rejected != nil {
+		return nil, nil, rejected
+	}
+	return nil, nil, errNoBackend
+}
 
-	// Enable the director to copy any additional headers it desires for
-	// forwarding to the remote server.
-	if w.Director != nil {
-		w.Director(req, requestHeader)
+// connectBackend dials the selected backend and returns the backend side of
+// a proxyConn. The connection is counted against the selected backend from
+// its selection on, and on success until releaseBackend is called.
+func (w *WebsocketProxy) connectBackend(req *http.Request) (*proxyConn, http.Header, error) {
+	index, b := w.reserveBackend(req)
+	if index < 0 {
+		return nil, nil, errNoBackend
+	}
+	backendURL := b.url(req)
+	if backendURL != nil && w.RewriteBackendURL != nil {
+		u := *backendURL
+		backendURL = w.RewriteBackendURL(req, &u)
+	}
+	if backendURL == nil {
+		w.requestLogger(req).Debugf("websocketproxy: backend %d has no URL for client(%s)", index, req.RemoteAddr)
+		w.unreserveBackend(b)
+		return nil, nil, errNoBackendURL
+	}
+	pc, upgradeHeader, err := w.dialBackend(req, index, b, backendURL)
+	if err != nil {
+		w.unreserveBackend(b)
+	}
+	return pc, upgradeHeader, err
+}
+
+// route returns the backend URL chosen by Router for req, or nil if the
+// balancer has to pick one.
+func (w *WebsocketProxy) route(req *http.Request) *url.URL {
+	if w.Router == nil {
+		return nil
+	}
+	return w.Router(req)
+}
+
+// dialBackend dials backendURL for req. index and b identify the backend it
+// was selected from; they are -1 and nil for a URL returned by Router, in
+// which case no backend bookkeeping is updated.
+func (w *WebsocketProxy) dialBackend(req *http.Request, index int, b *backend, backendURL *url.URL) (*proxyConn, http.Header, error) {
+	dialer := w.dialer()
+	// Offer the backend the subprotocols and the compression requested by
+	// the client.
+	dialer.Subprotocols = subprotocols(req)
+	dialer.EnableCompression = dialer.EnableCompression && offersDeflate(req.Header)
+
+	requestHeader := w.requestHeader(req)
+	clientHeader := requestHeader.Clone()
+	baseTLSConfig := dialer.TLSClientConfig
+	if b != nil {
+		w.applyBackendSettings(b, dialer, requestHeader)
 	}
 
 	// Connect to the backend URL, also pass the headers we get from the requst
 	// together with the Forwarded headers we prepared above.
-	// TODO: support multiplexing on the same backend connection instead of
-	// opening a new TCP connection time for each request. This should be
-	// optional:
+	// Every client gets its own backend connection: a WebSocket session is
+	// stateful, so idle backend connections cannot be handed to another
+	// client without a multiplexing extension such as
 	// http://tools.ietf.org/html/draft-ietf-hybi-websocket-multiplexing-01
-	connBackend, resp, err := dialer.Dial(backendURL.String(), requestHeader)
+	// which backends rarely support. KeepAlive and ConnectTimeout tune the
+	// underlying TCP connections instead. The dial is aborted if the client
+	// goes away in the meantime.
+	var (
+		connBackend *websocket.Conn
+		resp        *http.Response
+		err         error
+	)
+	target := backendURL
+	for redirects := 0; ; redirects++ {
+		d := *dialer
+		aborted := abortOnDone(req.Context(), &d)
+		connBackend, resp, err = d.DialContext(req.Context(), target.String(), requestHeader)
+		if aborted() {
+			// Not the backend's fault, leave its health alone.
+			if err == nil {
+				connBackend.Close()
+			}
+			w.requestLogger(req).Debugf("websocketproxy: client(%s) went away while dialing server(%s)", req.RemoteAddr, target.Host)
+			return nil, nil, req.Context().Err()
+		}
+		if err == nil || resp == nil || resp.StatusCode < 300 || resp.StatusCode >= 400 {
+			break
+		}
+		next := redirectURL(target, resp)
+		if next == nil || redirects >= w.MaxBackendRedirects {
+			err = fmt.Errorf("%w: %s", errBackendRedirect, resp.Status)
+			break
+		}
+		w.requestLogger(req).Debugf("websocketproxy: server(%s) redirected client(%s) to %s", target.Host, req.RemoteAddr, next)
+		if next.Host != target.Host {
+			// SetBackendHost names the host of the backend, not the
+			// one redirected to, and the headers of the backend and the
+			// client's credentials are not meant for another host either.
+			requestHeader.Del("Host")
+			dialer.TLSClientConfig = baseTLSConfig
+			if b != nil {
+				w.mu.Lock()
+				header := b.header
+				w.mu.Unlock()
+				for name := range header {
+					requestHeader.Del(name)
+				}
+			}
+			for _, name := range credentialHeaders {
+				requestHeader.Del(name)
+			}
+		}
+		target = next
+	}
+	if w.LogHandshakes {
+		w.logHandshake(req, index, target, requestHeader, resp)
+	}
+	if err != nil && resp != nil && resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		// The backend is up but refuses this client, which must not count
+		// against the backend's health.
+		w.requestLogger(req).Errorf("server(%s) rejected client(%s): %s", backendURL.Host, req.RemoteAddr, resp.Status)
+		w.metrics().IncConnErrors(backendURL.Host)
+		w.backendUp(b, backendURL)
+		return nil, nil, newHandshakeError(resp)
+	}
 	if err != nil {
-		log.Printf("server(%s) not available\r\n", backendURL.Host)
-		w.DesolateBackend[index] = 5;
+		w.requestLogger(req).Errorf("server(%s) not available: %v", backendURL.Host, err)
+		w.metrics().IncConnErrors(backendURL.Host)
+		w.backendDown(b, backendURL, err)
 		return nil, nil, err
 	}
 
-	// Only pass those headers to the upgrader.
-	upgradeHeader := http.Header{}
-	if hdr := resp.Header.Get("Sec-Websocket-Protocol"); hdr != "" {
-		upgradeHeader.Set("Sec-Websocket-Protocol", hdr)
+	upgradeHeader := w.upgradeHeader(resp)
+	if b != nil {
+		if cookie := w.stickyCookie(index, b); cookie != nil {
+			upgradeHeader.Add("Set-Cookie", cookie.String())
+		}
+	}
+	w.backendUp(b, backendURL)
+	pc := &proxyConn{backend: connBackend, backendURL: backendURL, entry: b, header: clientHeader, deflate: offersDeflate(resp.Header)}
+	return pc, upgradeHeader, nil
+}
+
+// backendDown records that dialing the backend b failed with err. b is nil
+// for a URL returned by Router.
+func (w *WebsocketProxy) backendDown(b *backend, backendURL *url.URL, err error) {
+	if b != nil {
+		w.mu.Lock()
+		b.circuit.failure(time.Now(), w.failureThreshold(), w.cooldownDuration(), w.cooldownJitter())
+		b.down = true
+		w.mu.Unlock()
+	}
+
+	if w.OnBackendDown != nil {
+		w.OnBackendDown(backendURL, err)
+	}
+}
+
+// backendUp records that dialing the backend b succeeded. b is nil for a
+// URL returned by Router.
+func (w *WebsocketProxy) backendUp(b *backend, backendURL *url.URL) {
+	if b == nil {
+		return
 	}
-	if hdr := resp.Header.Get("Set-Cookie"); hdr != "" {
-		upgradeHeader.Set("Set-Cookie", hdr)
+	w.mu.Lock()
+	b.circuit.success()
+	wasDown := b.down
+	b.down = false
+	w.mu.Unlock()
+
+	if wasDown && w.OnBackendUp != nil {
+		w.OnBackendUp(backendURL)
 	}
-	w.DesolateBackend[index] = 0;
-	return connBackend, upgradeHeader, nil
 }
 
-func (w *WebsocketProxy) redirectModeHandler(rw http.ResponseWriter, req *http.Request){
-	index := w.selectBackend()
-	backendURL := w.Backends[index](req)
+// proxyError reports that req could not be proxied.
+func (w *WebsocketProxy) proxyError(req *http.Request, err error) {
+	if w.OnProxyError != nil {
+		w.OnProxyError(req, err)
+	}
+}
+
+func (w *WebsocketProxy) redirectModeHandler(rw http.ResponseWriter, req *http.Request) {
+	backendURL := w.route(req)
+	if backendURL == nil {
+		index, b := w.selectBackend(req)
+		if index >= 0 {
+			backendURL = b.url(req)
+		}
+		if backendURL == nil {
+			w.requestLogger(req).Errorf("websocketproxy: %v", errNoBackend)
+			w.proxyError(req, errNoBackend)
+			w.backendError(rw, req, errNoBackend)
+			return
+		}
+	}
 
-	redirectURL := "ws://"+backendURL.Host
-	http.Redirect(rw, req, redirectURL, http.StatusMovedPermanently)
-	log.Printf("client(%s) redirect to backend (%s)", req.RemoteAddr, redirectURL)
-	return 
+	// A temporary redirect keeps clients from caching the choice of backend,
+	// so every new connection goes through the balancer again.
+	redirectURL := backendURL.String()
+	http.Redirect(rw, req, redirectURL, http.StatusTemporaryRedirect)
+	w.requestLogger(req).Debugf("client(%s) redirect to backend (%s)", req.RemoteAddr, redirectURL)
 }
 
 func (w *WebsocketProxy) reverseModeHandler(rw http.ResponseWriter, req *http.Request){
-	connBackend, upgradeHeader, err := w.tryGetBackendConn(req)
-	if err != nil{
-		log.Println(err)
-		http.Error(rw, "internal server error (code: 2)", http.StatusInternalServerError)
+	// The upgrader only speaks the HTTP/1.1 handshake and cannot hijack an
+	// HTTP/2 stream, fail early with a clear answer instead.
+	if req.ProtoMajor >= 2 {
+		w.requestLogger(req).Errorf("websocketproxy: rejected client(%s), %v", req.RemoteAddr, errHTTP2)
+		w.proxyError(req, errHTTP2)
+		w.httpError(rw, req, errHTTP2, http.StatusHTTPVersionNotSupported, errHTTP2.Error())
 		return
 	}
+	if !w.reserveConn() {
+		w.requestLogger(req).Errorf("websocketproxy: rejected client(%s), %d connections reached", req.RemoteAddr, w.MaxConnections)
+		w.proxyError(req, errTooManyConnections)
+		rw.Header().Set("Retry-After", retryAfter)
+		w.httpError(rw, req, errTooManyConnections, http.StatusServiceUnavailable, "service unavailable")
+		return
+	}
+	defer w.releaseConn()
+
+	// Reject handshakes the upgrader would fail before a backend is dialed
+	// for nothing.
+	upgrader := w.upgrader()
+	if code, err := checkHandshake(upgrader, req); err != nil {
+		w.requestLogger(req).Errorf("websocketproxy: rejected client(%s), %v", req.RemoteAddr, err)
+		w.proxyError(req, err)
+		if code == http.StatusUpgradeRequired {
+			// RFC 6455 section 4.4: list the versions the client may
+			// retry with.
+			rw.Header().Set(headerVersion, "13")
+		}
+		w.httpError(rw, req, err, code, http.StatusText(code))
+		return
+	}
+
+	// A proxy the dialer cannot speak to is a configuration error, not a
+	// backend failure, so no backend is dialed or marked down for it.
+	if err := w.checkBackendProxy(); err != nil {
+		w.requestLogger(req).Errorf("websocketproxy: %v", err)
+		w.proxyError(req, err)
+		w.httpError(rw, req, err, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	if len(w.FanOutBackends) > 0 {
+		w.serveFanOut(rw, req, upgrader)
+		return
+	}
+
+	pc, upgradeHeader, err := w.tryGetBackendConn(req)
+	if herr, ok := err.(*HandshakeError); ok {
+		w.requestLogger(req).Errorf("websocketproxy: %v", err)
+		w.proxyError(req, err)
+		for name, values := range herr.Header {
+			rw.Header()[name] = values
+		}
+		w.httpError(rw, req, herr, herr.StatusCode, http.StatusText(herr.StatusCode))
+		return
+	}
+	if err != nil && req.Context().Err() != nil {
+		// The client went away, there is nobody left to answer.
+		return
+	}
+	if err != nil {
+		// No backend could be reached, every one is down or out of
+		// rotation or the one chosen by Router failed to dial.
+		w.requestLogger(req).Errorf("websocketproxy: %v", err)
+		w.proxyError(req, err)
+		w.backendError(rw, req, err)
+		return
+	}
+	// failover may replace the backend, release whichever is current.
+	defer func() { w.releaseBackend(pc.entry) }()
+	connBackend := pc.backend
 	defer connBackend.Close()
 
-	upgrader := w.Upgrader
-	if w.Upgrader == nil {
-		upgrader = DefaultUpgrader
+	// Agree with the client on the subprotocol selected by the backend. It
+	// is passed in the response header since the upgrader would only match
+	// Subprotocols against the first Sec-WebSocket-Protocol line. A
+	// subprotocol the client did not offer, or that Upgrader does not
+	// support, would make an invalid handshake, so fail instead.
+	if protocol := connBackend.Subprotocol(); protocol != "" {
+		if !acceptsSubprotocol(req, upgrader, protocol) {
+			w.requestLogger(req).Errorf("websocketproxy: %v: %q", errSubprotocol, protocol)
+			w.proxyError(req, errSubprotocol)
+			connBackend.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseProtocolError, "subprotocol not accepted"),
+				time.Now().Add(time.Second))
+			w.httpError(rw, req, errSubprotocol, http.StatusBadGateway, "bad gateway")
+			return
+		}
+		upgradeHeader.Set(headerProtocol, protocol)
 	}
+	upgrader.Subprotocols = nil
+	upgrader.EnableCompression = upgrader.EnableCompression && pc.deflate
 
 	// Now upgrade the existing incoming request to a WebSocket connection.
-	// Also pass the header that we gathered from the Dial handshake.
+	// Also pass the header that we gathered from the Dial handshake. The
+	// upgrader answers the client itself on failure, or cannot answer at
+	// all once the connection is hijacked, so there is no status to write
+	// here but the failure is still reported.
 	connPub, err := upgrader.Upgrade(rw, req, upgradeHeader)
 	if err != nil {
-		log.Printf("websocketproxy: couldn't upgrade %s\n", err)
+		w.requestLogger(req).Errorf("websocketproxy: couldn't upgrade %s", err)
+		w.proxyError(req, err)
+		// Let the backend know right away rather than when the deferred
+		// Close drops the connection.
+		connBackend.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "client handshake failed"),
+			time.Now().Add(time.Second))
 		return
 	}
 	defer connPub.Close()
 
-	errc := make(chan error, 2)
+	pc.client = connPub
+	pc.start = time.Now()
+	if !w.trackConn(pc) {
+		pc.close(w.shutdownClose())
+		return
+	}
+	defer w.untrackConn(pc)
+
+	metrics := w.metrics()
+	metrics.IncActiveConns(pc.backendURL.Host)
+	defer func(start time.Time) {
+		metrics.DecActiveConns(pc.backendURL.Host)
+		metrics.ObserveConnDuration(pc.backendURL.Host, time.Since(start))
+	}(time.Now())
+
+	if w.MaxMessageSize > 0 {
+		connPub.SetReadLimit(w.MaxMessageSize)
+	}
+	forwardClose(connPub, pc.backendConn)
+
+	if w.IdleTimeout > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		pc.keepAlive(w.IdleTimeout, done)
+	}
+	// Armed after keepAlive, whose pong handlers the forwarding ones
+	// replace.
+	w.armBackend(pc, connBackend)
+	if w.ForwardPings {
+		forwardPings(connPub, pc.backendConn, w.IdleTimeout)
+	}
+
+	defer w.armTimers(req, pc)()
+
+	var record func(int, []byte) *websocket.Conn
+	if w.ReplayEarlyMessages > 0 {
+		pc.replay = newReplayBuffer(w.ReplayEarlyMessages, pc.start.Add(w.replayWindow()))
+		record = pc.record
+	}
 
-	replicateWebsocketConn := func(dst, src *websocket.Conn, dstName, srcName string) {
+	var mirror func(int, []byte)
+	if shadow := w.startShadow(req, pc.header); shadow != nil {
+		defer shadow.close()
+		mirror = shadow.send
+	}
+
+	// Each copy goroutine reports the side that ended it and why.
+	type copyEnd struct {
+		side Side
+		err  error
+	}
+	errc := make(chan copyEnd, 2)
+	// ended is set by the first copy goroutine to stop. Errors seen by the
+	// second one are caused by the teardown and are not worth reporting.
+	var ended int32
+	copyError := func(format string, v ...interface{}) {
+		err := v[len(v)-1].(error)
+		if atomic.CompareAndSwapInt32(&ended, 0, 1) && !isNormalClose(err) {
+			w.requestLogger(req).Errorf(format, v...)
+			return
+		}
+		w.requestLogger(req).Debugf(format, v...)
+	}
+	// failover returns the backend connection replacing conn after it
+	// failed with err, or nil if the copy has to stop.
+	failover := func(conn *websocket.Conn, err error) *websocket.Conn {
+		if pc.replay == nil && !w.resumes() || !droppedConn(err) || atomic.LoadInt32(&ended) == 1 {
+			return nil
+		}
+		return w.failover(req, pc, conn)
+	}
+	replicateWebsocketConn := func(dst, src *websocket.Conn, dstSide, srcSide Side, hook func(int, []byte) (int, []byte, error), record func(int, []byte) *websocket.Conn, mirror func(int, []byte), copied *int64) {
+		defer func() {
+			if r := recover(); r != nil {
+				atomic.StoreInt32(&ended, 1)
+				err := w.connPanic(req, pc, fmt.Sprintf("copying from %s to %s", srcSide, dstSide), r)
+				errc <- copyEnd{ProxySide, err}
+			}
+		}()
+		var buf []byte
+		if w.StreamMessages && hook == nil && record == nil && mirror == nil {
+			buf = make([]byte, streamBufferSize)
+		}
 		var err error
+		side := srcSide
 		for {
-			msgType, msg, err := src.ReadMessage()
+			var msgType int
+			var msg []byte
+			var r io.Reader
+			if buf != nil {
+				msgType, r, err = src.NextReader()
+			} else {
+				msgType, msg, err = src.ReadMessage()
+			}
 			if err != nil {
-				log.Printf("websocketproxy: error when copying from %s to %s using ReadMessage: %v", srcName, dstName, err)
+				if next := failover(src, err); next != nil {
+					src = next
+					continue
+				}
+				copyError("websocketproxy: error when copying from %s to %s using ReadMessage: %v", srcSide, dstSide, err)
+				if err == websocket.ErrReadLimit {
+					pc.close(websocket.CloseMessageTooBig, "message too big")
+				}
 				break
 			}
-			err = dst.WriteMessage(msgType, msg)
-			if err != nil {
-				log.Printf("websocketproxy: error when copying from %s to %s using WriteMessage: %v", srcName, dstName, err)
+			if w.IdleTimeout > 0 {
+				src.SetReadDeadline(time.Now().Add(w.IdleTimeout))
+			}
+			if srcSide == ClientSide && !w.AllowedMessageTypes.allows(msgType) {
+				atomic.StoreInt32(&ended, 1)
+				w.requestLogger(req).Errorf("websocketproxy: message type %d from %s not allowed", msgType, srcSide)
+				pc.close(websocket.CloseUnsupportedData, "message type not allowed")
 				break
+			}
+			if hook != nil {
+				msgType, msg, err = hook(msgType, msg)
+				if err != nil {
+					atomic.StoreInt32(&ended, 1)
+					w.requestLogger(req).Errorf("websocketproxy: message from %s to %s rejected: %v", srcSide, dstSide, err)
+					pc.close(websocket.ClosePolicyViolation, "message rejected")
+					break
+				}
+			}
+			if record != nil {
+				dst = record(msgType, msg)
+			} else if w.resumes() && dstSide == BackendSide {
+				dst = pc.waitBackend()
+			}
+			if mirror != nil {
+				mirror(msgType, msg)
+			}
+			if w.WriteTimeout > 0 {
+				dst.SetWriteDeadline(time.Now().Add(w.WriteTimeout))
+			}
+			n := int64(len(msg))
+			if r != nil {
+				var readErr error
+				n, readErr, err = copyMessage(dst, msgType, r, buf)
+				if readErr != nil {
+					// Part of the message may have been written already,
+					// so there is nothing to fail over with.
+					err = readErr
+					copyError("websocketproxy: error when copying from %s to %s using NextReader: %v", srcSide, dstSide, err)
+					if err == websocket.ErrReadLimit {
+						pc.close(websocket.CloseMessageTooBig, "message too big")
+					}
+					break
+				}
 			} else {
-				//log.Printf("websocketproxy: copying from %s to %s completed without error.", srcName, dstName)
+				err = dst.WriteMessage(msgType, msg)
+			}
+			if err != nil {
+				// A recorded message is replayed by the failover.
+				if next := failover(dst, err); next != nil {
+					dst = next
+					atomic.AddInt64(copied, n)
+					continue
+				}
+				copyError("websocketproxy: error when copying from %s to %s using WriteMessage: %v", srcSide, dstSide, err)
+				side = dstSide
+				break
 			}
+			atomic.AddInt64(copied, n)
 		}
-		errc <- err
+		errc <- copyEnd{side, err}
+	}
+
+	clientHook := w.OnClientMessage
+	throttle := w.newThrottle()
+	if throttle != nil {
+		clientHook = throttle.hook(clientHook)
 	}
 
-	go replicateWebsocketConn(connPub, connBackend, "client", "backend")
-	go replicateWebsocketConn(connBackend, connPub, "backend", "client")
+	go replicateWebsocketConn(connPub, connBackend, ClientSide, BackendSide, w.OnBackendMessage, nil, nil, &pc.fromBackend)
+	go replicateWebsocketConn(connBackend, connPub, BackendSide, ClientSide, clientHook, record, mirror, &pc.fromClient)
 
+	// Once either direction stopped, tell the surviving peer why, tear down
+	// both connections and wait for the other copy goroutine so the byte
+	// counts are final. A connection the proxy closed itself has no
+	// survivor.
+	end := <-errc
+	if throttle != nil {
+		throttle.stop()
+	}
+	if pc.isClosed() {
+		end.side = ProxySide
+	} else {
+		survivor := pc.client
+		if end.side == ClientSide {
+			survivor = pc.backendConn()
+		}
+		survivor.WriteControl(websocket.CloseMessage, survivorCloseMessage(end.err), time.Now().Add(closeWriteTimeout))
+	}
+	pc.closeConns()
 	<-errc
+
+	if w.OnConnClose != nil {
+		stats := pc.stats()
+		stats.RequestID = RequestID(req)
+		stats.ClosedBy, stats.Err = end.side, end.err
+		w.OnConnClose(stats)
+	}
 }
 
 
+// isHTTP2Handshake reports whether req opens a WebSocket over HTTP/2, with
+// the extended CONNECT of RFC 8441 and a :protocol of websocket.
+func isHTTP2Handshake(req *http.Request) bool {
+	return req.ProtoMajor >= 2 && req.Method == http.MethodConnect &&
+		strings.EqualFold(req.Header.Get(":protocol"), "websocket")
+}
+
+// serveNonUpgrade answers a request that is not a WebSocket handshake, with
+// NonUpgradeHandler if set and otherwise with 426 Upgrade Required.
+func (w *WebsocketProxy) serveNonUpgrade(rw http.ResponseWriter, req *http.Request) {
+	if w.NonUpgradeHandler != nil {
+		w.NonUpgradeHandler.ServeHTTP(rw, req)
+		return
+	}
+	w.requestLogger(req).Debugf("websocketproxy: rejected client(%s), %v", req.RemoteAddr, errNotWebSocket)
+	rw.Header().Set("Upgrade", "websocket")
+	rw.Header().Set("Connection", "Upgrade")
+	w.httpError(rw, req, errNotWebSocket, http.StatusUpgradeRequired, "upgrade required")
+}
+
+// armBackend prepares conn, the backend connection of pc, for copying.
+func (w *WebsocketProxy) armBackend(pc *proxyConn, conn *websocket.Conn) {
+	if w.MaxMessageSize > 0 {
+		conn.SetReadLimit(w.MaxMessageSize)
+	}
+	if w.IdleTimeout > 0 {
+		armIdleTimeout(conn, w.IdleTimeout)
+	}
+	forwardClose(conn, func() *websocket.Conn { return pc.client })
+	if w.ForwardPings {
+		forwardPings(conn, func() *websocket.Conn { return pc.client }, w.IdleTimeout)
+	}
+}
+
+// isNormalClose reports whether err is a close frame for a normal closure,
+// sent by a peer that ends the session on purpose.
+func isNormalClose(err error) bool {
+	return websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway)
+}
+
+// connPanic handles r, recovered from a goroutine copying messages of pc
+// while doing what: it logs and reports the panic and closes pc with 1011
+// (internal error), so a single connection cannot take the process down.
+func (w *WebsocketProxy) connPanic(req *http.Request, pc *proxyConn, what string, r interface{}) error {
+	err := fmt.Errorf("panic %s: %v", what, r)
+	w.requestLogger(req).Errorf("websocketproxy: %v\n%s", err, debug.Stack())
+	w.proxyError(req, err)
+	pc.close(websocket.CloseInternalServerErr, "internal error")
+	return err
+}
+
+// recoverHandler contains a panic of ServeHTTP, for example in Director, to
+// the request that caused it. Connections are closed by the deferred calls
+// of the handler. A client not upgraded yet gets a 500 response.
+func (w *WebsocketProxy) recoverHandler(rw http.ResponseWriter, req *http.Request) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if r == http.ErrAbortHandler {
+		panic(r)
+	}
+	err := fmt.Errorf("panic serving client(%s): %v", req.RemoteAddr, r)
+	w.requestLogger(req).Errorf("websocketproxy: %v\n%s", err, debug.Stack())
+	w.proxyError(req, err)
+	w.httpError(rw, req, err, http.StatusInternalServerError, "internal server error (code: 3)")
+}
+
 // ServeHTTP implements the http.Handler that proxies WebSocket connections.
 func (w *WebsocketProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	if w.ForwardMode == DefaultForwardMode{
+	req = w.withRequestID(req)
+	defer w.recoverHandler(rw, req)
+
+	// HTTP/2 handshakes use an extended CONNECT instead and are rejected by
+	// the mode handlers.
+	if !websocket.IsWebSocketUpgrade(req) && !isHTTP2Handshake(req) {
+		w.serveNonUpgrade(rw, req)
+		return
+	}
+
+	if w.isShuttingDown() {
+		w.httpError(rw, req, errShuttingDown, http.StatusServiceUnavailable, "service unavailable")
+		return
+	}
+	if !w.allowConn(req) {
+		w.requestLogger(req).Errorf("websocketproxy: rejected client(%s), connection rate limit exceeded", req.RemoteAddr)
+		w.proxyError(req, errRateLimited)
+		rw.Header().Set("Retry-After", retryAfter)
+		w.httpError(rw, req, errRateLimited, http.StatusTooManyRequests, "too many requests")
+		return
+	}
+
+	switch w.ForwardMode {
+	case ReverseForwardMode:
 		w.reverseModeHandler(rw, req)
-	}else if w.ForwardMode == RedirectForwardMode{
+	case RedirectForwardMode:
 		w.redirectModeHandler(rw, req)
+	default:
+		err := fmt.Errorf("unknown forward mode %d", w.ForwardMode)
+		w.requestLogger(req).Errorf("websocketproxy: %v", err)
+		w.proxyError(req, err)
+		w.httpError(rw, req, err, http.StatusInternalServerError, "internal server error (code: 1)")
 	}
 }
@@ -1,12 +1,21 @@
 package websocketproxy
 
 import (
+	"bytes"
+	"crypto/tls"
+	"errors"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/button-chen/websocketproxy/wstest"
 	"github.com/gorilla/websocket"
 )
 
@@ -36,7 +45,7 @@ func TestProxy(t *testing.T) {
 	mux.Handle("/proxy", proxy)
 	go func() {
 		if err := http.ListenAndServe(":7777", mux); err != nil {
-			t.Fatal("ListenAndServe: ", err)
+			t.Error("ListenAndServe: ", err)
 		}
 	}()
 
@@ -64,7 +73,7 @@ func TestProxy(t *testing.T) {
 
 		err := http.ListenAndServe(":8888", mux2)
 		if err != nil {
-			t.Fatal("ListenAndServe: ", err)
+			t.Error("ListenAndServe: ", err)
 		}
 	}()
 
@@ -123,3 +132,616 @@ func TestProxy(t *testing.T) {
 		t.Errorf("expecting: %s, got: %s", msg, string(p))
 	}
 }
+
+// echoBackend is a WebSocket server echoing every message back to the
+// sender, with url short for URL.
+type echoBackend struct {
+	*wstest.Backend
+	url *url.URL
+}
+
+func newEchoBackend(t testing.TB) *echoBackend {
+	b := wstest.NewBackend(wstest.Options{})
+	t.Cleanup(b.Close)
+	return &echoBackend{Backend: b, url: b.URL}
+}
+
+// dialProxy connects a client to the proxy served by s.
+func dialProxy(t *testing.T, s *httptest.Server) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// newHandshakeRequest returns a WebSocket handshake request for target, to
+// be served with a ResponseRecorder.
+func newHandshakeRequest(target string) *http.Request {
+	req := httptest.NewRequest("GET", target, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	return req
+}
+
+// closedURL returns a ws:// URL pointing at a local port nobody listens on.
+func closedURL(t *testing.T) *url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	u, _ := url.Parse("ws://" + addr)
+	return u
+}
+
+func TestConcurrentServeHTTP(t *testing.T) {
+	proxy := NewProxy()
+	proxy.AddBackend(closedURL(t))
+	proxy.AddBackend(closedURL(t))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rw := httptest.NewRecorder()
+			req := newHandshakeRequest("/")
+			proxy.ServeHTTP(rw, req)
+			if rw.Code != http.StatusServiceUnavailable {
+				t.Errorf("expecting status %d, got: %d", http.StatusServiceUnavailable, rw.Code)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestFailover(t *testing.T) {
+	dead := closedURL(t)
+	u, headers := newHeaderBackend(t)
+
+	proxy := NewProxy()
+	proxy.AddBackend(dead)
+	proxy.AddBackend(u)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	h := http.Header{"Cookie": {"session=1"}}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), h)
+	if err != nil {
+		t.Fatalf("expecting the proxy to fail over to the live backend, got: %v", err)
+	}
+	conn.Close()
+
+	got := <-headers
+	if got.Get("Cookie") != "session=1" || got.Get("X-Forwarded-For") == "" {
+		t.Errorf("expecting forwarded headers on the live backend, got: %v", got)
+	}
+	if proxy.selectable(0) {
+		t.Error("expecting the circuit of the dead backend to be open")
+	}
+	if index, _ := proxy.selectBackend(nil); index != 1 {
+		t.Errorf("expecting the live backend to be selected, got: %d", index)
+	}
+}
+
+func TestRedirectForwardMode(t *testing.T) {
+	u, _ := url.Parse("wss://backend.example.com:9001")
+	proxy := NewProxy()
+	proxy.AddBackend(u)
+	proxy.ForwardMode = RedirectForwardMode
+
+	rw := httptest.NewRecorder()
+	req := newHandshakeRequest("/chat?room=1")
+	proxy.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusTemporaryRedirect {
+		t.Errorf("expecting status %d, got: %d", http.StatusTemporaryRedirect, rw.Code)
+	}
+	want := "wss://backend.example.com:9001/chat?room=1"
+	if loc := rw.Header().Get("Location"); loc != want {
+		t.Errorf("expecting location: %s, got: %s", want, loc)
+	}
+}
+
+func TestNonUpgradeRequest(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	if rw.Code != http.StatusUpgradeRequired {
+		t.Errorf("expecting status %d, got: %d", http.StatusUpgradeRequired, rw.Code)
+	}
+	if got := rw.Header().Get("Upgrade"); got != "websocket" {
+		t.Errorf("expecting the Upgrade header, got: %q", got)
+	}
+
+	proxy.NonUpgradeHandler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("ok"))
+	})
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/healthz", nil))
+	if rw.Code != http.StatusOK || rw.Body.String() != "ok" {
+		t.Errorf("expecting the request to be delegated, got: %d %q", rw.Code, rw.Body.String())
+	}
+
+	if n := b.Accepted(); n != 0 {
+		t.Errorf("expecting no backend dial for plain requests, got: %d", n)
+	}
+}
+
+func TestBackendBasePath(t *testing.T) {
+	tests := []struct {
+		backend, request, want string
+	}{
+		{"ws://backend:9001", "/chat?room=1", "ws://backend:9001/chat?room=1"},
+		{"ws://backend:9001/api", "/chat", "ws://backend:9001/api/chat"},
+		{"ws://backend:9001/api/", "/chat", "ws://backend:9001/api/chat"},
+		{"ws://backend:9001/api?v=2", "/chat?room=1", "ws://backend:9001/api/chat?v=2&room=1"},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.backend)
+		proxy := NewProxy()
+		proxy.AddBackend(u)
+		req := httptest.NewRequest("GET", tt.request, nil)
+		if got := proxy.Backends[0](req).String(); got != tt.want {
+			t.Errorf("backend %s, request %s: expecting %s, got: %s", tt.backend, tt.request, tt.want, got)
+		}
+	}
+}
+
+func TestRewritePath(t *testing.T) {
+	u, _ := url.Parse("ws://backend:9001/api")
+	proxy := NewProxy()
+	proxy.AddBackend(u)
+	proxy.RewritePath = func(in *url.URL) string {
+		return "/v2" + strings.TrimPrefix(in.Path, "/legacy") + "?" + in.RawQuery
+	}
+
+	req := httptest.NewRequest("GET", "/legacy/chat?room=1", nil)
+	want := "ws://backend:9001/v2/chat?room=1"
+	if got := proxy.Backends[0](req).String(); got != want {
+		t.Errorf("expecting %s, got: %s", want, got)
+	}
+}
+
+func TestRewriteBackendURL(t *testing.T) {
+	dialed := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dialed <- r.URL.RequestURI()
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	defer backend.Close()
+	u, _ := url.Parse("ws" + strings.TrimPrefix(backend.URL, "http") + "/api")
+	skipped := newEchoBackend(t)
+
+	proxy := NewProxy()
+	proxy.AddBackend(skipped.url)
+	proxy.AddBackend(u)
+	proxy.RewriteBackendURL = func(req *http.Request, selected *url.URL) *url.URL {
+		if selected.Host == skipped.url.Host {
+			return nil
+		}
+		q := selected.Query()
+		q.Set("token", req.Header.Get("X-Token"))
+		selected.RawQuery = q.Encode()
+		return selected
+	}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	h := http.Header{"X-Token": {"secret"}}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http")+"/chat?room=1", h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if got, want := <-dialed, "/api/chat?room=1&token=secret"; got != want {
+		t.Errorf("expecting %s to be dialed, got: %s", want, got)
+	}
+	if n := skipped.Accepted(); n != 0 {
+		t.Errorf("expecting the skipped backend not to be dialed, got: %d", n)
+	}
+}
+
+func TestRemoveBackend(t *testing.T) {
+	u1, _ := url.Parse("ws://127.0.0.1:9001")
+	u2, _ := url.Parse("ws://127.0.0.1:9002")
+	u3, _ := url.Parse("ws://127.0.0.1:9003")
+
+	proxy := NewProxy()
+	proxy.AddBackend(u1)
+	proxy.AddBackend(u2)
+	proxy.AddBackend(u3)
+	proxy.tripBackend(2, time.Hour)
+
+	if !proxy.RemoveBackend(u2) {
+		t.Fatal("expecting backend to be removed")
+	}
+	if proxy.RemoveBackend(u2) {
+		t.Error("removing an unknown backend should report false")
+	}
+	if len(proxy.Backends) != 2 {
+		t.Fatalf("expecting 2 backends, got: %d", len(proxy.Backends))
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	if got := proxy.Backends[1](req).Host; got != u3.Host {
+		t.Errorf("expecting: %s, got: %s", u3.Host, got)
+	}
+	if proxy.selectable(1) {
+		t.Error("expecting the open circuit to move along with its backend")
+	}
+}
+
+func TestSetBackends(t *testing.T) {
+	a := newEchoBackend(t)
+	b := newEchoBackend(t)
+
+	proxy := NewProxy()
+	proxy.AddBackend(a.url)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	inflight := dialProxy(t, s)
+	defer inflight.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conn.Close()
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		if i%2 == 0 {
+			proxy.SetBackends([]*url.URL{b.url})
+		} else {
+			proxy.SetBackends([]*url.URL{a.url, b.url})
+		}
+	}
+	wg.Wait()
+
+	proxy.SetBackends([]*url.URL{b.url})
+	before := b.Accepted()
+	dialProxy(t, s).Close()
+	if n := b.Accepted(); n != before+1 {
+		t.Errorf("expecting the new connection on the new backend, got: %d", n-before)
+	}
+
+	// The connection proxied before the swap still works.
+	if err := inflight.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := inflight.ReadMessage(); err != nil || string(msg) != "hello" {
+		t.Errorf("expecting the in-flight connection to survive, got: %q, %v", msg, err)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	b := newToggleBackend(t, true)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.MaxRetries = 5
+	proxy.RetryBackoff = 20 * time.Millisecond
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	// The backend comes back while the proxy is still retrying.
+	time.AfterFunc(50*time.Millisecond, func() {
+		atomic.StoreInt32(&b.down, 0)
+	})
+	dialProxy(t, s).Close()
+	if n := atomic.LoadInt32(&b.proxied); n != 1 {
+		t.Errorf("expecting the retried connection on the backend, got: %d", n)
+	}
+
+	// Without retries a backend that is down fails the handshake.
+	atomic.StoreInt32(&b.down, 1)
+	proxy.MaxRetries = 0
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expecting the handshake to fail with 503, got: %v", err)
+	}
+}
+
+func TestHTTP2Rejected(t *testing.T) {
+	var proxyErr error
+	proxy := NewProxy()
+	proxy.AddBackend(closedURL(t))
+	proxy.OnProxyError = func(req *http.Request, err error) {
+		proxyErr = err
+	}
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("CONNECT", "/", nil)
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+	req.Header.Set(":protocol", "websocket")
+	proxy.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusHTTPVersionNotSupported {
+		t.Errorf("expecting status %d, got: %d", http.StatusHTTPVersionNotSupported, rw.Code)
+	}
+	if proxyErr != errHTTP2 {
+		t.Errorf("expecting the HTTP/2 error to be reported, got: %v", proxyErr)
+	}
+}
+
+func TestHTTP2NonUpgrade(t *testing.T) {
+	proxy := NewProxy()
+	proxy.AddBackend(closedURL(t))
+	proxy.ForwardMode = RedirectForwardMode
+
+	for _, method := range []string{"GET", "CONNECT"} {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/healthz", nil)
+		req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+		proxy.ServeHTTP(rw, req)
+		if rw.Code != http.StatusUpgradeRequired {
+			t.Errorf("%s: expecting status %d, got: %d", method, http.StatusUpgradeRequired, rw.Code)
+		}
+	}
+
+	proxy.NonUpgradeHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/healthz", nil)
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+	proxy.ServeHTTP(rw, req)
+	if rw.Code != http.StatusNoContent {
+		t.Errorf("expecting NonUpgradeHandler to serve HTTP/2 requests, got: %d", rw.Code)
+	}
+}
+
+func TestMessageHooks(t *testing.T) {
+	b := newEchoBackend(t)
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.OnClientMessage = func(msgType int, data []byte) (int, []byte, error) {
+		if string(data) == "bye" {
+			return 0, nil, errors.New("forbidden message")
+		}
+		return msgType, bytes.ToUpper(data), nil
+	}
+	proxy.OnBackendMessage = func(msgType int, data []byte) (int, []byte, error) {
+		return websocket.BinaryMessage, append(data, '!'), nil
+	}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	conn := dialProxy(t, s)
+	defer conn.Close()
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	messageType, p, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messageType != websocket.BinaryMessage || string(p) != "HELLO!" {
+		t.Errorf("expecting binary HELLO!, got: %d %s", messageType, p)
+	}
+
+	// A hook error tears the connection down.
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Error("expecting the connection to be closed")
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	b := newEchoBackend(t)
+	var proxyErrs int32
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.Logger = &recordingLogger{}
+	proxy.OnProxyError = func(*http.Request, error) {
+		atomic.AddInt32(&proxyErrs, 1)
+	}
+	proxy.OnClientMessage = func(msgType int, data []byte) (int, []byte, error) {
+		if string(data) == "boom" {
+			panic("bad hook")
+		}
+		return msgType, data, nil
+	}
+	proxy.Director = func(req *http.Request, out http.Header) {
+		if req.URL.Path == "/boom" {
+			panic("bad director")
+		}
+	}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyURL := "ws" + strings.TrimPrefix(s.URL, "http")
+
+	// A panicking hook closes its connection with 1011.
+	conn := dialProxy(t, s)
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("boom")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseInternalServerErr) {
+		t.Errorf("expecting close 1011, got: %v", err)
+	}
+
+	// A panicking Director fails the handshake with 500.
+	_, resp, err := websocket.DefaultDialer.Dial(proxyURL+"/boom", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expecting status 500, got: %v", err)
+	}
+
+	// The proxy keeps serving.
+	conn2 := dialProxy(t, s)
+	defer conn2.Close()
+	if err := conn2.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := conn2.ReadMessage(); err != nil || string(msg) != "hello" {
+		t.Errorf("expecting echo after the panics, got: %q, %v", msg, err)
+	}
+	if n := atomic.LoadInt32(&proxyErrs); n != 2 {
+		t.Errorf("expecting 2 proxy errors, got: %d", n)
+	}
+}
+
+func TestNoBackends(t *testing.T) {
+	for _, mode := range []int{ReverseForwardMode, RedirectForwardMode} {
+		proxy := NewProxy()
+		proxy.ForwardMode = mode
+
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, newHandshakeRequest("/"))
+		if rw.Code != http.StatusServiceUnavailable {
+			t.Errorf("mode %d: expecting status %d, got: %d", mode, http.StatusServiceUnavailable, rw.Code)
+		}
+		if rw.Header().Get("Retry-After") == "" {
+			t.Errorf("mode %d: expecting a Retry-After header", mode)
+		}
+	}
+}
+
+func TestSetBackendHost(t *testing.T) {
+	type handshake struct{ host, serverName string }
+	handshakes := make(chan handshake, 1)
+	upgrader := websocket.Upgrader{}
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handshakes <- handshake{r.Host, r.TLS.ServerName}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	backend.StartTLS()
+	defer backend.Close()
+	u, _ := url.Parse("wss" + strings.TrimPrefix(backend.URL, "https"))
+
+	proxy := NewProxy()
+	proxy.AddBackend(u)
+	// The test certificate is valid for example.com.
+	proxy.SetBackendTLSConfig(&tls.Config{RootCAs: backend.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs})
+	if !proxy.SetBackendHost(u, "example.com:8443") {
+		t.Fatal("expecting the backend to be found")
+	}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	dialProxy(t, s).Close()
+	got := <-handshakes
+	if got.host != "example.com:8443" || got.serverName != "example.com" {
+		t.Errorf("expecting Host example.com:8443 and SNI example.com, got: %+v", got)
+	}
+
+	proxy.SetBackendHost(u, "")
+	proxy.SetBackendTLSConfig(&tls.Config{InsecureSkipVerify: true})
+	dialProxy(t, s).Close()
+	if got := <-handshakes; got.host != u.Host {
+		t.Errorf("expecting the default Host %s, got: %s", u.Host, got.host)
+	}
+}
+
+func TestBackendTLSConfig(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		messageType, p, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		conn.WriteMessage(messageType, p)
+	}))
+	defer backend.Close()
+	u, _ := url.Parse("wss" + strings.TrimPrefix(backend.URL, "https"))
+
+	proxy := NewProxy()
+	proxy.AddBackend(u)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	// The self-signed certificate is rejected by default.
+	if _, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.URL, "http"), nil); err == nil {
+		t.Fatal("expecting the handshake to fail without a TLS config")
+	}
+
+	proxy.SetBackendTLSConfig(&tls.Config{InsecureSkipVerify: true})
+	conn := dialProxy(t, s)
+	defer conn.Close()
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello tls")); err != nil {
+		t.Fatal(err)
+	}
+	if _, p, err := conn.ReadMessage(); err != nil || string(p) != "hello tls" {
+		t.Errorf("expecting echo over wss, got: %q, %v", p, err)
+	}
+	if DefaultDialer.TLSClientConfig != nil {
+		t.Error("DefaultDialer must not be modified")
+	}
+}
+
+func TestLifecycleCallbacks(t *testing.T) {
+	b := newToggleBackend(t, true)
+
+	var mu sync.Mutex
+	var events []string
+	record := func(event string) {
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+	}
+
+	proxy := NewProxy()
+	proxy.AddBackend(b.url)
+	proxy.OnBackendDown = func(backend *url.URL, err error) {
+		if err == nil {
+			t.Error("expecting an error with OnBackendDown")
+		}
+		record("down " + backend.Host)
+	}
+	proxy.OnBackendUp = func(backend *url.URL) {
+		record("up " + backend.Host)
+	}
+	proxy.OnProxyError = func(req *http.Request, err error) {
+		record("error " + err.Error())
+	}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	proxyURL := "ws" + strings.TrimPrefix(s.URL, "http")
+	if _, _, err := websocket.DefaultDialer.Dial(proxyURL, nil); err == nil {
+		t.Fatal("expecting the handshake to fail while the backend is down")
+	}
+	atomic.StoreInt32(&b.down, 0)
+	dialProxy(t, s).Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"down " + b.url.Host, "error No backend available", "up " + b.url.Host}
+	if strings.Join(events, "|") != strings.Join(want, "|") {
+		t.Errorf("expecting events %q, got: %q", want, events)
+	}
+}
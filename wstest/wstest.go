@@ -0,0 +1,140 @@
+// Package wstest provides WebSocket backends for testing code that uses
+// websocketproxy, in the spirit of net/http/httptest. A backend echoes the
+// messages it receives and can be told to drop connections or reject
+// handshakes to exercise the failover paths of the proxy:
+//
+//	backend := wstest.NewBackend(wstest.Options{})
+//	defer backend.Close()
+//
+//	proxy := websocketproxy.NewProxy()
+//	proxy.AddBackend(backend.URL)
+package wstest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// Options configures a Backend. The zero value echoes every message.
+type Options struct {
+	// DropAfter, if non-zero, makes the backend drop each connection
+	// without a close frame once it received this many messages. The last
+	// one is not echoed.
+	DropAfter int
+
+	// RejectStatus, if non-zero, makes the backend answer every handshake
+	// with this status instead of upgrading the connection.
+	RejectStatus int
+}
+
+// Backend is a WebSocket server listening on the loopback interface.
+type Backend struct {
+	// URL is the ws:// URL of the backend.
+	URL *url.URL
+
+	// Server is the underlying HTTP server.
+	Server *httptest.Server
+
+	accepted int64
+	opts     Options
+	upgrader websocket.Upgrader
+
+	mu     sync.Mutex
+	conns  map[*websocket.Conn]struct{}
+	closed bool
+}
+
+// NewBackend starts and returns a backend behaving as set by opts. The
+// caller should call Close when finished, to shut it down.
+func NewBackend(opts Options) *Backend {
+	b := &Backend{opts: opts, conns: make(map[*websocket.Conn]struct{})}
+	b.Server = httptest.NewServer(http.HandlerFunc(b.serve))
+	b.URL, _ = url.Parse("ws" + strings.TrimPrefix(b.Server.URL, "http"))
+	return b
+}
+
+// Accepted returns the number of handshakes the backend accepted so far. A
+// handshake is counted before it is answered, so once a client connected
+// through the proxy its connection is included.
+func (b *Backend) Accepted() int {
+	return int(atomic.LoadInt64(&b.accepted))
+}
+
+// Close shuts down the backend and blocks until all its connections are
+// closed. Upgraded connections are closed without a close frame, as if the
+// backend went down.
+func (b *Backend) Close() {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.CloseClientConnections()
+	b.Server.Close()
+}
+
+// CloseClientConnections drops every connection to the backend, upgraded
+// or not, without a close frame. The backend keeps accepting new ones
+// unless it was closed.
+func (b *Backend) CloseClientConnections() {
+	b.mu.Lock()
+	for conn := range b.conns {
+		conn.UnderlyingConn().Close()
+	}
+	b.mu.Unlock()
+	b.Server.CloseClientConnections()
+}
+
+// track registers conn so that Close can drop it. It returns false if the
+// backend is closing, in which case conn must be closed.
+func (b *Backend) track(conn *websocket.Conn) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return false
+	}
+	b.conns[conn] = struct{}{}
+	return true
+}
+
+func (b *Backend) untrack(conn *websocket.Conn) {
+	b.mu.Lock()
+	delete(b.conns, conn)
+	b.mu.Unlock()
+}
+
+func (b *Backend) serve(w http.ResponseWriter, r *http.Request) {
+	if b.opts.RejectStatus != 0 {
+		http.Error(w, http.StatusText(b.opts.RejectStatus), b.opts.RejectStatus)
+		return
+	}
+	atomic.AddInt64(&b.accepted, 1)
+	conn, err := b.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if !b.track(conn) {
+		return
+	}
+	defer b.untrack(conn)
+
+	for received := 1; ; received++ {
+		messageType, p, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if received == b.opts.DropAfter {
+			conn.UnderlyingConn().Close()
+			return
+		}
+		if err = conn.WriteMessage(messageType, p); err != nil {
+			return
+		}
+	}
+}
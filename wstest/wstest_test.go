@@ -0,0 +1,86 @@
+package wstest
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestBackend(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   Options
+		echoes int
+		status int
+	}{
+		{"echo", Options{}, 3, http.StatusSwitchingProtocols},
+		{"drop", Options{DropAfter: 2}, 1, http.StatusSwitchingProtocols},
+		{"reject", Options{RejectStatus: http.StatusForbidden}, 0, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		b := NewBackend(tt.opts)
+		conn, resp, err := websocket.DefaultDialer.Dial(b.URL.String(), nil)
+		if resp == nil || resp.StatusCode != tt.status {
+			t.Errorf("%s: expecting status %d, got: %v", tt.name, tt.status, err)
+		}
+		echoes := 0
+		if err == nil {
+			for i := 0; i < 3; i++ {
+				if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+					break
+				}
+				if _, p, err := conn.ReadMessage(); err != nil || string(p) != "hello" {
+					break
+				}
+				echoes++
+			}
+			conn.Close()
+		}
+		if echoes != tt.echoes {
+			t.Errorf("%s: expecting %d echoes, got: %d", tt.name, tt.echoes, echoes)
+		}
+		wantAccepted := 1
+		if tt.opts.RejectStatus != 0 {
+			wantAccepted = 0
+		}
+		if n := b.Accepted(); n != wantAccepted {
+			t.Errorf("%s: expecting %d accepted handshakes, got: %d", tt.name, wantAccepted, n)
+		}
+		b.Close()
+	}
+}
+
+func TestBackendClose(t *testing.T) {
+	b := NewBackend(Options{})
+	conn, _, err := websocket.DefaultDialer.Dial(b.URL.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	b.CloseClientConnections()
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Error("expecting the connection to be dropped")
+	}
+	conn, _, err = websocket.DefaultDialer.Dial(b.URL.String(), nil)
+	if err != nil {
+		t.Fatalf("expecting the backend to accept new connections, got: %v", err)
+	}
+	defer conn.Close()
+
+	closed := make(chan struct{})
+	go func() {
+		b.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("expecting Close not to wait for the client to leave")
+	}
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Error("expecting the connection to be closed with the backend")
+	}
+}